@@ -23,6 +23,18 @@ func main() {
 			os.Exit(1)
 		}
 		cli.Index(os.Args[2:])
+	case "duplicates":
+		cli.Duplicates(os.Args[2:])
+	case "topics":
+		cli.Topics(os.Args[2:])
+	case "autotag":
+		cli.Autotag(os.Args[2:])
+	case "grep":
+		cli.Grep(os.Args[2:])
+	case "hooks":
+		cli.Hooks(os.Args[2:])
+	case "hook":
+		cli.Hook(os.Args[2:])
 	case "server":
 		server.Main()
 	}
@@ -2,12 +2,17 @@ package cli
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/vasilisp/wikai/internal/util"
 	"github.com/vasilisp/wikai/pkg/api"
@@ -73,7 +78,7 @@ func Index(args []string) {
 		pagePath := strings.TrimSuffix(arg, ".md")
 
 		if err := util.ValidatePagePath(pagePath); err != nil {
-			log.Fatal("invalid page path: %w", err)
+			log.Fatalf("invalid page path: %v", err)
 		}
 
 		builder.WriteString(pagePath)
@@ -95,9 +100,317 @@ func Index(args []string) {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode != http.StatusAccepted {
 		log.Fatalf("Failed to index: %s", resp.Status)
 	}
 
-	log.Printf("Indexed %d pages", len(args))
+	var job api.IndexJob
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		log.Fatal("Failed to decode response:", err)
+	}
+
+	job = waitForJob(client, 8080, job)
+
+	log.Printf("Indexed %d pages", job.Done-job.Failed)
+
+	if job.State == api.JobCancelled {
+		log.Printf("Indexing cancelled, %d pages not indexed", job.Total-job.Done)
+		os.Exit(1)
+	}
+
+	if job.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+const jobPollInterval = 500 * time.Millisecond
+
+func jobRequest(client *http.Client, method string, port int, id string) (api.IndexJob, error) {
+	req, err := http.NewRequest(method, fmt.Sprintf("http://localhost:%d%s%s", port, api.JobsPath, id), nil)
+	if err != nil {
+		return api.IndexJob{}, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return api.IndexJob{}, fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return api.IndexJob{}, fmt.Errorf("failed to get job status: %s", resp.Status)
+	}
+
+	var job api.IndexJob
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return api.IndexJob{}, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	return job, nil
+}
+
+// waitForJob polls the job until it finishes, printing progress and
+// per-page failures. An interrupt cancels the job.
+func waitForJob(client *http.Client, port int, job api.IndexJob) api.IndexJob {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	reported := make(map[string]bool)
+	lastDone := -1
+
+	for {
+		for _, page := range job.Results {
+			if page.State == api.PageFailed && !reported[page.Path] {
+				log.Printf("Failed to index %s: %s", page.Path, page.Error)
+				reported[page.Path] = true
+			}
+		}
+
+		if job.Done != lastDone {
+			log.Printf("Progress: %d/%d pages (%d failed)", job.Done, job.Total, job.Failed)
+			lastDone = job.Done
+		}
+
+		if job.State.Finished() {
+			return job
+		}
+
+		method := http.MethodGet
+		select {
+		case <-interrupt:
+			log.Printf("Cancelling job %s", job.ID)
+			method = http.MethodDelete
+		case <-ticker.C:
+		}
+
+		var err error
+		job, err = jobRequest(client, method, port, job.ID)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// Duplicates prints the pairs of pages that are likely duplicates, above an
+// optional similarity threshold
+func Duplicates(args []string) {
+	if len(args) > 1 {
+		log.Fatal("Usage: wikai duplicates [threshold]")
+	}
+
+	url := fmt.Sprintf("http://localhost:%d%s", 8080, api.DuplicatesPath)
+	if len(args) == 1 {
+		if _, err := strconv.ParseFloat(args[0], 64); err != nil {
+			log.Fatalf("invalid threshold: %v", err)
+		}
+		url += "?threshold=" + args[0]
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		log.Fatal("Failed to send request:", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("Failed to get duplicates: %s", resp.Status)
+	}
+
+	var duplicates []api.Duplicate
+	if err := json.NewDecoder(resp.Body).Decode(&duplicates); err != nil {
+		log.Fatal("Failed to decode response:", err)
+	}
+
+	for _, duplicate := range duplicates {
+		fmt.Printf("%.3f\t%s\t%s\n", duplicate.Similarity, duplicate.A.Path, duplicate.B.Path)
+	}
+}
+
+// Topics regenerates the topic pages, clustering into an optional number of
+// topics from an optional seed, and prints the topics
+func Topics(args []string) {
+	if len(args) > 2 {
+		log.Fatal("Usage: wikai topics [k [seed]]")
+	}
+
+	params := url.Values{}
+	if len(args) > 0 {
+		if k, err := strconv.Atoi(args[0]); err != nil || k <= 0 {
+			log.Fatalf("invalid number of topics: %s", args[0])
+		}
+		params.Set("k", args[0])
+	}
+	if len(args) > 1 {
+		if _, err := strconv.ParseInt(args[1], 10, 64); err != nil {
+			log.Fatalf("invalid seed: %v", err)
+		}
+		params.Set("seed", args[1])
+	}
+
+	resp, err := http.Post(fmt.Sprintf("http://localhost:%d%s?%s", 8080, api.TopicsPath, params.Encode()), "text/plain", nil)
+	if err != nil {
+		log.Fatal("Failed to send request:", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Failed to refresh topics: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var topics api.Topics
+	if err := json.NewDecoder(resp.Body).Decode(&topics); err != nil {
+		log.Fatal("Failed to decode response:", err)
+	}
+
+	for _, topic := range topics.Topics {
+		fmt.Printf("%s\t%s\t%d pages\n", topic.Path, topic.Name, len(topic.Pages))
+	}
+	for _, path := range topics.Removed {
+		fmt.Printf("%s\tremoved\n", path)
+	}
+}
+
+// Autotag prints the tags that would be added to every page, as JSON with
+// -json, and adds those of a file of such proposals, once reviewed, with
+// apply
+func Autotag(args []string) {
+	method := http.MethodGet
+	var body io.Reader
+	printJSON := false
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && args[0] == "-json":
+		printJSON = true
+	case len(args) == 2 && args[0] == "apply":
+		// the proposals, as printed with -json and reviewed; - is the
+		// standard input
+		method = http.MethodPost
+		body = os.Stdin
+		if args[1] != "-" {
+			file, err := os.Open(args[1])
+			if err != nil {
+				log.Fatal("Failed to open proposals:", err)
+			}
+			defer file.Close()
+			body = file
+		}
+	default:
+		log.Fatal("Usage: wikai autotag [-json] | wikai autotag apply <file>")
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("http://localhost:%d%s", 8080, api.AutotagPath), body)
+	if err != nil {
+		log.Fatal("Failed to create request:", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal("Failed to send request:", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Failed to tag pages: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var proposals []api.TagProposal
+	if err := json.NewDecoder(resp.Body).Decode(&proposals); err != nil {
+		log.Fatal("Failed to decode response:", err)
+	}
+
+	if printJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(proposals)
+		return
+	}
+
+	for _, proposal := range proposals {
+		fmt.Printf("%s\t+%s\t(has %s)\n", proposal.Path, strings.Join(proposal.Add, ", +"), strings.Join(proposal.Tags, ", "))
+	}
+
+	if method == http.MethodGet {
+		fmt.Printf("%d pages would be tagged; review the output of wikai autotag -json and pass it to wikai autotag apply to tag them\n", len(proposals))
+	} else {
+		fmt.Printf("tagged %d pages\n", len(proposals))
+	}
+}
+
+// Grep prints the lines of pages matching a pattern, in the style of grep -n
+func Grep(args []string) {
+	flags := flag.NewFlagSet("grep", flag.ExitOnError)
+	regex := flags.Bool("E", false, "interpret the pattern as a regular expression")
+	ignoreCase := flags.Bool("i", false, "ignore case")
+	context := flags.Int("C", 0, "lines of context around each match")
+	rev := flags.String("rev", "", "search this git revision instead of the working tree")
+	prefix := flags.String("prefix", "", "only search pages under this directory")
+	limit := flags.Int("limit", 0, "most matches to print")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: wikai grep [options] <pattern>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	params := url.Values{}
+	params.Set("q", flags.Arg(0))
+	params.Set("regex", strconv.FormatBool(*regex))
+	params.Set("ignore_case", strconv.FormatBool(*ignoreCase))
+	params.Set("context", strconv.Itoa(*context))
+	if *rev != "" {
+		params.Set("rev", *rev)
+	}
+	if *prefix != "" {
+		params.Set("prefix", strings.Trim(*prefix, "/")+"/")
+	}
+	if *limit > 0 {
+		params.Set("limit", strconv.Itoa(*limit))
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d%s?%s", 8080, api.GrepPath, params.Encode()))
+	if err != nil {
+		log.Fatal("Failed to send request:", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Failed to grep: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var result api.GrepResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		log.Fatal("Failed to decode response:", err)
+	}
+
+	for i, match := range result.Matches {
+		if *context > 0 && i > 0 {
+			fmt.Println("--")
+		}
+		for j, line := range match.Before {
+			fmt.Printf("%s.md-%d-%s\n", match.Path, match.Line-len(match.Before)+j, line)
+		}
+		fmt.Printf("%s.md:%d:%s\n", match.Path, match.Line, match.Text)
+		for j, line := range match.After {
+			fmt.Printf("%s.md-%d-%s\n", match.Path, match.Line+1+j, line)
+		}
+	}
+
+	if result.Truncated {
+		log.Printf("only the first %d matches are shown", len(result.Matches))
+	}
+
+	if len(result.Matches) == 0 {
+		os.Exit(1)
+	}
 }
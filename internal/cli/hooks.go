@@ -0,0 +1,334 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/vasilisp/wikai/internal/util"
+	"github.com/vasilisp/wikai/pkg/api"
+)
+
+// hooks that keep the server in sync with commits, merges and checkouts
+var hookNames = []string{"post-commit", "post-merge", "post-checkout"}
+
+// the lines wikai owns in a hook are between these markers
+const (
+	hookBegin = "# BEGIN wikai"
+	hookEnd   = "# END wikai"
+)
+
+// shells the block can be added to
+var hookShells = []string{"sh", "bash", "dash", "ksh", "zsh"}
+
+// script of the hooks installed where there were none
+const newHookScript = "#!/bin/sh\n"
+
+func gitOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return string(out), nil
+}
+
+// hooksDir returns the directory git runs the hooks of repo from, honouring
+// core.hooksPath
+func hooksDir(repo string) (string, error) {
+	out, err := gitOutput(repo, "rev-parse", "--git-path", "hooks")
+	if err != nil {
+		return "", err
+	}
+
+	dir := strings.TrimSpace(out)
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(repo, dir)
+	}
+
+	return dir, nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func hookBlock(exe string, name string) string {
+	return fmt.Sprintf("%s\n%s hook %s \"$@\" || true\n%s\n", hookBegin, shellQuote(exe), name, hookEnd)
+}
+
+// splitShebang splits a script into its #! line, if any, and the rest
+func splitShebang(script string) (string, string) {
+	if !strings.HasPrefix(script, "#!") {
+		return "", script
+	}
+
+	line, rest, _ := strings.Cut(script, "\n")
+	return line + "\n", rest
+}
+
+func isShellShebang(shebang string) bool {
+	if shebang == "" {
+		return true
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(shebang, "#!"))
+	if len(fields) == 0 {
+		return false
+	}
+
+	interpreter := filepath.Base(fields[0])
+	if interpreter == "env" && len(fields) > 1 {
+		interpreter = fields[1]
+	}
+
+	return slices.Contains(hookShells, interpreter)
+}
+
+// stripHookBlock removes the wikai block from a script, telling whether there
+// was one
+func stripHookBlock(script string) (string, bool) {
+	var builder strings.Builder
+	found, inBlock := false, false
+
+	for _, line := range strings.SplitAfter(script, "\n") {
+		switch strings.TrimSpace(line) {
+		case hookBegin:
+			found, inBlock = true, true
+			continue
+		case hookEnd:
+			if inBlock {
+				inBlock = false
+				continue
+			}
+		}
+		if !inBlock {
+			builder.WriteString(line)
+		}
+	}
+
+	return builder.String(), found
+}
+
+// installHook adds the block right after the #! line, so that an exit or exec
+// in an existing script does not skip it
+func installHook(dir string, exe string, name string) error {
+	path := filepath.Join(dir, name)
+
+	var mode os.FileMode = 0755
+	script := newHookScript
+
+	existing, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		script = string(existing)
+		if fi, err := os.Stat(path); err == nil {
+			mode = fi.Mode().Perm() | 0111
+		}
+	case !os.IsNotExist(err):
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	shebang, body := splitShebang(script)
+	if !isShellShebang(shebang) {
+		return fmt.Errorf("%s is not a shell script; add `%s hook %s \"$@\"` to it by hand", path, exe, name)
+	}
+
+	body, _ = stripHookBlock(body)
+	updated := shebang + hookBlock(exe, name) + body
+
+	if updated == script {
+		log.Printf("%s already installed", path)
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	if err := os.WriteFile(path, []byte(updated), mode); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	// WriteFile keeps the mode of existing files
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("failed to make %s executable: %v", path, err)
+	}
+
+	log.Printf("installed %s", path)
+	return nil
+}
+
+// uninstallHook removes the block, and the hook if installHook created it
+func uninstallHook(dir string, name string) error {
+	path := filepath.Join(dir, name)
+
+	existing, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	script, found := stripHookBlock(string(existing))
+	if !found {
+		return nil
+	}
+
+	if script == newHookScript {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", path, err)
+		}
+		log.Printf("removed %s", path)
+		return nil
+	}
+
+	if err := os.WriteFile(path, []byte(script), 0); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+
+	log.Printf("uninstalled from %s", path)
+	return nil
+}
+
+// Hooks installs or uninstalls the git hooks of the wiki repository that
+// keep a running server in sync with commits made outside wikai
+func Hooks(args []string) {
+	if len(args) == 0 || len(args) > 2 || (args[0] != "install" && args[0] != "uninstall") {
+		log.Fatal("Usage: wikai hooks install|uninstall [repo]")
+	}
+
+	repo := "."
+	if len(args) == 2 {
+		repo = args[1]
+	}
+
+	dir, err := hooksDir(repo)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var errs []error
+	switch args[0] {
+	case "install":
+		exe, err := os.Executable()
+		if err != nil {
+			log.Fatal("Failed to find the wikai binary:", err)
+		}
+		for _, name := range hookNames {
+			errs = append(errs, installHook(dir, exe, name))
+		}
+	case "uninstall":
+		for _, name := range hookNames {
+			errs = append(errs, uninstallHook(dir, name))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// emptyTree returns the empty tree of the repository, to diff root commits
+// against
+func emptyTree() (string, error) {
+	out, err := gitOutput(".", "hash-object", "-t", "tree", os.DevNull)
+	return strings.TrimSpace(out), err
+}
+
+// changedPages returns the pages that differ between two revisions
+func changedPages(from string, to string) ([]string, error) {
+	out, err := gitOutput(".", "diff", "--name-only", "-z", "--no-renames", from, to, "--", "*.md")
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, file := range strings.Split(out, "\x00") {
+		path, ok := strings.CutSuffix(file, ".md")
+		if !ok || util.ValidatePagePath(path) != nil {
+			continue
+		}
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+}
+
+// hookRevisions returns the revisions a hook invocation moved between, or
+// ok false if it did not change any pages
+func hookRevisions(name string, args []string) (string, string, bool, error) {
+	switch name {
+	case "post-commit":
+		if _, err := gitOutput(".", "rev-parse", "--verify", "-q", "HEAD^"); err == nil {
+			return "HEAD^", "HEAD", true, nil
+		}
+		tree, err := emptyTree()
+		return tree, "HEAD", err == nil, err
+	case "post-merge":
+		return "ORIG_HEAD", "HEAD", true, nil
+	case "post-checkout":
+		// args are the previous HEAD, the new HEAD and whether branches were
+		// switched, as opposed to files checked out; a null previous HEAD
+		// means a clone
+		if len(args) < 3 || args[2] != "1" || strings.Trim(args[0], "0") == "" {
+			return "", "", false, nil
+		}
+		return args[0], args[1], true, nil
+	}
+
+	return "", "", false, fmt.Errorf("unknown hook %s", name)
+}
+
+// Hook is run by the installed hooks, with the hook name and arguments. It
+// tells the server which pages changed. Failures are reported but never fail
+// the git command.
+func Hook(args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: wikai hook <name> [args]")
+	}
+
+	from, to, ok, err := hookRevisions(args[0], args[1:])
+	if err != nil {
+		log.Printf("wikai %s hook: %v", args[0], err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	paths, err := changedPages(from, to)
+	if err != nil {
+		log.Printf("wikai %s hook: %v", args[0], err)
+		return
+	}
+	if len(paths) == 0 {
+		return
+	}
+
+	resp, err := http.Post(fmt.Sprintf("http://localhost:%d%s", 8080, api.ReloadPath), "text/plain", strings.NewReader(strings.Join(paths, "\n")))
+	if err != nil {
+		log.Printf("wikai %s hook: server not reachable, %d changed pages not reloaded: %v", args[0], len(paths), err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		log.Printf("wikai %s hook: failed to reload %d pages: %s", args[0], len(paths), resp.Status)
+		return
+	}
+
+	log.Printf("wikai: reloading %d changed pages", len(paths))
+}
@@ -0,0 +1,150 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testExe = "/usr/local/bin/wi'kai"
+
+func readHook(t *testing.T, dir string, name string) string {
+	t.Helper()
+
+	buf, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func TestInstallHook(t *testing.T) {
+	cases := []struct {
+		name     string
+		existing string
+		want     string
+	}{
+		{"no hook", "", "#!/bin/sh\n" + hookBlock(testExe, "post-commit")},
+		{"user hook", "#!/bin/bash\necho hi\nexit 0\n", "#!/bin/bash\n" + hookBlock(testExe, "post-commit") + "echo hi\nexit 0\n"},
+		{"env shebang", "#!/usr/bin/env zsh\necho hi\n", "#!/usr/bin/env zsh\n" + hookBlock(testExe, "post-commit") + "echo hi\n"},
+		{"no shebang", "echo hi\n", hookBlock(testExe, "post-commit") + "echo hi\n"},
+		{"shebang only", "#!/bin/bash\n", "#!/bin/bash\n" + hookBlock(testExe, "post-commit")},
+		{"no final newline", "#!/bin/sh\necho hi", "#!/bin/sh\n" + hookBlock(testExe, "post-commit") + "echo hi"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "hooks")
+			path := filepath.Join(dir, "post-commit")
+
+			if c.existing != "" {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(c.existing), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := installHook(dir, testExe, "post-commit"); err != nil {
+				t.Fatal(err)
+			}
+			if got := readHook(t, dir, "post-commit"); got != c.want {
+				t.Errorf("installed hook %q, want %q", got, c.want)
+			}
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm()&0111 != 0111 {
+				t.Errorf("hook mode %v, want executable", fi.Mode())
+			}
+
+			// installing again changes nothing
+			if err := installHook(dir, testExe, "post-commit"); err != nil {
+				t.Fatal(err)
+			}
+			if got := readHook(t, dir, "post-commit"); got != c.want {
+				t.Errorf("reinstalled hook %q, want %q", got, c.want)
+			}
+
+			// a new binary replaces the block instead of adding another
+			if err := installHook(dir, "/opt/wikai", "post-commit"); err != nil {
+				t.Fatal(err)
+			}
+			got := readHook(t, dir, "post-commit")
+			if strings.Count(got, hookBegin) != 1 || !strings.Contains(got, hookBlock("/opt/wikai", "post-commit")) {
+				t.Errorf("hook after moving the binary %q", got)
+			}
+
+			if err := uninstallHook(dir, "post-commit"); err != nil {
+				t.Fatal(err)
+			}
+			if c.existing == "" {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("created hook not removed: %v", err)
+				}
+				return
+			}
+			if got := readHook(t, dir, "post-commit"); got != c.existing {
+				t.Errorf("uninstalled hook %q, want %q", got, c.existing)
+			}
+		})
+	}
+}
+
+func TestInstallHookNotShell(t *testing.T) {
+	dir := t.TempDir()
+	script := "#!/usr/bin/env python3\nprint('hi')\n"
+	if err := os.WriteFile(filepath.Join(dir, "post-merge"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := installHook(dir, testExe, "post-merge"); err == nil {
+		t.Error("installed into a python hook")
+	}
+	if got := readHook(t, dir, "post-merge"); got != script {
+		t.Errorf("python hook changed to %q", got)
+	}
+}
+
+func TestUninstallHookNotInstalled(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := uninstallHook(dir, "post-checkout"); err != nil {
+		t.Errorf("uninstalling a missing hook: %v", err)
+	}
+
+	script := "#!/bin/sh\necho hi\n"
+	if err := os.WriteFile(filepath.Join(dir, "post-checkout"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := uninstallHook(dir, "post-checkout"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readHook(t, dir, "post-checkout"); got != script {
+		t.Errorf("hook without the block changed to %q", got)
+	}
+}
+
+func TestIsShellShebang(t *testing.T) {
+	cases := []struct {
+		shebang string
+		want    bool
+	}{
+		{"", true},
+		{"#!/bin/sh\n", true},
+		{"#! /bin/bash -e\n", true},
+		{"#!/usr/bin/env dash\n", true},
+		{"#!/usr/bin/env python3\n", false},
+		{"#!/usr/bin/perl\n", false},
+		{"#!\n", false},
+	}
+
+	for _, c := range cases {
+		if got := isShellShebang(c.shebang); got != c.want {
+			t.Errorf("isShellShebang(%q) = %v, want %v", c.shebang, got, c.want)
+		}
+	}
+}
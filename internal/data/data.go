@@ -10,6 +10,9 @@ var SystemPrompt string
 //go:embed prompt_summarize.txt
 var SystemPromptSummarize string
 
+//go:embed prompt_topics.txt
+var SystemPromptTopics string
+
 //go:embed index.html
 var IndexHTML []byte
 
@@ -0,0 +1,195 @@
+// Package frontmatter reads and writes the YAML front matter of pages, a
+// block delimited by --- lines at the very start of the page:
+//
+//	---
+//	title: On-call rota
+//	tags: [infra, oncall]
+//	aliases: [rota]
+//	created: 2025-04-24
+//	owner: infra-team
+//	---
+package frontmatter
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Meta is the metadata of a page
+type Meta struct {
+	Title   string   `yaml:"title,omitempty"`
+	Tags    []string `yaml:"tags,omitempty"`
+	Aliases []string `yaml:"aliases,omitempty"`
+	// Created and Updated are zero if not given
+	Created time.Time `yaml:"created,omitempty"`
+	Updated time.Time `yaml:"updated,omitempty"`
+	// Fields are the keys not listed above
+	Fields map[string]any `yaml:",inline"`
+}
+
+// Empty tells whether there is no metadata at all
+func (m Meta) Empty() bool {
+	return m.Title == "" && len(m.Tags) == 0 && len(m.Aliases) == 0 &&
+		m.Created.IsZero() && m.Updated.IsZero() && len(m.Fields) == 0
+}
+
+// Date is when the page was last updated, or created if that is all there is
+func (m Meta) Date() time.Time {
+	if !m.Updated.IsZero() {
+		return m.Updated
+	}
+	return m.Created
+}
+
+// HasTag tells whether the page has a tag, ignoring case
+func (m Meta) HasTag(tag string) bool {
+	tag = NormalizeTag(tag)
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeTag returns the form tags are compared in: lowercase, without a
+// leading #
+func NormalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+}
+
+// stringList accepts a sequence, or a comma-separated scalar
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(node *yaml.Node) error {
+	var items []string
+
+	switch node.Kind {
+	case yaml.ScalarNode:
+		items = strings.Split(node.Value, ",")
+	case yaml.SequenceNode:
+		if err := node.Decode(&items); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("line %d: expected a list", node.Line)
+	}
+
+	*l = nil
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// rawMeta is Meta as written by hand
+type rawMeta struct {
+	Title   string         `yaml:"title"`
+	Tags    stringList     `yaml:"tags"`
+	Aliases stringList     `yaml:"aliases"`
+	Created time.Time      `yaml:"created"`
+	Updated time.Time      `yaml:"updated"`
+	Fields  map[string]any `yaml:",inline"`
+}
+
+// split separates the front matter from the body; ok is false if the page
+// has none
+func split(content []byte) (front []byte, body []byte, ok bool) {
+	rest, found := bytes.CutPrefix(content, []byte("---\n"))
+	if !found {
+		if rest, found = bytes.CutPrefix(content, []byte("---\r\n")); !found {
+			return nil, content, false
+		}
+	}
+
+	for offset := 0; offset < len(rest); {
+		line := rest[offset:]
+		end := bytes.IndexByte(line, '\n')
+		if end >= 0 {
+			line = line[:end+1]
+		}
+
+		if trimmed := bytes.TrimRight(line, "\r\n"); string(trimmed) == "---" || string(trimmed) == "..." {
+			return rest[:offset], rest[offset+len(line):], true
+		}
+		offset += len(line)
+	}
+
+	// not closed, so not front matter
+	return nil, content, false
+}
+
+// Parse returns the metadata of a page and its body without the front
+// matter. Pages without front matter have empty metadata. If the front matter
+// is not valid, the body is still returned.
+func Parse(content []byte) (Meta, []byte, error) {
+	front, body, ok := split(content)
+	if !ok {
+		return Meta{}, content, nil
+	}
+
+	var raw rawMeta
+	if err := yaml.Unmarshal(front, &raw); err != nil {
+		return Meta{}, body, fmt.Errorf("invalid front matter: %v", err)
+	}
+
+	meta := Meta{
+		Title:   strings.TrimSpace(raw.Title),
+		Aliases: raw.Aliases,
+		Created: raw.Created,
+		Updated: raw.Updated,
+		Fields:  raw.Fields,
+	}
+	for _, tag := range raw.Tags {
+		if tag = NormalizeTag(tag); tag != "" && !meta.HasTag(tag) {
+			meta.Tags = append(meta.Tags, tag)
+		}
+	}
+	if len(meta.Fields) == 0 {
+		meta.Fields = nil
+	}
+
+	return meta, body, nil
+}
+
+// Format prepends the metadata to a body as front matter, unless it is empty
+func Format(meta Meta, body []byte) ([]byte, error) {
+	if meta.Empty() {
+		return body, nil
+	}
+
+	front, err := yaml.Marshal(meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal front matter: %v", err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("---\n")
+	buf.Write(front)
+	buf.WriteString("---\n")
+	buf.Write(body)
+
+	return buf.Bytes(), nil
+}
+
+// Title returns the title of a page: the one in the metadata, or else the
+// first top-level heading of the body
+func Title(meta Meta, body []byte) string {
+	if meta.Title != "" {
+		return meta.Title
+	}
+
+	for _, line := range strings.Split(string(body), "\n") {
+		if heading, ok := strings.CutPrefix(strings.TrimSpace(line), "# "); ok {
+			return strings.TrimSpace(heading)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,180 @@
+package frontmatter
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		meta    Meta
+		body    string
+		invalid bool
+	}{
+		{
+			name:    "no front matter",
+			content: "# Title\n\ntext\n",
+			body:    "# Title\n\ntext\n",
+		},
+		{
+			name:    "not at the start",
+			content: "\n---\ntitle: x\n---\n",
+			body:    "\n---\ntitle: x\n---\n",
+		},
+		{
+			name:    "not closed",
+			content: "---\ntitle: x\n\ntext\n",
+			body:    "---\ntitle: x\n\ntext\n",
+		},
+		{
+			name:    "empty",
+			content: "---\n---\ntext\n",
+			body:    "text\n",
+		},
+		{
+			name:    "full",
+			content: "---\ntitle: \" On-call rota \"\ntags: [Infra, '#oncall', infra]\naliases: rota, schedule\ncreated: 2025-04-24\nupdated: 2025-05-01T10:30:00Z\nowner: infra-team\n---\n# Rota\n",
+			meta: Meta{
+				Title:   "On-call rota",
+				Tags:    []string{"infra", "oncall"},
+				Aliases: []string{"rota", "schedule"},
+				Created: date(2025, 4, 24),
+				Updated: time.Date(2025, 5, 1, 10, 30, 0, 0, time.UTC),
+				Fields:  map[string]any{"owner": "infra-team"},
+			},
+			body: "# Rota\n",
+		},
+		{
+			name:    "dots close",
+			content: "---\ntags: a\n...\ntext\n",
+			meta:    Meta{Tags: []string{"a"}},
+			body:    "text\n",
+		},
+		{
+			name:    "crlf",
+			content: "---\r\ntitle: x\r\n---\r\ntext\r\n",
+			meta:    Meta{Title: "x"},
+			body:    "text\r\n",
+		},
+		{
+			name:    "rule in body",
+			content: "---\ntitle: x\n---\nabove\n\n---\n\nbelow\n",
+			meta:    Meta{Title: "x"},
+			body:    "above\n\n---\n\nbelow\n",
+		},
+		{
+			name:    "malformed yaml",
+			content: "---\ntitle: [x\n---\ntext\n",
+			body:    "text\n",
+			invalid: true,
+		},
+		{
+			name:    "bad date",
+			content: "---\ncreated: last tuesday\n---\ntext\n",
+			body:    "text\n",
+			invalid: true,
+		},
+		{
+			name:    "bad tags",
+			content: "---\ntags: {a: b}\n---\ntext\n",
+			body:    "text\n",
+			invalid: true,
+		},
+	}
+
+	for _, c := range cases {
+		meta, body, err := Parse([]byte(c.content))
+		if (err != nil) != c.invalid {
+			t.Errorf("%s: error %v, want invalid %v", c.name, err, c.invalid)
+		}
+		if string(body) != c.body {
+			t.Errorf("%s: body %q, want %q", c.name, body, c.body)
+		}
+		if !reflect.DeepEqual(meta, c.meta) {
+			t.Errorf("%s: meta %+v, want %+v", c.name, meta, c.meta)
+		}
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	body := []byte("# Rota\n\n---\n\ntext\n")
+
+	cases := []Meta{
+		{Title: "On-call rota"},
+		{
+			Title:   "On-call rota",
+			Tags:    []string{"infra", "oncall"},
+			Aliases: []string{"rota"},
+			Created: date(2025, 4, 24),
+			Updated: time.Date(2025, 5, 1, 10, 30, 0, 0, time.UTC),
+			Fields: map[string]any{
+				"owner":    "infra-team",
+				"priority": 2,
+				"reviewers": []any{
+					"alice",
+					"bob",
+				},
+				"links": map[string]any{"runbook": "https://example.com"},
+			},
+		},
+	}
+
+	for _, meta := range cases {
+		content, err := Format(meta, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, parsedBody, err := Parse(content)
+		if err != nil {
+			t.Fatalf("parsing %q: %v", content, err)
+		}
+		if string(parsedBody) != string(body) {
+			t.Errorf("body %q, want %q", parsedBody, body)
+		}
+		if !reflect.DeepEqual(parsed, meta) {
+			t.Errorf("round trip of %+v gave %+v", meta, parsed)
+		}
+	}
+
+	// empty metadata adds no front matter
+	content, err := Format(Meta{}, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != string(body) {
+		t.Errorf("empty metadata formatted as %q", content)
+	}
+}
+
+func TestTitle(t *testing.T) {
+	cases := []struct {
+		meta Meta
+		body string
+		want string
+	}{
+		{Meta{Title: "Meta"}, "# Heading\n", "Meta"},
+		{Meta{}, "text\n\n# Heading \n## Sub\n", "Heading"},
+		{Meta{}, "## Sub\n", ""},
+	}
+
+	for _, c := range cases {
+		if got := Title(c.meta, []byte(c.body)); got != c.want {
+			t.Errorf("Title(%+v, %q) = %q, want %q", c.meta, c.body, got, c.want)
+		}
+	}
+
+	if meta := (Meta{Tags: []string{"infra"}}); !meta.HasTag("#Infra") || meta.HasTag("oncall") {
+		t.Error("HasTag does not normalize tags")
+	}
+	if meta := (Meta{Created: date(2025, 1, 1)}); !meta.Date().Equal(meta.Created) {
+		t.Error("Date without Updated is not Created")
+	}
+}
@@ -0,0 +1,552 @@
+// Repo implementation running the git binary
+
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (r *execRepo) seal() {}
+
+type execRepo struct {
+	path     string
+	identity Identity
+}
+
+// command prepares a git command in the repository, committing as the
+// configured identity
+func (r *execRepo) command(args ...string) *exec.Cmd {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.path
+
+	if r.identity.Name != "" || r.identity.Email != "" {
+		cmd.Env = os.Environ()
+		if r.identity.Name != "" {
+			cmd.Env = append(cmd.Env, "GIT_AUTHOR_NAME="+r.identity.Name, "GIT_COMMITTER_NAME="+r.identity.Name)
+		}
+		if r.identity.Email != "" {
+			cmd.Env = append(cmd.Env, "GIT_AUTHOR_EMAIL="+r.identity.Email, "GIT_COMMITTER_EMAIL="+r.identity.Email)
+		}
+	}
+
+	return cmd
+}
+
+// run runs a git command, returning its stdout; failures are reported as
+// *Error, with the output of the command
+func (r *execRepo) run(stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := r.command(args...)
+	cmd.Stdin = stdin
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if message == "" {
+			// some commands, e.g. commit, explain failures on stdout
+			message = strings.TrimSpace(stdout.String())
+		}
+		return nil, &Error{Args: args, Stderr: message, Err: err}
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// exitCode returns the exit code of a failed git command, or -1 if it did not
+// run to completion
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+func (r *execRepo) Add(file string) error {
+	_, err := r.run(nil, "add", "--", file)
+	return err
+}
+
+func (r *execRepo) Remove(file string) error {
+	_, err := r.run(nil, "rm", "-q", "-f", "--cached", "--ignore-unmatch", "--", file)
+	return err
+}
+
+func (r *execRepo) HashFile(file string) (string, error) {
+	out, err := r.run(nil, "hash-object", "--", file)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (r *execRepo) Commit(message string, allowEmpty bool) error {
+	var args []string
+	if allowEmpty {
+		args = []string{"commit", "-m", message, "--allow-empty"}
+	} else {
+		_, err := r.run(nil, "diff", "--cached", "--quiet")
+		if err == nil {
+			return ErrNothingToCommit
+		}
+		if exitCode(err) != 1 {
+			return err
+		}
+		args = []string{"commit", "-m", message}
+	}
+
+	if _, err := r.run(nil, args...); err != nil {
+		// as reported by the go-git backend
+		if _, identErr := r.run(nil, "var", "GIT_AUTHOR_IDENT"); identErr != nil {
+			return fmt.Errorf("%w: %w", ErrNoIdentity, err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (r *execRepo) GetNoteContents(handle func(string)) error {
+	out, err := r.run(nil, "notes", "--ref", "refs/notes/commits", "list")
+	if err != nil {
+		return fmt.Errorf("failed to get notes: %w", err)
+	}
+
+	var noteRefs []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			noteRefs = append(noteRefs, fields[0])
+		}
+	}
+
+	return r.catFiles(noteRefs, func(content []byte) {
+		for _, line := range strings.Split(string(content), "\n") {
+			if line != "" {
+				handle(line)
+			}
+		}
+	})
+}
+
+// resolve returns the object a revision names, or "" if it does not exist
+func (r *execRepo) resolve(rev string) (string, error) {
+	out, err := r.run(nil, "rev-parse", "--verify", "-q", rev)
+	if err != nil {
+		if exitCode(err) == 1 {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to resolve %s: %w", rev, err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (r *execRepo) Head() (string, error) {
+	return r.resolve("HEAD")
+}
+
+func (r *execRepo) Parents(commit string) ([]string, error) {
+	out, err := r.run(nil, "show", "-s", "--format=%P", commit+"^{commit}")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read commit %s: %w", commit, err)
+	}
+
+	return strings.Fields(string(out)), nil
+}
+
+func (r *execRepo) Reset(commit string) error {
+	var err error
+	if commit == "" {
+		_, err = r.run(nil, "update-ref", "-d", "HEAD")
+	} else {
+		_, err = r.run(nil, "reset", "-q", "--soft", commit)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to reset to %q: %w", commit, err)
+	}
+
+	return nil
+}
+
+func (r *execRepo) Unstage(commit string, files ...string) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	var args []string
+	if commit == "" {
+		args = append([]string{"rm", "-q", "-f", "--cached", "--ignore-unmatch", "--"}, files...)
+	} else {
+		args = append([]string{"reset", "-q", commit, "--"}, files...)
+	}
+
+	if _, err := r.run(nil, args...); err != nil {
+		return fmt.Errorf("failed to unstage %v: %w", files, err)
+	}
+
+	return nil
+}
+
+func (r *execRepo) BlobID(file string) (string, error) {
+	blob, err := r.resolve(":" + file)
+	if err != nil {
+		return "", err
+	}
+	if blob == "" {
+		return "", fmt.Errorf("%s is not staged", file)
+	}
+
+	return blob, nil
+}
+
+// ident returns the identity for commits on the notes ref
+func (r *execRepo) ident() string {
+	out, err := r.run(nil, "var", "GIT_COMMITTER_IDENT")
+	if err != nil {
+		return fmt.Sprintf("wikai <wikai@localhost> %d +0000", time.Now().Unix())
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+func (r *execRepo) SetBlobNotes(notes map[string]string) error {
+	if len(notes) == 0 {
+		return nil
+	}
+
+	parent, err := r.NotesCommit()
+	if err != nil {
+		return err
+	}
+
+	// existing notes may be stored with fan-out (e.g., ab/cdef...), in which
+	// case they are replaced in place
+	paths := make(map[string]string)
+	if parent != "" {
+		out, err := r.run(nil, "ls-tree", "-r", "-z", "--name-only", parent)
+		if err != nil {
+			return fmt.Errorf("failed to list notes tree: %w", err)
+		}
+		for _, path := range strings.Split(string(out), "\x00") {
+			if path != "" {
+				paths[strings.ReplaceAll(path, "/", "")] = path
+			}
+		}
+	}
+
+	// the notes tree is written directly, since fast-import only annotates
+	// commits with its note command; one process and one commit either way
+	var script bytes.Buffer
+	message := fmt.Sprintf("Set %d embeddings", len(notes))
+	fmt.Fprintf(&script, "commit %s\ncommitter %s\ndata %d\n%s\n", EmbeddingsRef, r.ident(), len(message), message)
+	if parent != "" {
+		fmt.Fprintf(&script, "from %s\n", parent)
+	}
+
+	blobs := make([]string, 0, len(notes))
+	for blob := range notes {
+		blobs = append(blobs, blob)
+	}
+	sort.Strings(blobs)
+
+	for _, blob := range blobs {
+		path, ok := paths[blob]
+		if !ok {
+			path = blob
+		}
+		note := notes[blob]
+		fmt.Fprintf(&script, "M 100644 inline %s\ndata %d\n%s\n", path, len(note), note)
+	}
+	script.WriteString("done\n")
+
+	if _, err := r.run(&script, "fast-import", "--quiet", "--done"); err != nil {
+		return fmt.Errorf("failed to set notes: %w", err)
+	}
+
+	return nil
+}
+
+func (r *execRepo) NotesCommit() (string, error) {
+	return r.resolve(EmbeddingsRef)
+}
+
+func (r *execRepo) GetBlobNotes(since string, handle func(blob string, note string), removed func(blob string)) error {
+	var noteObjects, blobs []string
+
+	if since == "" {
+		out, err := r.run(nil, "notes", "--ref", EmbeddingsRef, "list")
+		if err != nil {
+			return fmt.Errorf("failed to list notes: %w", err)
+		}
+
+		for _, line := range strings.Split(string(out), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				continue
+			}
+			noteObjects = append(noteObjects, fields[0])
+			blobs = append(blobs, fields[1])
+		}
+	} else {
+		out, err := r.run(nil, "diff-tree", "-r", "-z", "--no-renames", since, EmbeddingsRef)
+		if err != nil {
+			return fmt.Errorf("failed to diff notes since %s: %w", since, err)
+		}
+
+		// :<old mode> <new mode> <old object> <new object> <status> NUL <path> NUL
+		fields := strings.Split(string(out), "\x00")
+		for i := 0; i+1 < len(fields); i += 2 {
+			meta := strings.Fields(strings.TrimPrefix(fields[i], ":"))
+			if len(meta) != 5 {
+				return fmt.Errorf("unexpected diff-tree output: %s", fields[i])
+			}
+			blob := strings.ReplaceAll(fields[i+1], "/", "")
+			if meta[4] == "D" {
+				removed(blob)
+				continue
+			}
+			noteObjects = append(noteObjects, meta[3])
+			blobs = append(blobs, blob)
+		}
+	}
+
+	i := 0
+	return r.catFiles(noteObjects, func(content []byte) {
+		handle(blobs[i], string(content))
+		i++
+	})
+}
+
+// catFiles calls the handle with the contents of each object, in order
+func (r *execRepo) catFiles(objects []string, handle func([]byte)) error {
+	return r.catFilesWhile(objects, func(content []byte) bool {
+		handle(content)
+		return true
+	})
+}
+
+// catFilesWhile is catFiles, stopping once the handle returns false
+func (r *execRepo) catFilesWhile(objects []string, handle func([]byte) bool) error {
+	if len(objects) == 0 {
+		return nil
+	}
+
+	args := []string{"cat-file", "--batch"}
+	catCmd := r.command(args...)
+	catCmd.Stdin = strings.NewReader(strings.Join(objects, "\n") + "\n")
+
+	var stderr bytes.Buffer
+	catCmd.Stderr = &stderr
+
+	stdout, err := catCmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stdout pipe: %v", err)
+	}
+
+	if err := catCmd.Start(); err != nil {
+		return &Error{Args: args, Err: err}
+	}
+
+	reader := bufio.NewReader(stdout)
+	for range objects {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read cat-file header: %v", err)
+		}
+
+		// <object> <type> <size>, or <object> missing
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			return fmt.Errorf("unexpected cat-file output: %s", strings.TrimSpace(header))
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return fmt.Errorf("unexpected cat-file size: %s", fields[2])
+		}
+
+		content := make([]byte, size+1)
+		if _, err := io.ReadFull(reader, content); err != nil {
+			return fmt.Errorf("failed to read cat-file content: %v", err)
+		}
+
+		if !handle(content[:size]) {
+			// the rest of the output is not wanted
+			catCmd.Process.Kill()
+			catCmd.Wait()
+			return nil
+		}
+	}
+
+	if err := catCmd.Wait(); err != nil {
+		return &Error{Args: args, Stderr: strings.TrimSpace(stderr.String()), Err: err}
+	}
+
+	return nil
+}
+
+func (r *execRepo) ListFiles(handle func(path string, blob string)) error {
+	head, err := r.Head()
+	if err != nil {
+		return err
+	}
+	if head == "" {
+		return nil
+	}
+
+	out, err := r.run(nil, "ls-tree", "-r", "-z", "--full-tree", head)
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+
+	// <mode> SP <type> SP <object> TAB <file> NUL
+	for _, entry := range strings.Split(string(out), "\x00") {
+		meta, path, ok := strings.Cut(entry, "\t")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(meta)
+		if len(fields) != 3 || fields[1] != "blob" {
+			continue
+		}
+		handle(path, fields[2])
+	}
+
+	return nil
+}
+
+func (r *execRepo) ReadFiles(rev string, match func(path string) bool, handle func(path string, content []byte) bool) error {
+	// not an option, whatever the caller passed
+	if strings.HasPrefix(rev, "-") {
+		return fmt.Errorf("%w: %s", ErrUnknownRevision, rev)
+	}
+
+	out, err := r.run(nil, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUnknownRevision, rev)
+	}
+	commit := strings.TrimSpace(string(out))
+
+	out, err = r.run(nil, "ls-tree", "-r", "-z", "--full-tree", commit)
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+
+	pathBlobs := make(map[string]string)
+	for _, entry := range strings.Split(string(out), "\x00") {
+		meta, path, ok := strings.Cut(entry, "\t")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(meta)
+		if len(fields) != 3 || fields[1] != "blob" || !match(path) {
+			continue
+		}
+		pathBlobs[path] = fields[2]
+	}
+
+	// the tree order puts directories as if their names ended with a slash
+	paths := make([]string, 0, len(pathBlobs))
+	for path := range pathBlobs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	blobs := make([]string, len(paths))
+	for i, path := range paths {
+		blobs[i] = pathBlobs[path]
+	}
+
+	i := 0
+	return r.catFilesWhile(blobs, func(content []byte) bool {
+		i++
+		return handle(paths[i-1], content)
+	})
+}
+
+func initExecRepo(path string, branch string) error {
+	r := &execRepo{path: path}
+
+	if _, err := r.run(nil, "init", "-q"); err != nil {
+		return err
+	}
+
+	// rather than init --initial-branch, which older versions lack
+	if _, err := r.run(nil, "symbolic-ref", "HEAD", BranchRef(branch)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *execRepo) state() (repoState, error) {
+	var s repoState
+
+	out, err := r.run(nil, "rev-parse", "--is-bare-repository")
+	if err != nil {
+		return s, err
+	}
+	if strings.TrimSpace(string(out)) == "true" {
+		s.bare = true
+		return s, nil
+	}
+
+	out, err = r.run(nil, "symbolic-ref", "-q", "HEAD")
+	if err == nil {
+		s.branch = strings.TrimSpace(string(out))
+	} else if exitCode(err) != 1 {
+		return s, err
+	}
+
+	if _, err := r.run(nil, "var", "GIT_AUTHOR_IDENT"); err != nil {
+		s.identityErr = ErrNoIdentity
+	}
+
+	out, err = r.run(nil, "status", "--porcelain=v1", "-z", "--no-renames", "--untracked-files=no")
+	if err != nil {
+		return s, err
+	}
+
+	// XY SP <file> NUL, with X the index status and Y the working tree one
+	for _, entry := range strings.Split(string(out), "\x00") {
+		if len(entry) < 4 {
+			continue
+		}
+		x, y, file := entry[0], entry[1], entry[3:]
+		switch {
+		case x == 'U' || y == 'U' || (x == 'A' && y == 'A') || (x == 'D' && y == 'D'):
+			s.unmerged = append(s.unmerged, file)
+		case x != ' ':
+			s.staged = append(s.staged, file)
+			if y != ' ' {
+				s.modified = append(s.modified, file)
+			}
+		case y != ' ':
+			s.modified = append(s.modified, file)
+		}
+	}
+
+	return s, nil
+}
+
+func (r *execRepo) Check(branch string) ([]string, error) {
+	s, err := r.state()
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect %s: %w", r.path, err)
+	}
+
+	return s.check(r.path, branch)
+}
@@ -1,57 +1,135 @@
 package git
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 )
 
+// EmbeddingsRef is the notes ref holding page embeddings. Notes are attached
+// to page blobs, so that identical content shares an embedding and history
+// rewrites do not orphan them.
+const EmbeddingsRef = "refs/notes/wikai"
+
 // Repo represents a git repository
 type Repo interface {
 	// Add adds a file to the repository
 	Add(file string) error
-	// AddNote adds a note to the latest commit
-	AddNote(note string) error
-	// Commit commits the changes to the repository
+	// Remove stages the removal of a file, leaving the working tree alone
+	Remove(file string) error
+	// HashFile returns the blob a file in the working tree would have if
+	// added, without adding it
+	HashFile(file string) (string, error)
+	// Commit commits the changes to the repository; unless allowEmpty, it
+	// fails with ErrNothingToCommit if nothing is staged
 	Commit(message string, allowEmpty bool) error
-	// GetNoteContents gets the contents of all notes in the repository, calling
-	// the handle for each
+	// GetNoteContents gets the contents of all notes attached to commits,
+	// calling the handle for each; this is where embeddings used to be kept
 	GetNoteContents(handle func(string)) error
+	// BlobID returns the blob of a file as currently staged
+	BlobID(file string) (string, error)
+	// SetBlobNotes attaches notes, given by blob, under EmbeddingsRef in a
+	// single commit, replacing existing notes on the same blobs
+	SetBlobNotes(notes map[string]string) error
+	// NotesCommit returns the commit EmbeddingsRef points to, or "" if there
+	// are no notes
+	NotesCommit() (string, error)
+	// GetBlobNotes calls the handle for each note under EmbeddingsRef, with
+	// the blob the note is attached to. If since is not empty, only the notes
+	// added or changed after that commit of EmbeddingsRef are visited, and
+	// removed is called for the blobs whose notes were removed.
+	GetBlobNotes(since string, handle func(blob string, note string), removed func(blob string)) error
+	// ListFiles calls the handle for each file in the HEAD tree, with its blob
+	ListFiles(handle func(path string, blob string)) error
+	// ReadFiles calls the handle with the content of each file in the tree of
+	// a revision that match accepts, sorted by path, until the handle returns
+	// false; it fails with ErrUnknownRevision if the revision does not name a
+	// commit
+	ReadFiles(rev string, match func(path string) bool, handle func(path string, content []byte) bool) error
+	// Head returns the commit HEAD points to, or "" if there are no commits
+	Head() (string, error)
+	// Parents returns the parents of a commit
+	Parents(commit string) ([]string, error)
+	// Reset moves HEAD to the given commit without touching the index or the
+	// working tree; an empty commit leaves HEAD unborn
+	Reset(commit string) error
+	// Unstage resets the index entries of files to their state in the given
+	// commit; an empty commit removes them from the index
+	Unstage(commit string, files ...string) error
+	// Check verifies that wikai can commit to the repository on branch (the
+	// current branch if empty). The error describes every problem that
+	// prevents it; the warnings are problems that do not.
+	Check(branch string) ([]string, error)
 	seal()
 }
 
-func (r *repo) seal() {}
+// Backend selects the Repo implementation
+type Backend string
+
+const (
+	// BackendGoGit accesses the repository in-process; repositories using
+	// features it does not support are handled by BackendExec instead
+	BackendGoGit Backend = "go-git"
+	// BackendExec runs the git binary
+	BackendExec Backend = "exec"
+)
 
-type repo struct {
-	path string
+// Identity is the author and committer of the commits wikai makes; empty
+// fields are taken from the git configuration
+type Identity struct {
+	Name  string
+	Email string
 }
 
-func (r *repo) Add(file string) error {
-	cmd := exec.Command("git", "add", file)
-	cmd.Dir = r.path
-	return cmd.Run()
+type Options struct {
+	// Backend defaults to BackendGoGit
+	Backend  Backend
+	Identity Identity
+	// Branch is the branch new repositories start on; defaults to
+	// DefaultBranch
+	Branch string
 }
 
-func (r *repo) Commit(message string, allowEmpty bool) error {
-	var args []string
-	if allowEmpty {
-		args = []string{"commit", "-m", message, "--allow-empty"}
-	} else {
-		args = []string{"commit", "-m", message}
+const DefaultBranch = "main"
+
+// ErrNoIdentity is returned when committing without an identity, either
+// configured or in the git configuration
+var ErrNoIdentity = errors.New("no commit identity: set user.name and user.email in the git configuration, or the identity in the wikai configuration")
+
+// ErrNothingToCommit is returned by Commit when the index matches HEAD
+var ErrNothingToCommit = errors.New("nothing to commit")
+
+// ErrUnknownRevision is returned by ReadFiles when the revision does not name
+// a commit
+var ErrUnknownRevision = errors.New("unknown revision")
+
+// Error is a failed git command, with what it printed on stderr
+type Error struct {
+	Args []string
+	// Stderr is the error output of the command, or its standard output if
+	// there was none
+	Stderr string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Stderr == "" {
+		return fmt.Sprintf("git %s: %v", strings.Join(e.Args, " "), e.Err)
 	}
-	cmd := exec.Command("git", args...)
-	cmd.Dir = r.path
-	return cmd.Run()
+	return fmt.Sprintf("git %s: %v: %s", strings.Join(e.Args, " "), e.Err, e.Stderr)
 }
 
-func (r *repo) addGitIgnore(gitIgnore string) error {
-	gitIgnorePath := filepath.Join(r.path, ".gitignore")
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func addGitIgnore(repo Repo, path string, gitIgnore string) error {
+	gitIgnorePath := filepath.Join(path, ".gitignore")
 	if _, err := os.Stat(gitIgnorePath); !os.IsNotExist(err) {
-		log.Printf("gitignore already exists in %s", r.path)
+		log.Printf("gitignore already exists in %s", path)
 	} else {
 		err := os.WriteFile(gitIgnorePath, []byte(gitIgnore), 0644)
 		if err != nil {
@@ -59,173 +137,101 @@ func (r *repo) addGitIgnore(gitIgnore string) error {
 		}
 	}
 
-	err := r.Add(gitIgnorePath)
+	err := repo.Add(".gitignore")
 	if err != nil {
-		return fmt.Errorf("failed to add gitignore to %s: %v", gitIgnorePath, err)
+		return fmt.Errorf("failed to add gitignore to %s: %w", gitIgnorePath, err)
 	}
 
-	err = r.Commit("Add gitignore", false)
+	err = repo.Commit("Add gitignore", false)
 	if err != nil {
-		return fmt.Errorf("failed to commit gitignore to %s: %v", gitIgnorePath, err)
+		return fmt.Errorf("failed to commit gitignore to %s: %w", gitIgnorePath, err)
 	}
 
 	return nil
 }
 
-func initRepo(path string, gitIgnore string) (*repo, error) {
-	cmd := exec.Command("git", "init")
-	cmd.Dir = path
+// createRepo initialises a repository on the configured branch, committing
+// the gitignore if not empty
+func createRepo(path string, gitIgnore string, options Options) (Repo, error) {
+	branch := options.Branch
+	if branch == "" {
+		branch = DefaultBranch
+	}
 
-	err := cmd.Run()
+	var err error
+	if options.Backend == BackendExec {
+		err = initExecRepo(path, branch)
+	} else {
+		err = initGoGitRepo(path, branch)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to init repo %s: %v", path, err)
+		return nil, fmt.Errorf("failed to init repo %s: %w", path, err)
 	}
 
-	repo := repo{path: path}
+	repo, err := openRepo(path, options)
+	if err != nil {
+		return nil, err
+	}
 
 	if gitIgnore != "" {
-		err = repo.addGitIgnore(gitIgnore)
+		err = addGitIgnore(repo, path, gitIgnore)
 		if err != nil {
-			return nil, fmt.Errorf("failed to add gitignore to %s: %v", path, err)
+			return nil, fmt.Errorf("failed to add gitignore to %s: %w", path, err)
 		}
 	}
 
-	return &repo, nil
+	return repo, nil
 }
 
-func NewRepo(path string, gitIgnore string) (Repo, error) {
-	fi, err := os.Stat(path)
-	if os.IsNotExist(err) {
-		return nil, fmt.Errorf("repo %s does not exist", path)
-	}
-
-	if !fi.IsDir() {
-		return nil, fmt.Errorf("path %s is not a directory", path)
-	}
-
-	if _, err := os.Stat(filepath.Join(path, ".git")); os.IsNotExist(err) {
-		repo, err := initRepo(path, gitIgnore)
+// openRepo opens an existing repository with the configured backend,
+// falling back to BackendExec
+func openRepo(path string, options Options) (Repo, error) {
+	switch options.Backend {
+	case BackendExec:
+		return &execRepo{path: path, identity: options.Identity}, nil
+	case "", BackendGoGit:
+		repo, err := openGoGitRepo(path, options.Identity)
 		if err != nil {
-			return nil, err
+			log.Printf("using the git binary for %s: %v", path, err)
+			return &execRepo{path: path, identity: options.Identity}, nil
 		}
-
 		return repo, nil
 	}
 
-	log.Printf("will manage existing repo %s", path)
-	repo, err := initRepo(path, gitIgnore)
-	if err != nil {
-		return nil, err
-	}
-
-	return repo, nil
+	return nil, fmt.Errorf("unknown git backend %q", options.Backend)
 }
 
-func (r *repo) AddNote(note string) error {
-	// Add the vector as a note to the latest commit
-	noteCmd := exec.Command("git", "notes", "append", "-m", note, "HEAD")
-	noteCmd.Dir = r.path
-
-	if err := noteCmd.Run(); err != nil {
-		return fmt.Errorf("failed to add note: %v", err)
+// isRepo tells whether path is a repository, with a working tree or bare
+func isRepo(path string) bool {
+	if _, err := os.Stat(filepath.Join(path, ".git")); err == nil {
+		return true
 	}
 
-	return nil
+	_, headErr := os.Stat(filepath.Join(path, "HEAD"))
+	objects, objectsErr := os.Stat(filepath.Join(path, "objects"))
+	return headErr == nil && objectsErr == nil && objects.IsDir()
 }
 
-func (r *repo) getNotes() ([]string, error) {
-	noteCmd := exec.Command("git", "notes", "list")
-	noteCmd.Dir = r.path
-
-	stdout, err := noteCmd.StdoutPipe()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get stdout pipe: %v", err)
-	}
-
-	if err := noteCmd.Start(); err != nil {
-		return nil, fmt.Errorf("failed to start notes command: %v", err)
-	}
-
-	scanner := bufio.NewScanner(stdout)
-	result := make([]string, 0)
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if idx := strings.Index(line, " "); idx > 0 {
-			result = append(result, line[:idx])
-		} else if line != "" {
-			result = append(result, line)
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("failed to scan notes: %v", err)
-	}
-	if err := noteCmd.Wait(); err != nil {
-		return nil, fmt.Errorf("failed to wait for notes command: %v", err)
-	}
-
-	return result, nil
-}
-
-func (r *repo) getNoteContents(noteRefs []string, handle func(string)) error {
-	if len(noteRefs) == 0 {
-		return nil
-	}
-
-	catCmd := exec.Command("git", "cat-file", "--batch=")
-	catCmd.Dir = r.path
-
-	stdin, err := catCmd.StdinPipe()
-	if err != nil {
-		return fmt.Errorf("failed to get stdin pipe: %v", err)
+// NewRepo opens the repository at path, creating it if there is none. Call
+// Check before committing to an existing repository.
+func NewRepo(path string, gitIgnore string, options Options) (Repo, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("repo %s does not exist", path)
 	}
-
-	stdout, err := catCmd.StdoutPipe()
 	if err != nil {
-		return fmt.Errorf("failed to get stdout pipe: %v", err)
+		return nil, fmt.Errorf("failed to access repo %s: %w", path, err)
 	}
 
-	if err := catCmd.Start(); err != nil {
-		return fmt.Errorf("failed to start cat-file command: %v", err)
-	}
-
-	// Write all note refs to stdin
-	for _, ref := range noteRefs {
-		if _, err := fmt.Fprintln(stdin, ref); err != nil {
-			stdin.Close()
-			return fmt.Errorf("failed to write to stdin: %v", err)
-		}
-	}
-	stdin.Close()
-
-	// Read the contents from stdout
-	scanner := bufio.NewScanner(stdout)
-
-	for scanner.Scan() {
-		content := scanner.Text()
-
-		if content != "" {
-			handle(content)
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("failed to scan cat-file output: %v", err)
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("path %s is not a directory", path)
 	}
 
-	if err := catCmd.Wait(); err != nil {
-		return fmt.Errorf("failed to wait for cat-file command: %v", err)
+	if !isRepo(path) {
+		log.Printf("creating repo %s", path)
+		return createRepo(path, gitIgnore, options)
 	}
 
-	return nil
-}
-
-func (r *repo) GetNoteContents(handle func(string)) error {
-	noteRefs, err := r.getNotes()
-	if err != nil {
-		return fmt.Errorf("failed to get notes: %v", err)
-	}
-
-	return r.getNoteContents(noteRefs, handle)
+	log.Printf("will manage existing repo %s", path)
+	return openRepo(path, options)
 }
@@ -0,0 +1,545 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var backends = []Backend{BackendGoGit, BackendExec}
+
+var testIdentity = Identity{Name: "test", Email: "test@example.com"}
+
+// isolate keeps the git configuration of the user out of the test, with
+// globalConfig as the global one if not empty
+func isolate(t *testing.T, globalConfig string) {
+	t.Helper()
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	// rather than guessing an identity from the host name
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", "user.useConfigOnly")
+	t.Setenv("GIT_CONFIG_VALUE_0", "true")
+
+	if globalConfig != "" {
+		if err := os.WriteFile(filepath.Join(home, ".gitconfig"), []byte(globalConfig), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestRepo creates a repository in a temporary directory
+func newTestRepo(t *testing.T, backend Backend, identity Identity) (Repo, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	repo, err := NewRepo(dir, "", Options{Backend: backend, Identity: identity})
+	if err != nil {
+		t.Fatalf("NewRepo: %v", err)
+	}
+
+	return repo, dir
+}
+
+// runGit runs the git binary in dir as the test identity
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+// commitFiles writes and commits files, returning the new HEAD
+func commitFiles(t *testing.T, repo Repo, dir string, files map[string]string) string {
+	t.Helper()
+
+	for file, content := range files {
+		writeTestFile(t, dir, file, content)
+		if err := repo.Add(file); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if err := repo.Commit(fmt.Sprintf("commit %d files", len(files)), false); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatalf("Head: %v", err)
+	}
+	return head
+}
+
+func writeTestFile(t *testing.T, dir string, file string, content string) {
+	t.Helper()
+
+	path := filepath.Join(dir, file)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommit(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(string(backend), func(t *testing.T) {
+			isolate(t, "")
+			repo, dir := newTestRepo(t, backend, testIdentity)
+
+			head, err := repo.Head()
+			if err != nil || head != "" {
+				t.Fatalf("Head of a new repo %q, %v", head, err)
+			}
+
+			first := commitFiles(t, repo, dir, map[string]string{"a.md": "a"})
+			if parents, err := repo.Parents(first); err != nil || len(parents) != 0 {
+				t.Errorf("parents of the root commit %v, %v", parents, err)
+			}
+
+			if err := repo.Commit("nothing", false); !errors.Is(err, ErrNothingToCommit) {
+				t.Errorf("Commit without changes: got %v, want %v", err, ErrNothingToCommit)
+			}
+			if err := repo.Commit("empty", true); err != nil {
+				t.Fatalf("Commit allowing empty: %v", err)
+			}
+
+			second, err := repo.Head()
+			if err != nil {
+				t.Fatalf("Head: %v", err)
+			}
+			if parents, err := repo.Parents(second); err != nil || len(parents) != 1 || parents[0] != first {
+				t.Errorf("parents %v, %v; want [%s]", parents, err, first)
+			}
+			if author := runGit(t, dir, "log", "-1", "--format=%an <%ae>"); author != "test <test@example.com>" {
+				t.Errorf("author %q", author)
+			}
+		})
+	}
+}
+
+func TestCommitIdentity(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(string(backend), func(t *testing.T) {
+			// the name is configured, the email is taken from git
+			isolate(t, "[user]\n\tname = global\n\temail = global@example.com\n")
+			repo, dir := newTestRepo(t, backend, Identity{Name: "wikai"})
+
+			commitFiles(t, repo, dir, map[string]string{"a.md": "a"})
+			if author := runGit(t, dir, "log", "-1", "--format=%an <%ae>"); author != "wikai <global@example.com>" {
+				t.Errorf("author %q, want the configured name and the git email", author)
+			}
+
+			isolate(t, "")
+			writeTestFile(t, dir, "b.md", "b")
+			if err := repo.Add("b.md"); err != nil {
+				t.Fatalf("Add: %v", err)
+			}
+			if err := repo.Commit("no identity", false); !errors.Is(err, ErrNoIdentity) {
+				t.Errorf("Commit without an email: got %v, want %v", err, ErrNoIdentity)
+			}
+		})
+	}
+}
+
+// notes collects the notes GetBlobNotes visits
+func notes(t *testing.T, repo Repo, since string) (map[string]string, []string) {
+	t.Helper()
+
+	handled := make(map[string]string)
+	var removed []string
+	err := repo.GetBlobNotes(since, func(blob string, note string) {
+		handled[blob] = note
+	}, func(blob string) {
+		removed = append(removed, blob)
+	})
+	if err != nil {
+		t.Fatalf("GetBlobNotes: %v", err)
+	}
+
+	sort.Strings(removed)
+	return handled, removed
+}
+
+func TestBlobNotes(t *testing.T) {
+	for _, writer := range backends {
+		for _, reader := range backends {
+			t.Run(fmt.Sprintf("%s to %s", writer, reader), func(t *testing.T) {
+				isolate(t, "")
+				repo, dir := newTestRepo(t, writer, testIdentity)
+				other, err := NewRepo(dir, "", Options{Backend: reader, Identity: testIdentity})
+				if err != nil {
+					t.Fatalf("NewRepo: %v", err)
+				}
+
+				if commit, err := other.NotesCommit(); err != nil || commit != "" {
+					t.Fatalf("NotesCommit without notes %q, %v", commit, err)
+				}
+				if handled, _ := notes(t, other, ""); len(handled) != 0 {
+					t.Errorf("notes without any %v", handled)
+				}
+
+				blobs := make(map[string]string)
+				for _, file := range []string{"a.md", "b.md", "c.md"} {
+					writeTestFile(t, dir, file, file)
+					if blobs[file], err = repo.HashFile(file); err != nil {
+						t.Fatalf("HashFile: %v", err)
+					}
+				}
+
+				if err := repo.SetBlobNotes(map[string]string{blobs["a.md"]: "a", blobs["b.md"]: "b"}); err != nil {
+					t.Fatalf("SetBlobNotes: %v", err)
+				}
+				since, err := other.NotesCommit()
+				if err != nil || since == "" {
+					t.Fatalf("NotesCommit %q, %v", since, err)
+				}
+				if handled, _ := notes(t, other, ""); fmt.Sprint(handled) != fmt.Sprint(map[string]string{blobs["a.md"]: "a", blobs["b.md"]: "b"}) {
+					t.Errorf("notes %v", handled)
+				}
+
+				// a replaced, c added, b removed
+				if err := repo.SetBlobNotes(map[string]string{blobs["a.md"]: "a2", blobs["c.md"]: "c"}); err != nil {
+					t.Fatalf("SetBlobNotes: %v", err)
+				}
+				runGit(t, dir, "notes", "--ref", EmbeddingsRef, "remove", blobs["b.md"])
+
+				handled, removed := notes(t, other, since)
+				if fmt.Sprint(handled) != fmt.Sprint(map[string]string{blobs["a.md"]: "a2", blobs["c.md"]: "c"}) {
+					t.Errorf("notes since %s: %v", since, handled)
+				}
+				if fmt.Sprint(removed) != fmt.Sprint([]string{blobs["b.md"]}) {
+					t.Errorf("removed since %s: %v", since, removed)
+				}
+
+				if handled, _ := notes(t, other, ""); fmt.Sprint(handled) != fmt.Sprint(map[string]string{blobs["a.md"]: "a2", blobs["c.md"]: "c"}) {
+					t.Errorf("notes %v", handled)
+				}
+			})
+		}
+	}
+}
+
+func TestResetUnstage(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(string(backend), func(t *testing.T) {
+			isolate(t, "")
+			repo, dir := newTestRepo(t, backend, testIdentity)
+
+			first := commitFiles(t, repo, dir, map[string]string{"a.md": "a"})
+			original, err := repo.BlobID("a.md")
+			if err != nil {
+				t.Fatalf("BlobID: %v", err)
+			}
+
+			writeTestFile(t, dir, "a.md", "edited")
+			writeTestFile(t, dir, "b.md", "b")
+			for _, file := range []string{"a.md", "b.md"} {
+				if err := repo.Add(file); err != nil {
+					t.Fatalf("Add: %v", err)
+				}
+			}
+
+			if err := repo.Unstage(first, "a.md", "b.md"); err != nil {
+				t.Fatalf("Unstage: %v", err)
+			}
+			if blob, err := repo.BlobID("a.md"); err != nil || blob != original {
+				t.Errorf("blob of a.md %q, %v; want %s", blob, err, original)
+			}
+			if blob, err := repo.BlobID("b.md"); err == nil {
+				t.Errorf("b.md still staged as %s", blob)
+			}
+			if content, err := os.ReadFile(filepath.Join(dir, "a.md")); err != nil || string(content) != "edited" {
+				t.Errorf("working tree changed: %q, %v", content, err)
+			}
+
+			second := commitFiles(t, repo, dir, map[string]string{"b.md": "b"})
+			if err := repo.Reset(first); err != nil {
+				t.Fatalf("Reset: %v", err)
+			}
+			if head, err := repo.Head(); err != nil || head != first {
+				t.Errorf("HEAD %q, %v after reset; want %s", head, err, first)
+			}
+			// the index is left alone
+			if _, err := repo.BlobID("b.md"); err != nil {
+				t.Errorf("b.md unstaged by reset: %v", err)
+			}
+
+			if err := repo.Reset(second); err != nil {
+				t.Fatalf("Reset: %v", err)
+			}
+			if err := repo.Unstage("", "b.md"); err != nil {
+				t.Fatalf("Unstage: %v", err)
+			}
+			if _, err := repo.BlobID("b.md"); err == nil {
+				t.Error("b.md still staged")
+			}
+
+			if err := repo.Reset(""); err != nil {
+				t.Fatalf("Reset: %v", err)
+			}
+			if head, err := repo.Head(); err != nil || head != "" {
+				t.Errorf("HEAD %q, %v; want unborn", head, err)
+			}
+		})
+	}
+}
+
+func TestReadFiles(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(string(backend), func(t *testing.T) {
+			isolate(t, "")
+			repo, dir := newTestRepo(t, backend, testIdentity)
+
+			first := commitFiles(t, repo, dir, map[string]string{"c.md": "c", "a.md": "a", "d/b.md": "b", "e.txt": "e"})
+			commitFiles(t, repo, dir, map[string]string{"a.md": "a2"})
+			// not committed
+			writeTestFile(t, dir, "f.md", "f")
+
+			read := func(rev string, limit int) string {
+				t.Helper()
+
+				var files []string
+				err := repo.ReadFiles(rev, func(path string) bool {
+					return strings.HasSuffix(path, ".md")
+				}, func(path string, content []byte) bool {
+					files = append(files, path+"="+string(content))
+					return len(files) < limit
+				})
+				if err != nil {
+					t.Fatalf("ReadFiles %s: %v", rev, err)
+				}
+				return strings.Join(files, " ")
+			}
+
+			for _, test := range []struct {
+				rev   string
+				limit int
+				want  string
+			}{
+				{"HEAD", 10, "a.md=a2 c.md=c d/b.md=b"},
+				{"HEAD", 2, "a.md=a2 c.md=c"},
+				{first, 10, "a.md=a c.md=c d/b.md=b"},
+				{"HEAD~1", 10, "a.md=a c.md=c d/b.md=b"},
+			} {
+				if got := read(test.rev, test.limit); got != test.want {
+					t.Errorf("ReadFiles %s, limit %d: got %s, want %s", test.rev, test.limit, got, test.want)
+				}
+			}
+
+			for _, rev := range []string{"missing", "--all", strings.Repeat("0", 40)} {
+				err := repo.ReadFiles(rev, func(string) bool { return true }, func(string, []byte) bool { return true })
+				if !errors.Is(err, ErrUnknownRevision) {
+					t.Errorf("ReadFiles %s: got %v, want %v", rev, err, ErrUnknownRevision)
+				}
+			}
+
+			var listed []string
+			err := repo.ListFiles(func(path string, blob string) {
+				if hashed, err := repo.HashFile(path); err != nil || hashed != blob {
+					t.Errorf("blob of %s %s, hashed %s, %v", path, blob, hashed, err)
+				}
+				listed = append(listed, path)
+			})
+			if err != nil {
+				t.Fatalf("ListFiles: %v", err)
+			}
+			sort.Strings(listed)
+			if got := strings.Join(listed, " "); got != "a.md c.md d/b.md e.txt" {
+				t.Errorf("ListFiles: got %s", got)
+			}
+		})
+	}
+}
+
+func TestNewRepo(t *testing.T) {
+	isolate(t, "")
+
+	// made with the git binary, on a branch other than the default
+	dir := t.TempDir()
+	runGit(t, dir, "init", "-q", "-b", "trunk")
+	writeTestFile(t, dir, "a.md", "a")
+	runGit(t, dir, "add", "a.md")
+	runGit(t, dir, "commit", "-q", "-m", "add a")
+	head := runGit(t, dir, "rev-parse", "HEAD")
+
+	for _, backend := range backends {
+		t.Run(string(backend), func(t *testing.T) {
+			repo, err := NewRepo(dir, "ignored\n", Options{Backend: backend, Identity: testIdentity})
+			if err != nil {
+				t.Fatalf("NewRepo: %v", err)
+			}
+			if got, err := repo.Head(); err != nil || got != head {
+				t.Errorf("HEAD %q, %v; want %s", got, err, head)
+			}
+			if _, err := os.Stat(filepath.Join(dir, ".gitignore")); !os.IsNotExist(err) {
+				t.Errorf("gitignore added to an existing repo: %v", err)
+			}
+			if warnings, err := repo.Check(""); err != nil || len(warnings) != 0 {
+				t.Errorf("Check: %v, %v", warnings, err)
+			}
+
+			created, createdDir := newTestRepo(t, backend, testIdentity)
+			if branch := runGit(t, createdDir, "symbolic-ref", "HEAD"); branch != BranchRef(DefaultBranch) {
+				t.Errorf("new repo on %s, want %s", branch, BranchRef(DefaultBranch))
+			}
+			if head, err := created.Head(); err != nil || head != "" {
+				t.Errorf("HEAD of a new repo %q, %v", head, err)
+			}
+		})
+	}
+
+	file := filepath.Join(t.TempDir(), "file")
+	writeTestFile(t, filepath.Dir(file), "file", "")
+	for _, path := range []string{
+		filepath.Join(t.TempDir(), "missing"),
+		file,
+		// fails to stat with ENOTDIR rather than ENOENT
+		filepath.Join(file, "wiki"),
+	} {
+		if _, err := NewRepo(path, "", Options{}); err == nil {
+			t.Errorf("NewRepo %s succeeded", path)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// setup brings the repo, with a.md committed on main, to the state
+		// checked
+		setup    func(t *testing.T, dir string)
+		branch   string
+		identity Identity
+		// want are substrings of the error, none if empty
+		want    []string
+		warning string
+	}{
+		{name: "clean"},
+		{name: "clean on branch", branch: DefaultBranch},
+		{
+			name:  "detached HEAD",
+			setup: func(t *testing.T, dir string) { runGit(t, dir, "checkout", "-q", "--detach") },
+			want:  []string{"HEAD is detached; run `git checkout <branch>`"},
+		},
+		{
+			name:   "detached HEAD with branch",
+			setup:  func(t *testing.T, dir string) { runGit(t, dir, "checkout", "-q", "--detach") },
+			branch: DefaultBranch,
+			want:   []string{"HEAD is detached; run `git checkout main`"},
+		},
+		{
+			name:   "wrong branch",
+			branch: "wiki",
+			want:   []string{"is on main, but wikai commits to wiki"},
+		},
+		{
+			name: "merge in progress",
+			setup: func(t *testing.T, dir string) {
+				conflict(t, dir, "merge")
+			},
+			want: []string{"unmerged files", "a.md"},
+		},
+		{
+			name: "rebase in progress",
+			setup: func(t *testing.T, dir string) {
+				conflict(t, dir, "rebase")
+			},
+			want: []string{"HEAD is detached", "unmerged files", "a.md"},
+		},
+		{
+			name: "staged changes",
+			setup: func(t *testing.T, dir string) {
+				writeTestFile(t, dir, "a.md", "staged")
+				runGit(t, dir, "add", "a.md")
+			},
+			want: []string{"staged changes", "a.md"},
+		},
+		{
+			name:    "modified",
+			setup:   func(t *testing.T, dir string) { writeTestFile(t, dir, "a.md", "modified") },
+			warning: "uncommitted changes",
+		},
+		{
+			name:     "missing identity",
+			identity: Identity{Name: "wikai"},
+			want:     []string{ErrNoIdentity.Error()},
+		},
+	} {
+		for _, backend := range backends {
+			t.Run(test.name+"/"+string(backend), func(t *testing.T) {
+				isolate(t, "")
+
+				dir := t.TempDir()
+				runGit(t, dir, "init", "-q", "-b", DefaultBranch)
+				writeTestFile(t, dir, "a.md", "a")
+				runGit(t, dir, "add", "a.md")
+				runGit(t, dir, "commit", "-q", "-m", "add a")
+				if test.setup != nil {
+					test.setup(t, dir)
+				}
+
+				identity := testIdentity
+				if test.identity != (Identity{}) {
+					identity = test.identity
+				}
+				repo, err := NewRepo(dir, "", Options{Backend: backend, Identity: identity})
+				if err != nil {
+					t.Fatalf("NewRepo: %v", err)
+				}
+
+				warnings, err := repo.Check(test.branch)
+				if len(test.want) == 0 && err != nil {
+					t.Errorf("Check: %v", err)
+				}
+				for _, want := range test.want {
+					if err == nil || !strings.Contains(err.Error(), want) {
+						t.Errorf("Check: got %v, want %q", err, want)
+					}
+				}
+				if test.identity != (Identity{}) && !errors.Is(err, ErrNoIdentity) {
+					t.Errorf("Check: got %v, want %v", err, ErrNoIdentity)
+				}
+
+				if got := strings.Join(warnings, "\n"); (test.warning == "") != (got == "") || !strings.Contains(got, test.warning) {
+					t.Errorf("warnings %q, want %q", got, test.warning)
+				}
+			})
+		}
+	}
+}
+
+// conflict commits conflicting changes to a.md on main and on a new branch
+// other, then merges or rebases main onto other
+func conflict(t *testing.T, dir string, command string) {
+	t.Helper()
+
+	runGit(t, dir, "checkout", "-q", "-b", "other")
+	writeTestFile(t, dir, "a.md", "other")
+	runGit(t, dir, "commit", "-q", "-am", "edit a on other")
+	runGit(t, dir, "checkout", "-q", DefaultBranch)
+	writeTestFile(t, dir, "a.md", "main")
+	runGit(t, dir, "commit", "-q", "-am", "edit a on main")
+
+	cmd := exec.Command("git", "-c", "user.name=test", "-c", "user.email=test@example.com", command, "-q", "other")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "CONFLICT") {
+		t.Fatalf("git %s did not conflict: %v: %s", command, err, out)
+	}
+}
@@ -0,0 +1,694 @@
+// Repo implementation on go-git, without spawning processes
+
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func (r *goGitRepo) seal() {}
+
+type goGitRepo struct {
+	path     string
+	repo     *gogit.Repository
+	identity Identity
+}
+
+func openGoGitRepo(path string, identity Identity) (*goGitRepo, error) {
+	repo, err := gogit.PlainOpen(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+
+	cfg, err := repo.Config()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config of %s: %w", path, err)
+	}
+
+	// e.g. objectformat=sha256, which go-git would misread
+	if extensions := cfg.Raw.Section("extensions").Options; len(extensions) > 0 {
+		names := make([]string, len(extensions))
+		for i, option := range extensions {
+			names[i] = option.Key
+		}
+		return nil, fmt.Errorf("unsupported repository extensions %v", names)
+	}
+
+	return &goGitRepo{path: path, repo: repo, identity: identity}, nil
+}
+
+// signature returns the configured identity, completed from the git
+// configuration
+func (r *goGitRepo) signature() (*object.Signature, error) {
+	name, email := r.identity.Name, r.identity.Email
+
+	if name == "" || email == "" {
+		cfg, err := r.repo.ConfigScoped(config.SystemScope)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read git configuration: %w", err)
+		}
+		if name == "" {
+			name = cfg.User.Name
+		}
+		if email == "" {
+			email = cfg.User.Email
+		}
+	}
+
+	if name == "" || email == "" {
+		return nil, ErrNoIdentity
+	}
+
+	return &object.Signature{Name: name, Email: email, When: time.Now()}, nil
+}
+
+func (r *goGitRepo) Add(file string) error {
+	worktree, err := r.repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("failed to get worktree: %w", err)
+	}
+
+	if err := worktree.AddWithOptions(&gogit.AddOptions{Path: file, SkipStatus: true}); err != nil {
+		return fmt.Errorf("failed to add %s: %w", file, err)
+	}
+
+	return nil
+}
+
+func (r *goGitRepo) Remove(file string) error {
+	idx, err := r.repo.Storer.Index()
+	if err != nil {
+		return fmt.Errorf("failed to read index: %w", err)
+	}
+
+	if _, err := idx.Remove(file); err != nil {
+		if errors.Is(err, index.ErrEntryNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to remove %s: %w", file, err)
+	}
+
+	if err := r.repo.Storer.SetIndex(idx); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+
+	return nil
+}
+
+func (r *goGitRepo) HashFile(file string) (string, error) {
+	content, err := os.ReadFile(filepath.Join(r.path, file))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", file, err)
+	}
+
+	return plumbing.ComputeHash(plumbing.BlobObject, content).String(), nil
+}
+
+func (r *goGitRepo) Commit(message string, allowEmpty bool) error {
+	worktree, err := r.repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("failed to get worktree: %w", err)
+	}
+
+	signature, err := r.signature()
+	if err != nil {
+		return err
+	}
+
+	_, err = worktree.Commit(message, &gogit.CommitOptions{
+		Author:            signature,
+		AllowEmptyCommits: allowEmpty,
+	})
+	if errors.Is(err, gogit.ErrEmptyCommit) {
+		return ErrNothingToCommit
+	}
+	if err != nil {
+		return fmt.Errorf("failed to commit %q: %w", message, err)
+	}
+
+	return nil
+}
+
+// refCommit returns the commit a reference points to, or the zero hash if it
+// does not exist
+func (r *goGitRepo) refCommit(name plumbing.ReferenceName) (plumbing.Hash, error) {
+	ref, err := r.repo.Reference(name, true)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return plumbing.ZeroHash, nil
+	}
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to resolve %s: %w", name, err)
+	}
+
+	return ref.Hash(), nil
+}
+
+func (r *goGitRepo) commitTree(hash plumbing.Hash) (*object.Tree, error) {
+	commit, err := r.repo.CommitObject(hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read commit %s: %w", hash, err)
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tree of %s: %w", hash, err)
+	}
+
+	return tree, nil
+}
+
+// walkFiles calls fn for each file in tree, without reading their contents
+func walkFiles(tree *object.Tree, fn func(path string, hash plumbing.Hash)) error {
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entry.Mode.IsFile() {
+			fn(name, entry.Hash)
+		}
+	}
+}
+
+func (r *goGitRepo) GetNoteContents(handle func(string)) error {
+	hash, err := r.refCommit("refs/notes/commits")
+	if err != nil || hash.IsZero() {
+		return err
+	}
+
+	tree, err := r.commitTree(hash)
+	if err != nil {
+		return err
+	}
+
+	return tree.Files().ForEach(func(f *object.File) error {
+		content, err := f.Contents()
+		if err != nil {
+			return fmt.Errorf("failed to read note %s: %w", f.Name, err)
+		}
+
+		for _, line := range strings.Split(content, "\n") {
+			if line != "" {
+				handle(line)
+			}
+		}
+		return nil
+	})
+}
+
+func (r *goGitRepo) Head() (string, error) {
+	hash, err := r.refCommit(plumbing.HEAD)
+	if err != nil || hash.IsZero() {
+		return "", err
+	}
+
+	return hash.String(), nil
+}
+
+func (r *goGitRepo) Parents(commit string) ([]string, error) {
+	obj, err := r.repo.CommitObject(plumbing.NewHash(commit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read commit %s: %w", commit, err)
+	}
+
+	parents := make([]string, len(obj.ParentHashes))
+	for i, hash := range obj.ParentHashes {
+		parents[i] = hash.String()
+	}
+
+	return parents, nil
+}
+
+func (r *goGitRepo) Reset(commit string) error {
+	head, err := r.repo.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return fmt.Errorf("failed to read HEAD: %w", err)
+	}
+
+	name := plumbing.HEAD
+	if head.Type() == plumbing.SymbolicReference {
+		name = head.Target()
+	}
+
+	if commit == "" {
+		err = r.repo.Storer.RemoveReference(name)
+	} else {
+		err = r.repo.Storer.SetReference(plumbing.NewHashReference(name, plumbing.NewHash(commit)))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to reset to %q: %w", commit, err)
+	}
+
+	return nil
+}
+
+func (r *goGitRepo) Unstage(commit string, files ...string) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	idx, err := r.repo.Storer.Index()
+	if err != nil {
+		return fmt.Errorf("failed to read index: %w", err)
+	}
+
+	var tree *object.Tree
+	if commit != "" {
+		tree, err = r.commitTree(plumbing.NewHash(commit))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, file := range files {
+		var f *object.File
+		if tree != nil {
+			f, err = tree.File(file)
+			if err != nil && !errors.Is(err, object.ErrFileNotFound) {
+				return fmt.Errorf("failed to read %s in %s: %w", file, commit, err)
+			}
+		}
+
+		if f == nil {
+			if _, err := idx.Remove(file); err != nil && !errors.Is(err, index.ErrEntryNotFound) {
+				return fmt.Errorf("failed to unstage %s: %w", file, err)
+			}
+			continue
+		}
+
+		entry, err := idx.Entry(file)
+		if err != nil {
+			entry = idx.Add(file)
+		}
+		// the zero stat makes git compare the content on its next refresh
+		*entry = index.Entry{Name: file, Hash: f.Hash, Mode: f.Mode, Size: uint32(f.Size)}
+	}
+
+	if err := r.repo.Storer.SetIndex(idx); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+
+	return nil
+}
+
+func (r *goGitRepo) BlobID(file string) (string, error) {
+	idx, err := r.repo.Storer.Index()
+	if err != nil {
+		return "", fmt.Errorf("failed to read index: %w", err)
+	}
+
+	entry, err := idx.Entry(file)
+	if err != nil {
+		return "", fmt.Errorf("%s is not staged: %w", file, err)
+	}
+
+	return entry.Hash.String(), nil
+}
+
+func (r *goGitRepo) writeObject(obj interface {
+	Encode(plumbing.EncodedObject) error
+}) (plumbing.Hash, error) {
+	encoded := r.repo.Storer.NewEncodedObject()
+	if err := obj.Encode(encoded); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return r.repo.Storer.SetEncodedObject(encoded)
+}
+
+func (r *goGitRepo) writeBlob(content string) (plumbing.Hash, error) {
+	obj := r.repo.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := io.WriteString(w, content); err != nil {
+		w.Close()
+		return plumbing.ZeroHash, err
+	}
+	if err := w.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return r.repo.Storer.SetEncodedObject(obj)
+}
+
+// writeTree writes the tree holding files, given by path, and its subtrees
+func (r *goGitRepo) writeTree(files map[string]plumbing.Hash) (plumbing.Hash, error) {
+	tree := &object.Tree{}
+	subdirs := make(map[string]map[string]plumbing.Hash)
+
+	for path, hash := range files {
+		dir, rest, ok := strings.Cut(path, "/")
+		if !ok {
+			tree.Entries = append(tree.Entries, object.TreeEntry{Name: path, Mode: filemode.Regular, Hash: hash})
+			continue
+		}
+		if subdirs[dir] == nil {
+			subdirs[dir] = make(map[string]plumbing.Hash)
+		}
+		subdirs[dir][rest] = hash
+	}
+
+	for dir, subfiles := range subdirs {
+		hash, err := r.writeTree(subfiles)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: dir, Mode: filemode.Dir, Hash: hash})
+	}
+
+	// git orders directories as if their names ended with a slash
+	sortName := func(entry object.TreeEntry) string {
+		if entry.Mode == filemode.Dir {
+			return entry.Name + "/"
+		}
+		return entry.Name
+	}
+	sort.Slice(tree.Entries, func(i, j int) bool {
+		return sortName(tree.Entries[i]) < sortName(tree.Entries[j])
+	})
+
+	return r.writeObject(tree)
+}
+
+func (r *goGitRepo) SetBlobNotes(notes map[string]string) error {
+	if len(notes) == 0 {
+		return nil
+	}
+
+	parent, err := r.refCommit(EmbeddingsRef)
+	if err != nil {
+		return err
+	}
+
+	// existing notes may be stored with fan-out (e.g., ab/cdef...), in which
+	// case they are replaced in place
+	files := make(map[string]plumbing.Hash)
+	paths := make(map[string]string)
+	if !parent.IsZero() {
+		tree, err := r.commitTree(parent)
+		if err != nil {
+			return err
+		}
+		err = walkFiles(tree, func(path string, hash plumbing.Hash) {
+			files[path] = hash
+			paths[strings.ReplaceAll(path, "/", "")] = path
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list notes tree: %w", err)
+		}
+	}
+
+	for blob, note := range notes {
+		hash, err := r.writeBlob(note)
+		if err != nil {
+			return fmt.Errorf("failed to write note for %s: %w", blob, err)
+		}
+
+		path, ok := paths[blob]
+		if !ok {
+			path = blob
+		}
+		files[path] = hash
+	}
+
+	treeHash, err := r.writeTree(files)
+	if err != nil {
+		return fmt.Errorf("failed to write notes tree: %w", err)
+	}
+
+	signature, err := r.signature()
+	if err != nil {
+		signature = &object.Signature{Name: "wikai", Email: "wikai@localhost", When: time.Now()}
+	}
+
+	commit := &object.Commit{
+		Author:    *signature,
+		Committer: *signature,
+		Message:   fmt.Sprintf("Set %d embeddings", len(notes)),
+		TreeHash:  treeHash,
+	}
+	if !parent.IsZero() {
+		commit.ParentHashes = []plumbing.Hash{parent}
+	}
+
+	hash, err := r.writeObject(commit)
+	if err != nil {
+		return fmt.Errorf("failed to write notes commit: %w", err)
+	}
+
+	ref := plumbing.NewHashReference(EmbeddingsRef, hash)
+	if parent.IsZero() {
+		err = r.repo.Storer.SetReference(ref)
+	} else {
+		// fails if the notes moved since they were read
+		err = r.repo.Storer.CheckAndSetReference(ref, plumbing.NewHashReference(EmbeddingsRef, parent))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update %s: %w", EmbeddingsRef, err)
+	}
+
+	return nil
+}
+
+func (r *goGitRepo) NotesCommit() (string, error) {
+	hash, err := r.refCommit(EmbeddingsRef)
+	if err != nil || hash.IsZero() {
+		return "", err
+	}
+
+	return hash.String(), nil
+}
+
+func (r *goGitRepo) readBlob(hash plumbing.Hash) (string, error) {
+	blob, err := r.repo.BlobObject(hash)
+	if err != nil {
+		return "", err
+	}
+
+	reader, err := blob.Reader()
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+
+	return string(content), nil
+}
+
+func (r *goGitRepo) GetBlobNotes(since string, handle func(blob string, note string), removed func(blob string)) error {
+	hash, err := r.refCommit(EmbeddingsRef)
+	if err != nil {
+		return err
+	}
+	if hash.IsZero() {
+		if since != "" {
+			return fmt.Errorf("%s does not exist", EmbeddingsRef)
+		}
+		return nil
+	}
+
+	tree, err := r.commitTree(hash)
+	if err != nil {
+		return err
+	}
+
+	if since == "" {
+		return tree.Files().ForEach(func(f *object.File) error {
+			note, err := f.Contents()
+			if err != nil {
+				return fmt.Errorf("failed to read note %s: %w", f.Name, err)
+			}
+			handle(strings.ReplaceAll(f.Name, "/", ""), note)
+			return nil
+		})
+	}
+
+	sinceTree, err := r.commitTree(plumbing.NewHash(since))
+	if err != nil {
+		return err
+	}
+
+	changes, err := object.DiffTree(sinceTree, tree)
+	if err != nil {
+		return fmt.Errorf("failed to diff notes since %s: %w", since, err)
+	}
+
+	for _, change := range changes {
+		if change.To.Name == "" {
+			removed(strings.ReplaceAll(change.From.Name, "/", ""))
+			continue
+		}
+
+		note, err := r.readBlob(change.To.TreeEntry.Hash)
+		if err != nil {
+			return fmt.Errorf("failed to read note %s: %w", change.To.Name, err)
+		}
+		handle(strings.ReplaceAll(change.To.Name, "/", ""), note)
+	}
+
+	return nil
+}
+
+func (r *goGitRepo) ListFiles(handle func(path string, blob string)) error {
+	head, err := r.refCommit(plumbing.HEAD)
+	if err != nil || head.IsZero() {
+		return err
+	}
+
+	tree, err := r.commitTree(head)
+	if err != nil {
+		return err
+	}
+
+	err = walkFiles(tree, func(path string, hash plumbing.Hash) {
+		handle(path, hash.String())
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+
+	return nil
+}
+
+func (r *goGitRepo) ReadFiles(rev string, match func(path string) bool, handle func(path string, content []byte) bool) error {
+	hash, err := r.repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUnknownRevision, rev)
+	}
+
+	tree, err := r.commitTree(*hash)
+	if err != nil {
+		return err
+	}
+
+	blobs := make(map[string]plumbing.Hash)
+	err = walkFiles(tree, func(path string, hash plumbing.Hash) {
+		if match(path) {
+			blobs[path] = hash
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+
+	paths := make([]string, 0, len(blobs))
+	for path := range blobs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		content, err := r.readBlob(blobs[path])
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if !handle(path, []byte(content)) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func initGoGitRepo(path string, branch string) error {
+	_, err := gogit.PlainInitWithOptions(path, &gogit.PlainInitOptions{
+		InitOptions: gogit.InitOptions{DefaultBranch: plumbing.ReferenceName(BranchRef(branch))},
+	})
+	return err
+}
+
+func (r *goGitRepo) state() (repoState, error) {
+	var s repoState
+
+	worktree, err := r.repo.Worktree()
+	if errors.Is(err, gogit.ErrIsBareRepository) {
+		s.bare = true
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+
+	head, err := r.repo.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return s, fmt.Errorf("failed to read HEAD: %w", err)
+	}
+	if head.Type() == plumbing.SymbolicReference {
+		s.branch = head.Target().String()
+	}
+
+	if _, err := r.signature(); err != nil {
+		s.identityErr = err
+	}
+
+	idx, err := r.repo.Storer.Index()
+	if err != nil {
+		return s, fmt.Errorf("failed to read index: %w", err)
+	}
+	for _, entry := range idx.Entries {
+		// index.Merged is 1, like index.AncestorMode, but merged entries are
+		// decoded with stage 0
+		if entry.Stage != 0 && !slices.Contains(s.unmerged, entry.Name) {
+			s.unmerged = append(s.unmerged, entry.Name)
+		}
+	}
+	if len(s.unmerged) > 0 {
+		// go-git does not compute the status of conflicts
+		return s, nil
+	}
+
+	status, err := worktree.Status()
+	if err != nil {
+		return s, fmt.Errorf("failed to get status: %w", err)
+	}
+	for file, fileStatus := range status {
+		if fileStatus.Staging != gogit.Unmodified && fileStatus.Staging != gogit.Untracked {
+			s.staged = append(s.staged, file)
+		}
+		if fileStatus.Worktree != gogit.Unmodified && fileStatus.Worktree != gogit.Untracked {
+			s.modified = append(s.modified, file)
+		}
+	}
+	sort.Strings(s.staged)
+	sort.Strings(s.modified)
+
+	return s, nil
+}
+
+func (r *goGitRepo) Check(branch string) ([]string, error) {
+	s, err := r.state()
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect %s: %w", r.path, err)
+	}
+
+	return s.check(r.path, branch)
+}
@@ -0,0 +1,80 @@
+// startup health check
+
+package git
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// repoState is what Check needs to know about a repository
+type repoState struct {
+	bare bool
+	// branch HEAD is on, e.g. refs/heads/main; empty if HEAD is detached
+	branch string
+	// identityErr is set if commits would have no identity
+	identityErr error
+	// unmerged files have conflicts
+	unmerged []string
+	// staged files differ between the index and HEAD
+	staged []string
+	// modified files differ between the working tree and the index
+	modified []string
+}
+
+// BranchRef returns the ref of a branch name
+func BranchRef(branch string) string {
+	return "refs/heads/" + branch
+}
+
+func listFiles(files []string) string {
+	const limit = 5
+	if len(files) > limit {
+		return fmt.Sprintf("%s and %d more", strings.Join(files[:limit], ", "), len(files)-limit)
+	}
+	return strings.Join(files, ", ")
+}
+
+// check turns the state into an error listing every problem that keeps
+// wikai from committing safely, and warnings for the ones that do not
+func (s repoState) check(path string, branch string) ([]string, error) {
+	var errs []error
+	var warnings []string
+
+	if s.bare {
+		errs = append(errs, fmt.Errorf("%s is a bare repository; point wikiPath at a clone with a working tree", path))
+		return nil, errors.Join(errs...)
+	}
+
+	switch {
+	case s.branch == "" && branch == "":
+		errs = append(errs, fmt.Errorf("HEAD is detached; run `git checkout <branch>` in %s", path))
+	case s.branch == "":
+		errs = append(errs, fmt.Errorf("HEAD is detached; run `git checkout %s` in %s", branch, path))
+	case branch != "" && s.branch != BranchRef(branch):
+		errs = append(errs, fmt.Errorf("%s is on %s, but wikai commits to %s; run `git checkout %s`, or change gitBranch",
+			path, strings.TrimPrefix(s.branch, "refs/heads/"), branch, branch))
+	}
+
+	if s.identityErr != nil {
+		errs = append(errs, s.identityErr)
+	}
+
+	if len(s.unmerged) > 0 {
+		errs = append(errs, fmt.Errorf("unmerged files in %s (%s); resolve the conflicts and commit, or abort the merge",
+			path, listFiles(s.unmerged)))
+	}
+
+	if len(s.staged) > 0 {
+		errs = append(errs, fmt.Errorf("staged changes in %s (%s) would be included in wikai's commits; commit them or run `git restore --staged`",
+			path, listFiles(s.staged)))
+	}
+
+	if len(s.modified) > 0 {
+		warnings = append(warnings, fmt.Sprintf("uncommitted changes in %s (%s); pages are committed when they are indexed",
+			path, listFiles(s.modified)))
+	}
+
+	return warnings, errors.Join(errs...)
+}
@@ -0,0 +1,101 @@
+// Package grep finds exact text, or regular expressions, in the lines of
+// pages; unlike search, it does not go by meaning
+package grep
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MaxContext is the most lines of context around a match
+const MaxContext = 10
+
+// Options describes what to look for
+type Options struct {
+	Pattern string
+	// Regexp interprets the pattern as a regular expression (RE2 syntax),
+	// rather than as literal text
+	Regexp     bool
+	IgnoreCase bool
+	// Context is the number of lines before and after each match to return
+	Context int
+}
+
+// Matcher finds the lines of a page matching a pattern
+type Matcher struct {
+	re      *regexp.Regexp
+	context int
+	// literal is set if the pattern is literal text, which matches a page
+	// only if it matches one of its lines
+	literal bool
+}
+
+// Compile validates the options and returns their matcher
+func Compile(options Options) (*Matcher, error) {
+	if options.Pattern == "" {
+		return nil, errors.New("empty pattern")
+	}
+	if options.Context < 0 || options.Context > MaxContext {
+		return nil, fmt.Errorf("context must be between 0 and %d lines", MaxContext)
+	}
+
+	pattern := options.Pattern
+	if !options.Regexp {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if options.IgnoreCase {
+		pattern = "(?i)" + pattern
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+
+	return &Matcher{re: re, context: options.Context, literal: !options.Regexp}, nil
+}
+
+// Match is a matching line, numbered from 1, with the lines around it
+type Match struct {
+	Line   int
+	Text   string
+	Before []string
+	After  []string
+}
+
+// Find returns the matching lines of content, at most limit of them if
+// positive
+func (m *Matcher) Find(content []byte, limit int) []Match {
+	// cheap rejection of the pages without any match; a regular expression
+	// may match lines but not the page, e.g. if anchored with ^
+	if m.literal && !m.re.Match(content) {
+		return nil
+	}
+
+	lines := strings.Split(string(bytes.TrimSuffix(content, []byte("\n"))), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+
+	var matches []Match
+	for i, line := range lines {
+		if !m.re.MatchString(line) {
+			continue
+		}
+
+		matches = append(matches, Match{
+			Line:   i + 1,
+			Text:   line,
+			Before: lines[max(0, i-m.context):i],
+			After:  lines[i+1 : min(len(lines), i+1+m.context)],
+		})
+		if limit > 0 && len(matches) == limit {
+			break
+		}
+	}
+
+	return matches
+}
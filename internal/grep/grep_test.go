@@ -0,0 +1,89 @@
+package grep
+
+import (
+	"fmt"
+	"testing"
+)
+
+const page = "first\nmatch one\nthird\r\nfourth\nmatch two\nlast match\n"
+
+func TestFind(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		options Options
+		limit   int
+		want    []Match
+	}{
+		{
+			name:    "no context",
+			options: Options{Pattern: "match"},
+			want: []Match{
+				{Line: 2, Text: "match one", Before: []string{}, After: []string{}},
+				{Line: 5, Text: "match two", Before: []string{}, After: []string{}},
+				{Line: 6, Text: "last match", Before: []string{}, After: []string{}},
+			},
+		},
+		{
+			// the context is cut at the start and end of the page, and
+			// overlaps between matches
+			name:    "context",
+			options: Options{Pattern: "match", Context: 2},
+			want: []Match{
+				{Line: 2, Text: "match one", Before: []string{"first"}, After: []string{"third", "fourth"}},
+				{Line: 5, Text: "match two", Before: []string{"third", "fourth"}, After: []string{"last match"}},
+				{Line: 6, Text: "last match", Before: []string{"fourth", "match two"}, After: []string{}},
+			},
+		},
+		{
+			name:    "limit",
+			options: Options{Pattern: "match", Context: 1},
+			limit:   2,
+			want: []Match{
+				{Line: 2, Text: "match one", Before: []string{"first"}, After: []string{"third"}},
+				{Line: 5, Text: "match two", Before: []string{"fourth"}, After: []string{"last match"}},
+			},
+		},
+		{
+			name:    "ignore case",
+			options: Options{Pattern: "MATCH T", IgnoreCase: true},
+			want:    []Match{{Line: 5, Text: "match two", Before: []string{}, After: []string{}}},
+		},
+		{
+			name:    "regexp",
+			options: Options{Pattern: "^match", Regexp: true},
+			want: []Match{
+				{Line: 2, Text: "match one", Before: []string{}, After: []string{}},
+				{Line: 5, Text: "match two", Before: []string{}, After: []string{}},
+			},
+		},
+		{
+			name:    "literal",
+			options: Options{Pattern: "^match"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			matcher, err := Compile(test.options)
+			if err != nil {
+				t.Fatalf("Compile: %v", err)
+			}
+
+			got := matcher.Find([]byte(page), test.limit)
+			if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, options := range []Options{
+		{},
+		{Pattern: "x", Context: -1},
+		{Pattern: "x", Context: MaxContext + 1},
+		{Pattern: "(", Regexp: true},
+	} {
+		if _, err := Compile(options); err == nil {
+			t.Errorf("Compile(%+v) succeeded", options)
+		}
+	}
+}
@@ -6,6 +6,11 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"time"
+
+	"github.com/vasilisp/wikai/internal/git"
+	"github.com/vasilisp/wikai/pkg/backai"
+	"github.com/vasilisp/wikai/pkg/embedding"
 )
 
 type config struct {
@@ -14,6 +19,66 @@ type config struct {
 	OpenAIToken         string `json:"openaiToken"`
 	EmbeddingDimensions int    `json:"embeddingDimensions,omitempty"`
 	Port                int    `json:"port,omitempty"`
+	// SearchTokenBudgets maps chat model names to the token budget for
+	// documents returned by the search tool
+	SearchTokenBudgets map[string]int `json:"searchTokenBudgets,omitempty"`
+	// UsagePath is where token usage counters are persisted
+	UsagePath string `json:"usagePath,omitempty"`
+	// DailySpendingCap is the maximum daily OpenAI cost in USD; zero means no
+	// cap
+	DailySpendingCap float64 `json:"dailySpendingCap,omitempty"`
+	// EmbeddingCachePath is the directory for cached embeddings
+	EmbeddingCachePath string `json:"embeddingCachePath,omitempty"`
+	// EmbeddingCacheSize is the maximum number of cached embeddings
+	EmbeddingCacheSize int `json:"embeddingCacheSize,omitempty"`
+	// RequestTimeoutSeconds bounds each embedding and chat completion request
+	RequestTimeoutSeconds int `json:"requestTimeoutSeconds,omitempty"`
+	// MaxRetries is the number of retries for failed embedding and chat
+	// completion requests; -1 disables retries
+	MaxRetries int `json:"maxRetries,omitempty"`
+	// RequestsPerMinute limits the rate of embedding requests, and that of
+	// chat completion requests
+	RequestsPerMinute int `json:"requestsPerMinute,omitempty"`
+	// QueryTimeoutSeconds bounds the tool calls made while answering a query
+	QueryTimeoutSeconds int `json:"queryTimeoutSeconds,omitempty"`
+	// IndexWorkers is the number of background indexing workers
+	IndexWorkers int `json:"indexWorkers,omitempty"`
+	// IndexBatchSize is the number of pages an indexing job commits together,
+	// 20 by default. A job shows progress and can be cancelled between
+	// batches, and a cancelled or failed job leaves the batches it finished
+	// committed.
+	IndexBatchSize int `json:"indexBatchSize,omitempty"`
+	// VectorEncoding is how embeddings are stored, both in notes and in
+	// memory: float64 (default), float32 or int8. A change applies in memory
+	// on restart, while existing notes keep their encoding until their pages
+	// are indexed again.
+	VectorEncoding embedding.Encoding `json:"vectorEncoding,omitempty"`
+	// GitBackend is "go-git" (default) or "exec", to run the git binary
+	GitBackend git.Backend `json:"gitBackend,omitempty"`
+	// GitAuthorName and GitAuthorEmail are the identity of the commits made
+	// by wikai; by default they come from the git configuration
+	GitAuthorName  string `json:"gitAuthorName,omitempty"`
+	GitAuthorEmail string `json:"gitAuthorEmail,omitempty"`
+	// GitBranch is the branch wikai commits to; startup fails if the wiki is
+	// on another one. By default, any branch is accepted.
+	GitBranch string `json:"gitBranch,omitempty"`
+	// WatchIntervalSeconds is how often the wiki is polled for pages edited
+	// outside wikai; zero disables the watcher
+	WatchIntervalSeconds int `json:"watchIntervalSeconds,omitempty"`
+	// WatchDebounceSeconds is how long a page must be left alone before the
+	// watcher indexes it
+	WatchDebounceSeconds int `json:"watchDebounceSeconds,omitempty"`
+	// SearchMMRLambda trades relevance for diversity in the results of the
+	// search tool, between 0 and 1; 1 ranks by relevance alone and 0 by
+	// diversity alone. Default 0.7.
+	SearchMMRLambda *float64 `json:"searchMMRLambda,omitempty"`
+	// DuplicateSimilarity is the cosine similarity above which two pages are
+	// reported as likely duplicates, between 0 and 1; default 0.9
+	DuplicateSimilarity float64 `json:"duplicateSimilarity,omitempty"`
+	// AutoTagSimilarity is the cosine similarity between a page and a tag of
+	// the vocabulary above which the tag is proposed for the page, between 0
+	// and 1; default 0.4
+	AutoTagSimilarity float64 `json:"autoTagSimilarity,omitempty"`
 }
 
 func loadConfig() *config {
@@ -51,6 +116,35 @@ func loadConfig() *config {
 		config.Port = 8080
 	}
 
+	if config.UsagePath == "" {
+		config.UsagePath = filepath.Join(homeDir, ".config", "wikai-usage.json")
+	}
+
+	if config.EmbeddingCachePath == "" {
+		config.EmbeddingCachePath = filepath.Join(homeDir, ".cache", "wikai", "embeddings")
+	}
+
+	config.VectorEncoding, err = embedding.ParseEncoding(string(config.VectorEncoding))
+	if err != nil {
+		log.Fatal("Failed to parse config file:", err)
+	}
+
+	if lambda := config.SearchMMRLambda; lambda != nil && (*lambda < 0 || *lambda > 1) {
+		log.Fatal("searchMMRLambda must be between 0 and 1")
+	}
+
+	if config.DuplicateSimilarity == 0 {
+		config.DuplicateSimilarity = backai.DefaultDuplicateSimilarity
+	} else if config.DuplicateSimilarity < 0 || config.DuplicateSimilarity > 1 {
+		log.Fatal("duplicateSimilarity must be between 0 and 1")
+	}
+
+	if config.AutoTagSimilarity == 0 {
+		config.AutoTagSimilarity = defaultAutoTagSimilarity
+	} else if config.AutoTagSimilarity < 0 || config.AutoTagSimilarity > 1 {
+		log.Fatal("autoTagSimilarity must be between 0 and 1")
+	}
+
 	return &config
 }
 
@@ -65,3 +159,29 @@ func wikiPath(config *config) (string, error) {
 	}
 	return wikiPath, nil
 }
+
+func (config *config) retryPolicy() backai.RetryPolicy {
+	policy := backai.DefaultRetryPolicy
+
+	if config.RequestTimeoutSeconds > 0 {
+		policy.Timeout = time.Duration(config.RequestTimeoutSeconds) * time.Second
+	}
+	if config.MaxRetries > 0 {
+		policy.MaxRetries = config.MaxRetries
+	} else if config.MaxRetries < 0 {
+		policy.MaxRetries = 0
+	}
+
+	return policy
+}
+
+func (config *config) gitOptions() git.Options {
+	return git.Options{
+		Backend: config.GitBackend,
+		Identity: git.Identity{
+			Name:  config.GitAuthorName,
+			Email: config.GitAuthorEmail,
+		},
+		Branch: config.GitBranch,
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/vasilisp/wikai/pkg/api"
+)
+
+// duplicatesHandler lists the pairs of pages at least as similar as the
+// threshold parameter, or the configured duplicate similarity, most similar
+// first
+func duplicatesHandler(ctx *ctx, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	threshold := ctx.config.DuplicateSimilarity
+	if s := r.URL.Query().Get("threshold"); s != "" {
+		var err error
+		if threshold, err = strconv.ParseFloat(s, 64); err != nil || threshold <= 0 || threshold > 1 {
+			http.Error(w, "Invalid threshold", http.StatusBadRequest)
+			return
+		}
+	}
+
+	pairs, err := ctx.bai.DB().SimilarPairs(threshold)
+	if err != nil {
+		log.Printf("duplicates error: %v", err)
+		http.Error(w, "Failed to find duplicates", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]api.Duplicate, len(pairs))
+	for i, pair := range pairs {
+		a, _ := ctx.meta.info(pair.A)
+		b, _ := ctx.meta.info(pair.B)
+		response[i] = api.Duplicate{A: a, B: b, Similarity: pair.Similarity}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
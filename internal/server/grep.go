@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vasilisp/wikai/internal/git"
+	"github.com/vasilisp/wikai/internal/grep"
+	"github.com/vasilisp/wikai/internal/util"
+	"github.com/vasilisp/wikai/pkg/api"
+)
+
+const (
+	// matches returned if the limit parameter is missing
+	defaultGrepMatches = 100
+	// most matches returned
+	maxGrepMatches = 1000
+)
+
+// grepPages finds the lines the matcher accepts in the pages under prefix, in
+// the working tree or, if rev is not empty, in that revision. At most limit
+// matches are returned, sorted by page and line; truncated tells whether
+// there were more. Pages are read one at a time, in order, until the limit
+// is reached.
+func grepPages(ctx *ctx, rev string, prefix string, matcher *grep.Matcher, limit int) (api.GrepResult, error) {
+	util.Assert(ctx != nil, "grepPages nil ctx")
+	util.Assert(limit > 0, "grepPages non-positive limit")
+
+	result := api.GrepResult{Matches: make([]api.GrepMatch, 0)}
+
+	// add adds the matches of a page, returning false once there are more
+	// than limit
+	add := func(path string, content []byte) bool {
+		// one more than the rest, to tell whether there are more
+		for _, match := range matcher.Find(content, limit+1-len(result.Matches)) {
+			if len(result.Matches) == limit {
+				result.Truncated = true
+				return false
+			}
+			result.Matches = append(result.Matches, api.GrepMatch{
+				Path:   path,
+				Line:   match.Line,
+				Text:   match.Text,
+				Before: match.Before,
+				After:  match.After,
+			})
+		}
+		return true
+	}
+
+	if rev != "" {
+		err := ctx.git.ReadFiles(rev, func(file string) bool {
+			path, ok := strings.CutSuffix(file, ".md")
+			return ok && strings.HasPrefix(path, prefix) && util.ValidatePagePath(path) == nil
+		}, func(file string, content []byte) bool {
+			return add(strings.TrimSuffix(file, ".md"), content)
+		})
+		if err != nil {
+			return api.GrepResult{}, err
+		}
+		return result, nil
+	}
+
+	wikiPath0, err := wikiPath(ctx.config)
+	if err != nil {
+		return api.GrepResult{}, err
+	}
+
+	pages, err := scanPages(wikiPath0)
+	if err != nil {
+		return api.GrepResult{}, err
+	}
+
+	paths := make([]string, 0, len(pages))
+	for path := range pages {
+		if strings.HasPrefix(path, prefix) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		content, err := os.ReadFile(filepath.Join(wikiPath0, path+".md"))
+		if err != nil {
+			// removed since the scan
+			continue
+		}
+		if !add(path, content) {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+func (ctx *ctx) Grep(options grep.Options, prefix string, limit int) (api.GrepResult, error) {
+	matcher, err := grep.Compile(options)
+	if err != nil {
+		return api.GrepResult{}, err
+	}
+
+	return grepPages(ctx, "", prefix, matcher, limit)
+}
+
+// grepHandler returns the lines of pages matching the q parameter, literally
+// unless regex is set, with as many lines of context as the context
+// parameter. The pages are those under prefix, in the working tree or in the
+// rev revision.
+func grepHandler(ctx *ctx, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	options := grep.Options{Pattern: query.Get("q")}
+	limit := defaultGrepMatches
+
+	var err error
+	if s := query.Get("regex"); s != "" {
+		if options.Regexp, err = strconv.ParseBool(s); err != nil {
+			http.Error(w, "Invalid regex", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("ignore_case"); s != "" {
+		if options.IgnoreCase, err = strconv.ParseBool(s); err != nil {
+			http.Error(w, "Invalid ignore_case", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("context"); s != "" {
+		if options.Context, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "Invalid context", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 || limit > maxGrepMatches {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	matcher, err := grep.Compile(options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := grepPages(ctx, query.Get("rev"), query.Get("prefix"), matcher, limit)
+	if err != nil {
+		if errors.Is(err, git.ErrUnknownRevision) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("grep error: %v", err)
+		http.Error(w, "Grep failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+	"github.com/google/uuid"
+	"github.com/vasilisp/wikai/internal/util"
+	"github.com/vasilisp/wikai/pkg/api"
+)
+
+// number of finished jobs whose status is kept around
+const finishedJobsLimit = 100
+
+// capacity of the queue of jobs waiting for a worker
+const jobQueueSize = 64
+
+// defaultIndexBatchSize is the number of pages of a job committed together
+// when no batch size is configured
+const defaultIndexBatchSize = 20
+
+var errQueueFull = errors.New("indexing queue is full")
+
+type job struct {
+	mu     sync.Mutex
+	status api.IndexJob
+	// reason is appended to the commit messages of the job
+	reason string
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (j *job) snapshot() api.IndexJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	status := j.status
+	status.Results = append([]api.IndexResult(nil), j.status.Results...)
+	return status
+}
+
+func (j *job) update(fn func(status *api.IndexJob)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	fn(&j.status)
+	j.status.Updated = time.Now().Unix()
+}
+
+type jobQueue struct {
+	mu       sync.Mutex
+	active   map[string]*job
+	finished *lru.Cache
+	queue    chan *job
+	// batchSize is the number of pages of a job embedded and committed
+	// together
+	batchSize int
+}
+
+// newJobQueue starts workers goroutines that run indexing jobs in the
+// background. Every batchSize pages of a job (defaultIndexBatchSize if not
+// positive) are committed as they are done: the job reports progress and can
+// be cancelled between batches, and the batches it finished stay committed if
+// it is cancelled or fails.
+func newJobQueue(ctx *ctx, workers int, batchSize int) *jobQueue {
+	util.Assert(ctx != nil, "newJobQueue nil ctx")
+
+	if workers <= 0 {
+		workers = 1
+	}
+	if batchSize <= 0 {
+		batchSize = defaultIndexBatchSize
+	}
+
+	q := &jobQueue{
+		active:    make(map[string]*job),
+		finished:  lru.New(finishedJobsLimit),
+		queue:     make(chan *job, jobQueueSize),
+		batchSize: batchSize,
+	}
+
+	for range workers {
+		go func() {
+			for j := range q.queue {
+				q.run(ctx, j)
+			}
+		}()
+	}
+
+	return q
+}
+
+// submit queues a job indexing paths, returning its initial status
+func (q *jobQueue) submit(paths []string, reason string) (api.IndexJob, error) {
+	now := time.Now().Unix()
+
+	results := make([]api.IndexResult, len(paths))
+	for i, path := range paths {
+		results[i] = api.IndexResult{Path: path, State: api.PagePending}
+	}
+
+	jobCtx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		status: api.IndexJob{
+			ID:      uuid.New().String(),
+			State:   api.JobQueued,
+			Total:   len(paths),
+			Results: results,
+			Created: now,
+			Updated: now,
+		},
+		reason: reason,
+		ctx:    jobCtx,
+		cancel: cancel,
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	select {
+	case q.queue <- j:
+	default:
+		cancel()
+		return api.IndexJob{}, errQueueFull
+	}
+
+	q.active[j.status.ID] = j
+	log.Printf("queued indexing job %s with %d pages", j.status.ID, len(paths))
+
+	return j.snapshot(), nil
+}
+
+func (q *jobQueue) get(id string) (*job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if j, ok := q.active[id]; ok {
+		return j, true
+	}
+
+	if j, ok := q.finished.Get(id); ok {
+		return j.(*job), true
+	}
+
+	return nil, false
+}
+
+func (q *jobQueue) status(id string) (api.IndexJob, bool) {
+	j, ok := q.get(id)
+	if !ok {
+		return api.IndexJob{}, false
+	}
+
+	return j.snapshot(), true
+}
+
+// cancel stops a job; batches already committed stay indexed
+func (q *jobQueue) cancelJob(id string) (api.IndexJob, bool) {
+	j, ok := q.get(id)
+	if !ok {
+		return api.IndexJob{}, false
+	}
+
+	j.cancel()
+
+	return j.snapshot(), true
+}
+
+func (q *jobQueue) finish(j *job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.active, j.status.ID)
+	q.finished.Add(j.status.ID, j)
+}
+
+func (q *jobQueue) run(ctx *ctx, j *job) {
+	defer q.finish(j)
+	defer j.cancel()
+
+	j.update(func(status *api.IndexJob) {
+		status.State = api.JobRunning
+	})
+
+	paths := make([]string, 0, j.status.Total)
+	for _, result := range j.snapshot().Results {
+		paths = append(paths, result.Path)
+	}
+
+	for start := 0; start < len(paths); start += q.batchSize {
+		end := min(start+q.batchSize, len(paths))
+
+		if j.ctx.Err() != nil {
+			j.update(func(status *api.IndexJob) {
+				for i := start; i < len(paths); i++ {
+					status.Results[i].State = api.PageCancelled
+				}
+				status.State = api.JobCancelled
+			})
+			log.Printf("cancelled indexing job %s", j.status.ID)
+			return
+		}
+
+		results := indexBatch(ctx, j.ctx, paths[start:end], j.reason)
+
+		j.update(func(status *api.IndexJob) {
+			for i, result := range results {
+				switch {
+				case result.State == api.PageCancelled:
+					// cancelled while the batch was embedded
+				case result.Error != "":
+					result.State = api.PageFailed
+					status.Failed++
+					status.Done++
+				default:
+					result.State = api.PageIndexed
+					status.Done++
+				}
+				status.Results[start+i] = result
+			}
+		})
+	}
+
+	if j.ctx.Err() != nil {
+		j.update(func(status *api.IndexJob) {
+			status.State = api.JobCancelled
+		})
+		log.Printf("cancelled indexing job %s", j.status.ID)
+		return
+	}
+
+	j.update(func(status *api.IndexJob) {
+		status.State = api.JobDone
+	})
+
+	final := j.snapshot()
+	log.Printf("finished indexing job %s: %d pages, %d failed", final.ID, final.Done, final.Failed)
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/vasilisp/wikai/internal/util"
+	"github.com/vasilisp/wikai/internal/wikilink"
+	"github.com/vasilisp/wikai/pkg/api"
+)
+
+// linkGraph is the [[links]] between pages, in both directions. Links to
+// pages that do not exist are kept, so that backlinks show up as soon as the
+// page is written.
+type linkGraph struct {
+	mu sync.RWMutex
+	// out maps pages to the pages they link to, in order
+	out map[string][]string
+	// in maps pages to the pages linking to them
+	in map[string]map[string]bool
+}
+
+func newLinkGraph() *linkGraph {
+	return &linkGraph{
+		out: make(map[string][]string),
+		in:  make(map[string]map[string]bool),
+	}
+}
+
+// set replaces the outbound links of a page with the links in its content
+func (g *linkGraph) set(path string, content []byte) {
+	targets := wikilink.Targets(content)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.removeLocked(path)
+
+	if len(targets) == 0 {
+		return
+	}
+
+	g.out[path] = targets
+	for _, target := range targets {
+		if g.in[target] == nil {
+			g.in[target] = make(map[string]bool)
+		}
+		g.in[target][path] = true
+	}
+}
+
+// remove drops the outbound links of a page; links to it are kept
+func (g *linkGraph) remove(path string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.removeLocked(path)
+}
+
+func (g *linkGraph) removeLocked(path string) {
+	for _, target := range g.out[path] {
+		delete(g.in[target], path)
+		if len(g.in[target]) == 0 {
+			delete(g.in, target)
+		}
+	}
+	delete(g.out, path)
+}
+
+func (g *linkGraph) outbound(path string) []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return slices.Clone(g.out[path])
+}
+
+// inbound returns the pages linking to a page, sorted
+func (g *linkGraph) inbound(path string) []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	sources := make([]string, 0, len(g.in[path]))
+	for source := range g.in[path] {
+		sources = append(sources, source)
+	}
+	slices.Sort(sources)
+
+	return sources
+}
+
+// pageExists tells whether there is a page at a valid path
+func pageExists(ctx *ctx, path string) bool {
+	wikiPath0, err := wikiPath(ctx.config)
+	if err != nil {
+		return false
+	}
+
+	fi, err := os.Stat(filepath.Join(wikiPath0, path+".md"))
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// linksHandler returns the outbound and inbound links of a page
+func linksHandler(ctx *ctx, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, api.LinksPath), ".md")
+	if err := util.ValidatePagePath(path); err != nil {
+		http.Error(w, "Invalid page path", http.StatusBadRequest)
+		return
+	}
+
+	links := api.Links{
+		Path:     path,
+		Outbound: make([]api.Link, 0),
+		Inbound:  make([]api.Link, 0),
+	}
+	for _, target := range ctx.links.outbound(path) {
+		links.Outbound = append(links.Outbound, api.Link{Path: target, Exists: pageExists(ctx, target)})
+	}
+	for _, source := range ctx.links.inbound(path) {
+		links.Inbound = append(links.Inbound, api.Link{Path: source, Exists: true})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(links)
+}
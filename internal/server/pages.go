@@ -0,0 +1,363 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vasilisp/wikai/internal/frontmatter"
+	"github.com/vasilisp/wikai/internal/util"
+	"github.com/vasilisp/wikai/pkg/api"
+	"github.com/vasilisp/wikai/pkg/search"
+)
+
+// metaIndex is the front matter of every page, and the pages their aliases
+// point to
+type metaIndex struct {
+	mu      sync.RWMutex
+	pages   map[string]frontmatter.Meta
+	titles  map[string]string
+	aliases map[string]string
+}
+
+func newMetaIndex() *metaIndex {
+	return &metaIndex{
+		pages:   make(map[string]frontmatter.Meta),
+		titles:  make(map[string]string),
+		aliases: make(map[string]string),
+	}
+}
+
+func (m *metaIndex) set(path string, meta frontmatter.Meta, title string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.removeLocked(path)
+
+	m.pages[path] = meta
+	m.titles[path] = title
+	for _, alias := range meta.Aliases {
+		if other, ok := m.aliases[alias]; ok && other != path {
+			log.Printf("alias %s of %s is also an alias of %s", alias, path, other)
+			continue
+		}
+		m.aliases[alias] = path
+	}
+}
+
+func (m *metaIndex) remove(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.removeLocked(path)
+}
+
+func (m *metaIndex) removeLocked(path string) {
+	for _, alias := range m.pages[path].Aliases {
+		if m.aliases[alias] == path {
+			delete(m.aliases, alias)
+		}
+	}
+	delete(m.pages, path)
+	delete(m.titles, path)
+}
+
+// resolveAlias returns the page an alias points to
+func (m *metaIndex) resolveAlias(alias string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	path, ok := m.aliases[alias]
+	return path, ok
+}
+
+func (m *metaIndex) info(path string) (api.PageInfo, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	meta, ok := m.pages[path]
+	if !ok {
+		return api.PageInfo{Path: path}, false
+	}
+	return pageInfo(path, meta, m.titles[path]), true
+}
+
+// list returns the pages the filter accepts, sorted by path
+func (m *metaIndex) list(filter pageFilter) []api.PageInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	pages := make([]api.PageInfo, 0)
+	for path, meta := range m.pages {
+		if filter.match(meta) {
+			pages = append(pages, pageInfo(path, meta, m.titles[path]))
+		}
+	}
+	slices.SortFunc(pages, func(a, b api.PageInfo) int {
+		if a.Path < b.Path {
+			return -1
+		}
+		if a.Path > b.Path {
+			return 1
+		}
+		return 0
+	})
+
+	return pages
+}
+
+// keep returns whether the filter accepts a page, for search.Query
+func (m *metaIndex) keep(filter pageFilter) func(path string) bool {
+	return func(path string) bool {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		return filter.match(m.pages[path])
+	}
+}
+
+// Dated returns whether a page is dated on or after from, for the search
+// tool
+func (ctx *ctx) Dated(from time.Time) func(path string) bool {
+	return ctx.meta.keep(pageFilter{from: from})
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func pageInfo(path string, meta frontmatter.Meta, title string) api.PageInfo {
+	return api.PageInfo{
+		Path:    path,
+		Title:   title,
+		Tags:    meta.Tags,
+		Aliases: meta.Aliases,
+		Created: unixOrZero(meta.Created),
+		Updated: unixOrZero(meta.Updated),
+		Fields:  meta.Fields,
+	}
+}
+
+// pageFilter selects pages by metadata; zero fields match everything
+type pageFilter struct {
+	// tags are normalized; pages must have all of them
+	tags []string
+	// from and to bound the date of the page, updated or else created; to is
+	// exclusive
+	from time.Time
+	to   time.Time
+}
+
+func (f pageFilter) match(meta frontmatter.Meta) bool {
+	for _, tag := range f.tags {
+		if !meta.HasTag(tag) {
+			return false
+		}
+	}
+
+	if f.from.IsZero() && f.to.IsZero() {
+		return true
+	}
+
+	date := meta.Date()
+	if date.IsZero() {
+		return false
+	}
+	return (f.from.IsZero() || !date.Before(f.from)) && (f.to.IsZero() || date.Before(f.to))
+}
+
+// parseDate accepts a day, e.g. 2025-04-24, or an RFC 3339 time; a day as an
+// upper bound includes the whole day
+func parseDate(s string, upper bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q; expected YYYY-MM-DD or RFC 3339", s)
+	}
+	if upper {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// parsePageFilter reads the tag, which may be repeated, from and to query
+// parameters
+func parsePageFilter(query url.Values) (pageFilter, error) {
+	var filter pageFilter
+	for _, tag := range query["tag"] {
+		if tag = frontmatter.NormalizeTag(tag); tag != "" {
+			filter.tags = append(filter.tags, tag)
+		}
+	}
+
+	var err error
+	if from := query.Get("from"); from != "" {
+		if filter.from, err = parseDate(from, false); err != nil {
+			return filter, err
+		}
+	}
+	if to := query.Get("to"); to != "" {
+		if filter.to, err = parseDate(to, true); err != nil {
+			return filter, err
+		}
+	}
+
+	return filter, nil
+}
+
+// pageChanged updates the links and metadata of a page from its content
+func (ctx *ctx) pageChanged(path string, content []byte) {
+	meta, body, err := frontmatter.Parse(content)
+	if err != nil {
+		log.Printf("page %s: %v", path, err)
+	}
+
+	ctx.links.set(path, body)
+	ctx.meta.set(path, meta, frontmatter.Title(meta, body))
+	ctx.bai.DB().SetTags(path, meta.Tags)
+}
+
+// pageRemoved drops the links and metadata of a deleted page
+func (ctx *ctx) pageRemoved(path string) {
+	ctx.links.remove(path)
+	ctx.meta.remove(path)
+}
+
+// loadPages reads the links and metadata of every page in the wiki
+func loadPages(ctx *ctx) error {
+	util.Assert(ctx != nil, "loadPages nil ctx")
+	start := time.Now()
+
+	wikiPath0, err := wikiPath(ctx.config)
+	if err != nil {
+		return err
+	}
+
+	pages, err := scanPages(wikiPath0)
+	if err != nil {
+		return err
+	}
+
+	links := 0
+	for path := range pages {
+		content, err := os.ReadFile(filepath.Join(wikiPath0, path+".md"))
+		if err != nil {
+			log.Printf("failed to read %s: %v", path, err)
+			continue
+		}
+		ctx.pageChanged(path, content)
+		links += len(ctx.links.outbound(path))
+	}
+
+	log.Printf("loaded %d pages with %d links in %.2f seconds", len(pages), links, time.Since(start).Seconds())
+
+	return nil
+}
+
+// pagesHandler lists the pages, filtered by the tag, from and to parameters
+func pagesHandler(ctx *ctx, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parsePageFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ctx.meta.list(filter))
+}
+
+const defaultSearchResults = 10
+
+// searchHandler returns the pages closest to the q parameter, among those
+// matching the tag, from, to and prefix parameters and at least as similar as
+// min_similarity, diversified by MMR if mmr_lambda is set, even to 0; offset
+// and limit page through the results
+func searchHandler(ctx *ctx, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("q") == "" {
+		http.Error(w, "Empty query", http.StatusBadRequest)
+		return
+	}
+
+	filter, err := parsePageFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q := search.Query{
+		Prefix: query.Get("prefix"),
+		Tags:   filter.tags,
+		Limit:  defaultSearchResults,
+	}
+	if s := query.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("offset"); s != "" {
+		if q.Offset, err = strconv.Atoi(s); err != nil || q.Offset < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("min_similarity"); s != "" {
+		if q.MinSimilarity, err = strconv.ParseFloat(s, 64); err != nil {
+			http.Error(w, "Invalid min_similarity", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("mmr_lambda"); s != "" {
+		if q.MMRLambda, err = strconv.ParseFloat(s, 64); err != nil || q.MMRLambda < 0 || q.MMRLambda > 1 {
+			http.Error(w, "Invalid mmr_lambda", http.StatusBadRequest)
+			return
+		}
+		q.MMR = true
+	}
+
+	// tags are filtered by the DB; dates are those of the front matter
+	if !filter.from.IsZero() || !filter.to.IsZero() {
+		q.Keep = ctx.meta.keep(pageFilter{from: filter.from, to: filter.to})
+	}
+
+	results, err := ctx.bai.Search(r.Context(), query.Get("q"), q)
+	if err != nil {
+		log.Printf("search error: %v", err)
+		apiError(w, err, "Search error")
+		return
+	}
+
+	response := make([]api.SearchResult, len(results))
+	for i, result := range results {
+		info, _ := ctx.meta.info(result.Path)
+		response[i] = api.SearchResult{PageInfo: info, Distance: result.Distance}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
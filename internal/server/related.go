@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/groupcache/lru"
+	"github.com/vasilisp/wikai/internal/util"
+	"github.com/vasilisp/wikai/pkg/api"
+	"github.com/vasilisp/wikai/pkg/search"
+)
+
+const (
+	// number of related notes shown under a page
+	defaultRelated = 5
+	// most related notes the API returns
+	maxRelated = 50
+	// pages whose related notes are cached
+	relatedCacheSize = 1024
+)
+
+// relatedCache keeps the related notes of recently viewed pages, computed at
+// a given version of the search DB; any change to the embeddings invalidates
+// all of them, since every page may have a new neighbour
+type relatedCache struct {
+	mu      sync.Mutex
+	version uint64
+	cache   *lru.Cache
+}
+
+func newRelatedCache() *relatedCache {
+	return &relatedCache{cache: lru.New(relatedCacheSize)}
+}
+
+type relatedKey struct {
+	path  string
+	limit int
+}
+
+// related returns the pages closest to a page, excluding itself; none if the
+// page has no embedding
+func (c *relatedCache) related(db search.DB, path string, limit int) ([]search.Result, error) {
+	version := db.Version()
+	key := relatedKey{path: path, limit: limit}
+
+	c.mu.Lock()
+	if c.version != version {
+		c.cache.Clear()
+		c.version = version
+	}
+	cached, ok := c.cache.Get(key)
+	c.mu.Unlock()
+
+	if ok {
+		return cached.([]search.Result), nil
+	}
+
+	vector, ok := db.Vector(path)
+	if !ok {
+		return nil, nil
+	}
+
+	results, err := db.Query(search.Query{
+		Vector: vector,
+		Deny:   []string{path},
+		Limit:  limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	// a result computed from an older version must not replace a newer one
+	if c.version == version {
+		c.cache.Add(key, results)
+	}
+	c.mu.Unlock()
+
+	return results, nil
+}
+
+// relatedHandler returns the related notes of a page, at most the limit
+// parameter
+func relatedHandler(ctx *ctx, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, api.RelatedPath), ".md")
+	if err := util.ValidatePagePath(path); err != nil {
+		http.Error(w, "Invalid page path", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultRelated
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 || limit > maxRelated {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, ok := ctx.bai.DB().DocStamp(path); !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	results, err := ctx.related.related(ctx.bai.DB(), path, limit)
+	if err != nil {
+		http.Error(w, "Failed to find related notes", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]api.SearchResult, len(results))
+	for i, result := range results {
+		info, _ := ctx.meta.info(result.Path)
+		response[i] = api.SearchResult{PageInfo: info, Distance: result.Distance}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
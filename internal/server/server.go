@@ -2,21 +2,30 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	htmlpkg "html"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"syscall"
 	"text/template"
 	"time"
 
 	"github.com/microcosm-cc/bluemonday"
 	"github.com/vasilisp/wikai/internal/data"
+	"github.com/vasilisp/wikai/internal/frontmatter"
 	"github.com/vasilisp/wikai/internal/git"
 	"github.com/vasilisp/wikai/internal/util"
+	"github.com/vasilisp/wikai/internal/wikilink"
 	"github.com/vasilisp/wikai/pkg/api"
 	"github.com/vasilisp/wikai/pkg/backai"
 	"github.com/vasilisp/wikai/pkg/embedding"
@@ -27,23 +36,81 @@ type ctx struct {
 	config *config
 	git    git.Repo
 	bai    backai.Ctx
+	jobs   *jobQueue
+	// writeMu serialises page writes with their git commit and note, so that
+	// concurrent requests cannot interleave and attach notes to each other's
+	// commits
+	writeMu sync.Mutex
+	// pageBlobs maps pages to the blob their embedding was computed from, or
+	// that was last seen for generated pages; guarded by writeMu
+	pageBlobs map[string]string
+	links     *linkGraph
+	meta      *metaIndex
+	related   *relatedCache
+	// vocabulary is the controlled vocabulary of tags
+	vocabulary *vocabulary
 }
 
+// loadEmbeddings loads the embedding of every page in HEAD from the note on
+// its blob. Pages without one fall back to the legacy notes on commits, which
+// may describe an older version of the page.
 func loadEmbeddings(ctx *ctx) error {
 	util.Assert(ctx != nil, "loadEmbeddings nil ctx")
 	start := time.Now()
 
-	err := ctx.git.GetNoteContents(func(embJSON string) {
+	blobEmbeddings, err := loadBlobEmbeddings(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get notes: %w", err)
+	}
+
+	missing := make(map[string]bool)
+	err = ctx.git.ListFiles(func(file string, blob string) {
+		path, ok := strings.CutSuffix(file, ".md")
+		if !ok || util.ValidatePagePath(path) != nil {
+			return
+		}
+
+		if ctx.isGeneratedPage(path) {
+			ctx.pageBlobs[path] = blob
+			return
+		}
+
+		emb, ok := blobEmbeddings[blob]
+		if !ok {
+			missing[path] = true
+			return
+		}
+		ctx.bai.DB().Add(path, emb.Vector, emb.Stamp)
+		ctx.pageBlobs[path] = blob
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list pages: %w", err)
+	}
+
+	legacy := 0
+	err = ctx.git.GetNoteContents(func(embJSON string) {
 		var emb embedding.Embedding
 		if err := json.Unmarshal([]byte(embJSON), &emb); err != nil {
 			log.Printf("failed to unmarshal embedding: %v", err)
+			return
+		}
+		if !missing[emb.ID] {
+			return
 		}
 		ctx.bai.DB().Add(emb.ID, emb.Vector, emb.Stamp)
+		legacy++
 	})
 	if err != nil {
 		return fmt.Errorf("failed to get note contents: %w", err)
 	}
 
+	if legacy > 0 {
+		log.Printf("loaded %d embeddings from legacy commit notes; re-index to attach them to the current page versions", legacy)
+	}
+	if len(missing) > 0 {
+		log.Printf("%d pages have no embedding for their current version", len(missing))
+	}
+
 	log.Printf("loaded %d embeddings in %.2f seconds", ctx.bai.DB().NumRows(), time.Since(start).Seconds())
 
 	return nil
@@ -53,103 +120,250 @@ func newCtx() *ctx {
 	config := loadConfig()
 	util.Assert(config != nil, "newCtx nil config")
 
-	git, err := git.NewRepo(config.WikiPath, "")
-	util.Assert(err == nil, "newCtx failed to create git repo")
+	git, err := git.NewRepo(config.WikiPath, "", config.gitOptions())
+	if err != nil {
+		log.Fatalf("Failed to open wiki repo: %v", err)
+	}
 
 	ctx := ctx{
-		config: config,
-		git:    git,
+		config:     config,
+		git:        git,
+		pageBlobs:  make(map[string]string),
+		links:      newLinkGraph(),
+		meta:       newMetaIndex(),
+		related:    newRelatedCache(),
+		vocabulary: &vocabulary{},
 	}
 
-	ctx.bai = backai.NewCtx(&ctx, ctx.config.WikiPrefix, ctx.config.OpenAIToken, ctx.config.EmbeddingDimensions)
+	ctx.bai = backai.NewCtx(&ctx, backai.Options{
+		WikiPrefix:          ctx.config.WikiPrefix,
+		APIKey:              ctx.config.OpenAIToken,
+		EmbeddingDimensions: ctx.config.EmbeddingDimensions,
+		SearchTokenBudgets:  ctx.config.SearchTokenBudgets,
+		UsagePath:           ctx.config.UsagePath,
+		DailySpendingCap:    ctx.config.DailySpendingCap,
+		EmbeddingCachePath:  ctx.config.EmbeddingCachePath,
+		EmbeddingCacheSize:  ctx.config.EmbeddingCacheSize,
+		Retry:               ctx.config.retryPolicy(),
+		RequestsPerMinute:   ctx.config.RequestsPerMinute,
+		QueryTimeout:        time.Duration(ctx.config.QueryTimeoutSeconds) * time.Second,
+		VectorEncoding:      ctx.config.VectorEncoding,
+		SearchMMRLambda:     ctx.config.SearchMMRLambda,
+		DuplicateSimilarity: ctx.config.DuplicateSimilarity,
+	})
 
 	return &ctx
 }
 
-func index(ctx *ctx, path, content string, vector []float64) error {
-	util.Assert(ctx != nil, "index nil ctx")
-	util.Assert(path != "", "index empty path")
-	util.Assert(content != "", "index empty content")
-	util.Assert(vector != nil, "index nil vector")
-	util.Assert(len(vector) > 0, "index empty vector")
+func wikiHandler(ctx *ctx, w http.ResponseWriter, r *http.Request) {
+	// Get the page path from the URL, removing prefix; a trailing slash asks
+	// for the index of a directory
+	pagePath := strings.TrimPrefix(r.URL.Path, ctx.config.WikiPrefix+"/")
 
-	err := ctx.git.Add(path + ".md")
+	wikiPath0, err := wikiPath(ctx.config)
 	if err != nil {
-		return fmt.Errorf("Failed to add page to git: %v", err)
+		log.Printf("Failed to get Wiki path: %v", err)
+		http.Error(w, "Failed to get Wiki path", http.StatusInternalServerError)
+		return
 	}
 
-	emb := embedding.Embedding{
-		ID:     path,
-		Vector: vector,
-		Stamp:  time.Now(),
+	if dir, ok := strings.CutSuffix(pagePath, "/"); ok || pagePath == "" {
+		dirHandler(ctx, w, r, wikiPath0, dir)
+		return
+	}
+
+	if err := util.ValidatePagePath(pagePath); err != nil {
+		http.NotFound(w, r)
+		return
 	}
-	embJSON, err := json.Marshal(emb)
+	fullPath := filepath.Join(wikiPath0, pagePath+".md")
+
+	// Read the markdown file
+	content, err := os.ReadFile(fullPath)
 	if err != nil {
-		return fmt.Errorf("Failed to marshal embedding: %v", err)
+		if !os.IsNotExist(err) {
+			http.Error(w, "Failed to read page", http.StatusInternalServerError)
+			return
+		}
+		if fi, err := os.Stat(filepath.Join(wikiPath0, pagePath)); err == nil && fi.IsDir() {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusFound)
+			return
+		}
+		if target, ok := ctx.meta.resolveAlias(pagePath); ok {
+			http.Redirect(w, r, ctx.config.WikiPrefix+"/"+target, http.StatusFound)
+			return
+		}
+		http.NotFound(w, r)
+		return
 	}
 
-	err = ctx.git.Commit(fmt.Sprintf("Add %s", path), true)
+	// the front matter is not shown, except for the tags
+	meta, body, err := frontmatter.Parse(content)
 	if err != nil {
-		return fmt.Errorf("Failed to commit page to git: %v", err)
+		log.Printf("page %s: %v", pagePath, err)
 	}
 
-	err = ctx.git.AddNote(string(embJSON))
+	docStampStr := "unknown"
+	docStamp, ok := ctx.bai.DB().DocStamp(pagePath)
+	if !meta.Date().IsZero() {
+		docStamp, ok = meta.Date(), true
+	}
+	if ok {
+		docStampStr = docStamp.Format("2006-01-02 15:04:05")
+	}
+
+	var related []string
+	results, err := ctx.related.related(ctx.bai.DB(), pagePath, defaultRelated)
 	if err != nil {
-		return fmt.Errorf("Failed to add vector to git: %v", err)
+		log.Printf("failed to find notes related to %s: %v", pagePath, err)
+	}
+	for _, result := range results {
+		related = append(related, result.Path)
 	}
 
-	return nil
+	renderPage(ctx, w, body, page{
+		Title:     frontmatter.Title(meta, body),
+		Tags:      meta.Tags,
+		Stamp:     docStampStr,
+		Backlinks: ctx.links.inbound(pagePath),
+		Related:   related,
+	})
 }
 
-func wikiHandler(ctx *ctx, w http.ResponseWriter, r *http.Request) {
-	// Get the page path from the URL, removing prefix
-	prefixLen := len(ctx.config.WikiPrefix)
-	util.Assert(len(r.URL.Path) >= prefixLen+2, "wikiHandler empty page path")
-	pagePath := r.URL.Path[prefixLen+1:]
-
-	wikiPath0, err := wikiPath(ctx.config)
-	if err != nil {
-		log.Printf("Failed to get Wiki path: %v", err)
-		http.Error(w, "Failed to get Wiki path", http.StatusInternalServerError)
+// dirHandler serves the index of a directory of the wiki, listing its pages
+// and the subdirectories that have pages
+func dirHandler(ctx *ctx, w http.ResponseWriter, r *http.Request, wikiPath0 string, dir string) {
+	if dir != "" && (util.ValidatePagePath(dir) != nil || !hasPages(filepath.Join(wikiPath0, dir))) {
+		http.NotFound(w, r)
 		return
 	}
-	fullPath := filepath.Join(wikiPath0, pagePath+".md")
 
-	// Read the markdown file
-	content, err := os.ReadFile(fullPath)
+	entries, err := os.ReadDir(filepath.Join(wikiPath0, dir))
 	if err != nil {
 		if os.IsNotExist(err) {
 			http.NotFound(w, r)
 			return
 		}
-		http.Error(w, "Failed to read page", http.StatusInternalServerError)
+		http.Error(w, "Failed to read directory", http.StatusInternalServerError)
 		return
 	}
 
+	prefix := ctx.config.WikiPrefix + "/"
+	title := "Pages"
+	if dir != "" {
+		prefix += dir + "/"
+		title = dir
+	}
+
+	var content bytes.Buffer
+	fmt.Fprintf(&content, "# %s\n\n", title)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			if util.ValidatePageSegment(name) == nil && hasPages(filepath.Join(wikiPath0, dir, name)) {
+				fmt.Fprintf(&content, "- [%s/](%s%s/)\n", name, prefix, name)
+			}
+			continue
+		}
+		if page, ok := strings.CutSuffix(name, ".md"); ok && entry.Type().IsRegular() && util.ValidatePageSegment(page) == nil {
+			fmt.Fprintf(&content, "- [%s](%s%s)\n", page, prefix, page)
+		}
+	}
+
+	renderPage(ctx, w, content.Bytes(), page{Title: title})
+}
+
+// hasPages tells whether there is a page anywhere under a directory
+func hasPages(dir string) bool {
+	found := false
+	filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		switch {
+		case err != nil || found:
+			return filepath.SkipAll
+		case entry.IsDir() && path != dir && util.ValidatePageSegment(entry.Name()) != nil:
+			return filepath.SkipDir
+		}
+		page, ok := strings.CutSuffix(entry.Name(), ".md")
+		found = ok && entry.Type().IsRegular() && util.ValidatePageSegment(page) == nil
+		return nil
+	})
+	return found
+}
+
+// pagePolicy sanitizes rendered pages, keeping the classes of [[links]]
+var pagePolicy = func() *bluemonday.Policy {
+	policy := bluemonday.UGCPolicy()
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^` + wikilink.Class + `( ` + wikilink.ClassMissing + `)?$`)).OnElements("a")
+	return policy
+}()
+
+// pageLink is a link to another page in the wiki template, labelled with its
+// title if it has one
+type pageLink struct {
+	Label string
+	URL   string
+}
+
+func newPageLink(ctx *ctx, path string) pageLink {
+	label := path
+	if info, ok := ctx.meta.info(path); ok && info.Title != "" {
+		label = info.Title
+	}
+	return pageLink{Label: htmlpkg.EscapeString(label), URL: ctx.config.WikiPrefix + "/" + path}
+}
+
+// page is what the wiki template shows around the content; empty fields are
+// not shown
+type page struct {
+	Title     string
+	Tags      []string
+	Stamp     string
+	Backlinks []string
+	Related   []string
+}
+
+// renderPage converts markdown to sanitized HTML in the wiki template
+func renderPage(ctx *ctx, w http.ResponseWriter, content []byte, page page) {
 	// Convert markdown to HTML and sanitize output
-	md := goldmark.New()
+	md := goldmark.New(goldmark.WithExtensions(wikilink.New(ctx.config.WikiPrefix, func(path string) bool {
+		if _, ok := ctx.meta.resolveAlias(path); ok {
+			return true
+		}
+		return pageExists(ctx, path)
+	})))
 	var buf bytes.Buffer
 	if err := md.Convert(content, &buf); err != nil {
 		http.Error(w, "Failed to convert markdown", http.StatusInternalServerError)
 		return
 	}
-	html := bluemonday.UGCPolicy().SanitizeBytes(buf.Bytes())
+	html := pagePolicy.SanitizeBytes(buf.Bytes())
+
+	linkTo := func(path string) pageLink {
+		return newPageLink(ctx, path)
+	}
 
 	// Write response
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 
 	// Render template with content
 	tmpl := template.Must(template.New("wiki").Parse(string(data.WikiTemplate)))
-	docStampStr := "unknown"
-	docStamp, ok := ctx.bai.DB().DocStamp(pagePath)
-	if ok {
-		docStampStr = docStamp.Format("2006-01-02 15:04:05")
-	}
 
+	// text/template does not escape, and titles and tags come from the page
 	if err := tmpl.Execute(w, struct {
-		Content string
-		Stamp   string
-	}{string(html), docStampStr}); err != nil {
+		Content   string
+		Title     string
+		Tags      []string
+		Stamp     string
+		Backlinks []pageLink
+		Related   []pageLink
+	}{
+		string(html),
+		htmlpkg.EscapeString(page.Title),
+		util.MapSlice(page.Tags, htmlpkg.EscapeString),
+		page.Stamp,
+		util.MapSlice(page.Backlinks, linkTo),
+		util.MapSlice(page.Related, linkTo),
+	}); err != nil {
 		http.Error(w, "Failed to render template", http.StatusInternalServerError)
 		return
 	}
@@ -163,21 +377,132 @@ func (ctx *ctx) Read(path string) (string, error) {
 	return string(content), nil
 }
 
-func (ctx *ctx) Write(path string, content string, embedding []float64) error {
+// Write writes a page, commits it and attaches its embedding as one
+// transaction, then adds the embedding to the search DB. The page is embedded
+// as written, with its dates: once, unless tagging a new page adds tags to it,
+// which costs a second embedding.
+func (ctx *ctx) Write(path string, content string) error {
 	util.Assert(ctx != nil, "writePage nil ctx")
 	util.Assert(path != "", "writePage empty path")
 	util.Assert(content != "", "writePage empty content")
 
-	fullPath := filepath.Join(ctx.config.WikiPath, path+".md")
+	stamp := time.Now()
 
-	// FIXME transactional write+insert
-	if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
-		return fmt.Errorf("Failed to write page: %v", err)
-	} else {
-		log.Printf("wrote page %s at %s", path, fullPath)
+	for {
+		// the dates come from the page as it is, read under the lock; the
+		// page is embedded without holding it, so the write starts over if a
+		// concurrent one changed the page meanwhile
+		ctx.writeMu.Lock()
+		previous, _ := ctx.Read(path)
+		ctx.writeMu.Unlock()
+
+		page, vector, err := preparePage(ctx, path, content, previous, stamp)
+		if err != nil {
+			return err
+		}
+
+		written, err := ctx.commitPage(path, page, vector, stamp, previous)
+		if written || err != nil {
+			return err
+		}
+		log.Printf("%s changed while being written, writing it again", path)
+	}
+}
+
+// preparePage stamps a page, embeds it and tags it if new, returning it as it
+// is to be written, with its embedding
+func preparePage(ctx *ctx, path string, content string, previous string, stamp time.Time) (string, []float64, error) {
+	content, err := stampPage(content, previous, stamp)
+	if err != nil {
+		return "", nil, err
+	}
+
+	vector, err := ctx.bai.Embed(context.Background(), content)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to embed page: %w", err)
+	}
+
+	if tagged := autoTag(ctx, path, content, vector); tagged != content {
+		content = tagged
+		if vector, err = ctx.bai.Embed(context.Background(), content); err != nil {
+			return "", nil, fmt.Errorf("Failed to embed page: %w", err)
+		}
+	}
+
+	return content, vector, nil
+}
+
+// commitPage writes a page, unless it is no longer previous, telling whether
+// it did
+func (ctx *ctx) commitPage(path string, content string, vector []float64, stamp time.Time, previous string) (bool, error) {
+	embJSON, err := json.Marshal(embedding.Embedding{
+		ID:       path,
+		Vector:   vector,
+		Stamp:    stamp,
+		Encoding: ctx.config.VectorEncoding,
+	})
+	if err != nil {
+		return false, fmt.Errorf("Failed to marshal embedding: %v", err)
+	}
+
+	ctx.writeMu.Lock()
+	defer ctx.writeMu.Unlock()
+
+	if current, _ := ctx.Read(path); current != previous {
+		return false, nil
+	}
+
+	t, err := beginTxn(ctx)
+	if err != nil {
+		return false, fmt.Errorf("Failed to begin transaction: %w", err)
+	}
+
+	file := path + ".md"
+	if err := t.writeFile(file, []byte(content)); err != nil {
+		return false, t.abort(fmt.Errorf("Failed to write page: %w", err))
+	}
+	log.Printf("wrote page %s", path)
+
+	blob, err := t.stage(file)
+	if err != nil {
+		return false, t.abort(err)
+	}
+
+	if err := t.commit(fmt.Sprintf("Add %s", path), map[string]string{blob: string(embJSON)}); err != nil {
+		return false, t.abort(err)
+	}
+
+	t.finish()
+
+	ctx.bai.DB().Add(path, vector, stamp)
+	ctx.pageBlobs[path] = blob
+	ctx.pageChanged(path, []byte(content))
+
+	return true, nil
+}
+
+// stampPage sets the updated date in the front matter of a page being
+// written, and the created date unless the page already has one, keeping that
+// of the previous version of the page if any
+func stampPage(content string, previous string, now time.Time) (string, error) {
+	meta, body, err := frontmatter.Parse([]byte(content))
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse front matter: %w", err)
+	}
+
+	if meta.Created.IsZero() {
+		meta.Created = now.Truncate(time.Second)
+		if previousMeta, _, err := frontmatter.Parse([]byte(previous)); err == nil && !previousMeta.Created.IsZero() {
+			meta.Created = previousMeta.Created
+		}
 	}
+	meta.Updated = now.Truncate(time.Second)
 
-	return index(ctx, path, content, embedding)
+	stamped, err := frontmatter.Format(meta, body)
+	if err != nil {
+		return "", err
+	}
+	return string(stamped), nil
 }
 
 func aiHandler(ctx *ctx, w http.ResponseWriter, r *http.Request) {
@@ -206,10 +531,15 @@ func aiHandler(ctx *ctx, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	aiResponse, err := ctx.bai.Query(userQuery, postRequest.ChatID)
+	aiResponse, err := ctx.bai.Query(r.Context(), userQuery, postRequest.ChatID)
+	if errors.Is(err, backai.ErrSpendingCapReached) {
+		log.Printf("refusing query: %v", err)
+		http.Error(w, "Daily spending cap reached", http.StatusTooManyRequests)
+		return
+	}
 	if err != nil {
 		log.Printf("LLM error: %v", err)
-		http.Error(w, "LLM error", http.StatusInternalServerError)
+		apiError(w, err, "LLM error")
 		return
 	}
 
@@ -218,36 +548,198 @@ func aiHandler(ctx *ctx, w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(aiResponse)
 }
 
-func validateAndIndex(ctx *ctx, path string) error {
-	util.Assert(ctx != nil, "validateAndIndex nil ctx")
+// apiError reports an error from backai, distinguishing temporary API
+// conditions from internal errors
+func apiError(w http.ResponseWriter, err error, msg string) {
+	var apiErr *backai.APIError
+	if !errors.As(err, &apiErr) {
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+
+	if apiErr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(apiErr.RetryAfter.Seconds()+0.5)))
+	}
+
+	switch {
+	case errors.Is(err, backai.ErrRateLimited):
+		http.Error(w, msg+": rate limited", http.StatusTooManyRequests)
+	case errors.Is(err, backai.ErrTimeout):
+		http.Error(w, msg+": timed out", http.StatusGatewayTimeout)
+	default:
+		http.Error(w, msg+": service unavailable", http.StatusServiceUnavailable)
+	}
+}
+
+// readPage validates a page path given on the command line or over the API
+// and reads the page, returning the normalized path and the content
+func readPage(ctx *ctx, path string) (string, string, error) {
+	util.Assert(ctx != nil, "readPage nil ctx")
 
 	path = strings.TrimSuffix(path, ".md")
 
 	if err := util.ValidatePagePath(path); err != nil {
-		return fmt.Errorf("invalid page path: %w", err)
+		return path, "", fmt.Errorf("invalid page path: %w", err)
 	}
 
 	wikiPath0, err := wikiPath(ctx.config)
 	if err != nil {
-		return fmt.Errorf("failed to get wiki path: %w", err)
+		return path, "", fmt.Errorf("failed to get wiki path: %w", err)
 	}
 	fullPath := filepath.Join(wikiPath0, path+".md")
 
 	content, err := os.ReadFile(fullPath)
 	if err != nil {
-		return fmt.Errorf("failed to read page %s: %w", path, err)
+		return path, "", fmt.Errorf("failed to read page %s: %w", path, err)
+	}
+	if len(content) == 0 {
+		return path, "", fmt.Errorf("page %s is empty", path)
+	}
+
+	return path, string(content), nil
+}
+
+// indexBatch embeds the given pages with as few API requests as possible,
+// commits all of them at once and attaches all embeddings in a single note.
+// Generated pages are only tracked, not embedded. The reason, if any, is
+// appended to the commit message. Failures are reported per page, and pages
+// whose embedding was cancelled are marked as such.
+func indexBatch(ctx *ctx, rctx context.Context, paths []string, reason string) []api.IndexResult {
+	util.Assert(ctx != nil, "indexBatch nil ctx")
+
+	results := make([]api.IndexResult, len(paths))
+
+	var pending []int
+	var contents []string
+	var generated []int
+	var generatedContents []string
+	for i, path := range paths {
+		path, content, err := readPage(ctx, path)
+		results[i].Path = path
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		if meta, _, _ := frontmatter.Parse([]byte(content)); isGenerated(meta) {
+			generated = append(generated, i)
+			generatedContents = append(generatedContents, content)
+			continue
+		}
+		pending = append(pending, i)
+		contents = append(contents, content)
+	}
+
+	if len(generated) > 0 {
+		ctx.writeMu.Lock()
+		for k, i := range generated {
+			if err := trackGenerated(ctx, results[i].Path, []byte(generatedContents[k])); err != nil {
+				results[i].Error = err.Error()
+			}
+		}
+		ctx.writeMu.Unlock()
+	}
+
+	if len(pending) == 0 {
+		return results
 	}
 
-	embedding, err := ctx.bai.Embed(string(content))
+	embeddings := ctx.bai.EmbedBatch(rctx, contents)
+
+	// embedding happens outside the lock; staging, commit and note are one
+	// transaction
+	ctx.writeMu.Lock()
+	defer ctx.writeMu.Unlock()
+
+	t, err := beginTxn(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to embed page %s: %w", path, err)
+		err = fmt.Errorf("failed to begin transaction: %w", err)
+		for _, i := range pending {
+			results[i].Error = err.Error()
+		}
+		return results
+	}
+
+	var indexed []int
+	var embJSONs []string
+	stamp := time.Now()
+	for j, i := range pending {
+		if err := embeddings[j].Err; err != nil {
+			results[i].Error = err.Error()
+			if errors.Is(err, context.Canceled) {
+				results[i].State = api.PageCancelled
+			}
+			continue
+		}
+
+		path := results[i].Path
+		embJSON, err := json.Marshal(embedding.Embedding{
+			ID:       path,
+			Vector:   embeddings[j].Vector,
+			Stamp:    stamp,
+			Encoding: ctx.config.VectorEncoding,
+		})
+		if err != nil {
+			results[i].Error = fmt.Sprintf("failed to marshal embedding: %v", err)
+			continue
+		}
+
+		indexed = append(indexed, j)
+		embJSONs = append(embJSONs, string(embJSON))
 	}
 
-	err = index(ctx, path, string(content), embedding)
+	fail := func(err error) []api.IndexResult {
+		err = t.abort(err)
+		for _, j := range indexed {
+			results[pending[j]].Error = err.Error()
+		}
+		return results
+	}
+
+	if len(indexed) == 0 {
+		t.finish()
+		return results
+	}
+
+	notes := make(map[string]string, len(indexed))
+	blobs := make([]string, len(indexed))
+	for k, j := range indexed {
+		blob, err := t.stage(results[pending[j]].Path + ".md")
+		if err != nil {
+			return fail(err)
+		}
+		notes[blob] = embJSONs[k]
+		blobs[k] = blob
+	}
+
+	if err := t.commit(fmt.Sprintf("Index %d pages%s", len(indexed), reason), notes); err != nil {
+		return fail(err)
+	}
+
+	t.finish()
+
+	for k, j := range indexed {
+		path := results[pending[j]].Path
+		ctx.bai.DB().Add(path, embeddings[j].Vector, stamp)
+		ctx.pageBlobs[path] = blobs[k]
+		ctx.pageChanged(path, []byte(contents[j]))
+	}
+
+	return results
+}
+
+// trackGenerated takes in a generated page without embedding it, dropping
+// any embedding from before it was generated; must be called with writeMu
+// held
+func trackGenerated(ctx *ctx, path string, content []byte) error {
+	blob, err := ctx.git.HashFile(path + ".md")
 	if err != nil {
-		return fmt.Errorf("failed to index page %s: %w", path, err)
+		return err
 	}
 
+	ctx.bai.DB().Remove(path)
+	ctx.pageBlobs[path] = blob
+	ctx.pageChanged(path, content)
+
 	return nil
 }
 
@@ -264,14 +756,107 @@ func indexHandler(ctx *ctx, w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	paths := strings.Split(string(body), "\n")
-	for _, path := range paths {
-		if err := validateAndIndex(ctx, path); err != nil {
-			log.Printf("failed to index page %s: %v", path, err)
-			http.Error(w, "Failed to index page", http.StatusInternalServerError)
+	paths := make([]string, 0)
+	for _, path := range strings.Split(string(body), "\n") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+
+	if len(paths) == 0 {
+		http.Error(w, "No pages to index", http.StatusBadRequest)
+		return
+	}
+
+	job, err := ctx.jobs.submit(paths, "")
+	if err != nil {
+		log.Printf("failed to submit indexing job: %v", err)
+		http.Error(w, "Failed to submit indexing job", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+
+	json.NewEncoder(w).Encode(job)
+}
+
+// reloadHandler takes the pages changed by git commands, e.g. from hooks, and
+// brings the search DB up to date with them in the background, so that hooks
+// of commits made by wikai while holding writeMu do not deadlock
+func reloadHandler(ctx *ctx, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	paths := make([]string, 0)
+	for _, path := range strings.Split(string(body), "\n") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		if err := util.ValidatePagePath(path); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid page path %q", path), http.StatusBadRequest)
 			return
 		}
+		paths = append(paths, path)
+	}
+
+	go func() {
+		if _, err := syncPages(ctx, paths, "reload"); err != nil {
+			log.Printf("reload: %v", err)
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func jobsHandler(ctx *ctx, w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, api.JobsPath)
+	if id == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var job api.IndexJob
+	var ok bool
+
+	switch r.Method {
+	case http.MethodGet:
+		job, ok = ctx.jobs.status(id)
+	case http.MethodDelete:
+		job, ok = ctx.jobs.cancelJob(id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(job)
+}
+
+func statsHandler(ctx *ctx, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(ctx.bai.Usage())
 }
 
 func handlerWith[T interface{}](t T, fn func(T, http.ResponseWriter, *http.Request)) http.HandlerFunc {
@@ -298,6 +883,17 @@ func installHandlers(ctx *ctx) {
 
 	http.HandleFunc(api.PostPath, handlerWith(ctx, aiHandler))
 	http.HandleFunc(api.IndexPath, handlerWith(ctx, indexHandler))
+	http.HandleFunc(api.StatsPath, handlerWith(ctx, statsHandler))
+	http.HandleFunc(api.JobsPath, handlerWith(ctx, jobsHandler))
+	http.HandleFunc(api.ReloadPath, handlerWith(ctx, reloadHandler))
+	http.HandleFunc(api.LinksPath, handlerWith(ctx, linksHandler))
+	http.HandleFunc(api.PagesPath, handlerWith(ctx, pagesHandler))
+	http.HandleFunc(api.SearchPath, handlerWith(ctx, searchHandler))
+	http.HandleFunc(api.RelatedPath, handlerWith(ctx, relatedHandler))
+	http.HandleFunc(api.DuplicatesPath, handlerWith(ctx, duplicatesHandler))
+	http.HandleFunc(api.TopicsPath, handlerWith(ctx, topicsHandler))
+	http.HandleFunc(api.AutotagPath, handlerWith(ctx, autotagHandler))
+	http.HandleFunc(api.GrepPath, handlerWith(ctx, grepHandler))
 	http.HandleFunc(ctx.config.WikiPrefix+"/", handlerWith(ctx, wikiHandler))
 
 	// Serve style.css
@@ -308,17 +904,75 @@ func installHandlers(ctx *ctx) {
 	})
 }
 
+// shutdownTimeout bounds how long the requests in progress may take to
+// finish on shutdown
+const shutdownTimeout = 10 * time.Second
+
 func Main() {
 	ctx := newCtx()
 
-	err := loadEmbeddings(ctx)
+	if err := recoverTxn(ctx); err != nil {
+		log.Printf("failed to recover interrupted transaction: %v", err)
+		os.Exit(1)
+	}
+
+	warnings, err := ctx.git.Check(ctx.config.GitBranch)
+	for _, warning := range warnings {
+		log.Printf("warning: %s", warning)
+	}
+	if err != nil {
+		log.Printf("wiki repo is not usable:\n%v", err)
+		os.Exit(1)
+	}
+
+	// the front matter tells which pages are generated, and not embedded
+	if err := loadPages(ctx); err != nil {
+		log.Printf("failed to load pages: %v", err)
+	}
+
+	err = loadEmbeddings(ctx)
 	if err != nil {
 		log.Printf("failed to load embeddings: %v", err)
 		os.Exit(1)
 	}
 
+	ctx.jobs = newJobQueue(ctx, ctx.config.IndexWorkers, ctx.config.IndexBatchSize)
+
+	if ctx.config.WatchIntervalSeconds > 0 {
+		debounce := defaultWatchDebounce
+		if ctx.config.WatchDebounceSeconds > 0 {
+			debounce = time.Duration(ctx.config.WatchDebounceSeconds) * time.Second
+		}
+		startWatcher(ctx, time.Duration(ctx.config.WatchIntervalSeconds)*time.Second, debounce)
+	}
+
 	installHandlers(ctx)
 
+	server := &http.Server{Addr: fmt.Sprintf(":%d", ctx.config.Port)}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		log.Printf("shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("failed to shut down: %v", err)
+		}
+	}()
+
 	log.Printf("Server starting on port %d...", ctx.config.Port)
-	http.ListenAndServe(fmt.Sprintf(":%d", ctx.config.Port), nil)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("server failed: %v", err)
+	} else {
+		<-stopped
+	}
+
+	// the usage counters are saved with a delay
+	ctx.bai.Close()
 }
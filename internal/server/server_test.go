@@ -0,0 +1,1238 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vasilisp/wikai/internal/frontmatter"
+	"github.com/vasilisp/wikai/internal/git"
+	"github.com/vasilisp/wikai/internal/grep"
+	"github.com/vasilisp/wikai/pkg/api"
+	"github.com/vasilisp/wikai/pkg/backai"
+	"github.com/vasilisp/wikai/pkg/embedding"
+)
+
+const testDimensions = 8
+
+// testVector is the embedding the stand-in API returns for an input
+func testVector(input string) []float64 {
+	h := fnv.New64a()
+	h.Write([]byte(input))
+	seed := h.Sum64()
+
+	v := make([]float64, testDimensions)
+	for i := range v {
+		seed = seed*6364136223846793005 + 1442695040888963407
+		v[i] = float64(seed>>11)/float64(1<<53) - 0.5
+	}
+	return v
+}
+
+// embeddingsStandIn serves the embeddings endpoint with testVector; if not
+// nil, wait is called before answering and the request is dropped if it
+// returns false
+func embeddingsStandIn(t *testing.T, wait func(r *http.Request) bool) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Input []string `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// after the body is read, so that the request context ends when the
+		// client goes away
+		if wait != nil && !wait(r) {
+			return
+		}
+
+		type datum struct {
+			Object    string    `json:"object"`
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		}
+		data := make([]datum, len(request.Input))
+		for i, input := range request.Input {
+			data[i] = datum{Object: "embedding", Index: i, Embedding: testVector(input)}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"object": "list",
+			"data":   data,
+			"model":  "text-embedding-3-small",
+			"usage":  map[string]int{"prompt_tokens": len(request.Input), "total_tokens": len(request.Input)},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// newTestCtx returns a ctx on a new wiki repo in a temporary directory, with
+// embeddings from a stand-in API
+func newTestCtx(t *testing.T) *ctx {
+	t.Helper()
+
+	return newTestCtxWith(t, embeddingsStandIn(t, nil))
+}
+
+// newTestCtxWith is newTestCtx with embeddings from standIn
+func newTestCtxWith(t *testing.T, standIn *httptest.Server) *ctx {
+	t.Helper()
+
+	dir := t.TempDir()
+	repo, err := git.NewRepo(dir, "", git.Options{Identity: git.Identity{Name: "test", Email: "test@example.com"}})
+	if err != nil {
+		t.Fatalf("NewRepo: %v", err)
+	}
+
+	ctx := &ctx{
+		config: &config{
+			WikiPath:            dir,
+			WikiPrefix:          "/wikai",
+			EmbeddingDimensions: testDimensions,
+			VectorEncoding:      embedding.Float64,
+			DuplicateSimilarity: backai.DefaultDuplicateSimilarity,
+			AutoTagSimilarity:   defaultAutoTagSimilarity,
+		},
+		git:        repo,
+		pageBlobs:  make(map[string]string),
+		links:      newLinkGraph(),
+		meta:       newMetaIndex(),
+		related:    newRelatedCache(),
+		vocabulary: &vocabulary{},
+	}
+
+	ctx.bai = backai.NewCtx(ctx, backai.Options{
+		WikiPrefix:          ctx.config.WikiPrefix,
+		APIKey:              "test",
+		EmbeddingDimensions: testDimensions,
+		EmbeddingBaseURL:    standIn.URL + "/",
+		VectorEncoding:      ctx.config.VectorEncoding,
+	})
+
+	return ctx
+}
+
+// blobNotes returns the embeddings attached to blobs
+func blobNotes(t *testing.T, ctx *ctx) map[string]embedding.Embedding {
+	t.Helper()
+
+	notes := make(map[string]embedding.Embedding)
+	err := ctx.git.GetBlobNotes("", func(blob string, note string) {
+		var emb embedding.Embedding
+		if err := json.Unmarshal([]byte(note), &emb); err != nil {
+			t.Errorf("note on %s: %v", blob, err)
+		}
+		notes[blob] = emb
+	}, nil)
+	if err != nil {
+		t.Fatalf("GetBlobNotes: %v", err)
+	}
+
+	return notes
+}
+
+// TestConcurrentWrites runs page writes concurrently with background indexing
+// and checks that every page ends up committed with its own note; run with
+// -race
+func TestConcurrentWrites(t *testing.T) {
+	const (
+		writers = 6
+		batches = 3
+		pages   = 4
+	)
+
+	ctx := newTestCtx(t)
+
+	// the pages indexed in the background are edited outside wikai
+	indexed := make([][]string, batches)
+	for b := range batches {
+		for p := range pages {
+			path := fmt.Sprintf("batch-%d/page-%d", b, p)
+			file := filepath.Join(ctx.config.WikiPath, path+".md")
+			if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(file, []byte(fmt.Sprintf("# Page %d of batch %d\n", p, b)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			indexed[b] = append(indexed[b], path)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			path := fmt.Sprintf("written-%d", w)
+			content := fmt.Sprintf("# Note %d\n\nWritten concurrently.\n", w)
+			if err := ctx.Write(path, content); err != nil {
+				t.Errorf("Write %s: %v", path, err)
+			}
+		}()
+	}
+	for b := range batches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for _, result := range indexBatch(ctx, context.Background(), indexed[b], "") {
+				if result.Error != "" {
+					t.Errorf("indexing %s: %s", result.Path, result.Error)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if t.Failed() {
+		return
+	}
+
+	paths := make([]string, 0)
+	for w := range writers {
+		paths = append(paths, fmt.Sprintf("written-%d", w))
+	}
+	for b := range batches {
+		paths = append(paths, indexed[b]...)
+	}
+
+	notes := blobNotes(t, ctx)
+	for _, path := range paths {
+		blob, ok := ctx.pageBlobs[path]
+		if !ok {
+			t.Errorf("%s has no blob", path)
+			continue
+		}
+
+		committed, err := ctx.git.HashFile(path + ".md")
+		if err != nil {
+			t.Fatalf("HashFile: %v", err)
+		}
+		if committed != blob {
+			t.Errorf("%s is at blob %s, indexed as %s", path, committed, blob)
+		}
+
+		if note, ok := notes[blob]; !ok || note.ID != path {
+			t.Errorf("blob of %s has note for %q", path, note.ID)
+		}
+
+		if _, ok := ctx.bai.DB().DocStamp(path); !ok {
+			t.Errorf("%s is not in the search DB", path)
+		}
+	}
+
+	if journal, _ := journalPath(ctx); fileExists(journal) {
+		t.Error("transaction journal left behind")
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// TestStuckTxn checks that a transaction left behind, either by a rollback
+// that failed halfway or by a crash, is rolled back by the next write
+func TestStuckTxn(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// interrupt leaves the committed transaction as it would be found
+		interrupt func(t *testing.T, ctx *ctx, txn *txn, head string)
+	}{
+		{"failed rollback", func(t *testing.T, ctx *ctx, txn *txn, head string) {
+			// the rollback resets the commit, then fails before restoring the
+			// file and removing the journal
+			txn.journal.Noted = false
+			if err := txn.save(); err != nil {
+				t.Fatalf("save: %v", err)
+			}
+			if err := ctx.git.Reset(head); err != nil {
+				t.Fatalf("Reset: %v", err)
+			}
+		}},
+		{"unrecorded commit", func(t *testing.T, ctx *ctx, txn *txn, head string) {
+			// a crash after the commit, before the journal records it
+			txn.journal.Commit = ""
+			txn.journal.Noted = false
+			if err := txn.save(); err != nil {
+				t.Fatalf("save: %v", err)
+			}
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := newTestCtx(t)
+
+			original := "# Page\n\nOriginal.\n"
+			if err := ctx.Write("page", original); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			file := filepath.Join(ctx.config.WikiPath, "page.md")
+			written, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			head, err := ctx.git.Head()
+			if err != nil {
+				t.Fatalf("Head: %v", err)
+			}
+
+			ctx.writeMu.Lock()
+			txn, err := beginTxn(ctx)
+			if err != nil {
+				t.Fatalf("beginTxn: %v", err)
+			}
+			if err := txn.writeFile("page.md", []byte("# Page\n\nEdited.\n")); err != nil {
+				t.Fatalf("writeFile: %v", err)
+			}
+			if _, err := txn.stage("page.md"); err != nil {
+				t.Fatalf("stage: %v", err)
+			}
+			if err := txn.commit("edit page", nil); err != nil {
+				t.Fatalf("commit: %v", err)
+			}
+			test.interrupt(t, ctx, txn, head)
+			ctx.writeMu.Unlock()
+
+			other := "# Other\n"
+			if err := ctx.Write("other", other); err != nil {
+				t.Fatalf("Write after interrupted transaction: %v", err)
+			}
+
+			content, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != string(written) {
+				t.Errorf("page not restored, got %q", content)
+			}
+			if journal, _ := journalPath(ctx); fileExists(journal) {
+				t.Error("transaction journal left behind")
+			}
+
+			// the write of other is the only commit after the original
+			newHead, err := ctx.git.Head()
+			if err != nil {
+				t.Fatalf("Head: %v", err)
+			}
+			parents, err := ctx.git.Parents(newHead)
+			if err != nil {
+				t.Fatalf("Parents: %v", err)
+			}
+			if len(parents) != 1 || parents[0] != head {
+				t.Errorf("parents of HEAD %v, want [%s]", parents, head)
+			}
+		})
+	}
+}
+
+// TestGeneratedPagesNotIndexed checks that generated pages are tracked but
+// kept out of the search DB
+func TestGeneratedPagesNotIndexed(t *testing.T) {
+	ctx := newTestCtx(t)
+
+	note := "# Note\n"
+	if err := ctx.Write("note", note); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// embedded before it was generated
+	topic := "topics/notes"
+	ctx.bai.DB().Add(topic, testVector(topic), time.Now())
+
+	content, err := topicPage(ctx, "Notes", []string{"note"})
+	if err != nil {
+		t.Fatalf("topicPage: %v", err)
+	}
+	file := filepath.Join(ctx.config.WikiPath, topic+".md")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, result := range indexBatch(ctx, context.Background(), []string{topic}, "") {
+		if result.Error != "" {
+			t.Fatalf("indexing %s: %s", result.Path, result.Error)
+		}
+	}
+
+	if _, ok := ctx.bai.DB().DocStamp(topic); ok {
+		t.Error("generated page is in the search DB")
+	}
+	if _, ok := ctx.pageBlobs[topic]; !ok {
+		t.Error("generated page is not tracked")
+	}
+	if !ctx.isGeneratedPage(topic) {
+		t.Error("generated page is not in the metadata")
+	}
+	if _, ok := ctx.bai.DB().DocStamp("note"); !ok {
+		t.Error("note is not in the search DB")
+	}
+}
+
+// TestWriteEmbedsPageAsWritten checks that the note of a written page is the
+// embedding of the page with its front matter
+func TestWriteEmbedsPageAsWritten(t *testing.T) {
+	ctx := newTestCtx(t)
+
+	content := "# Page\n"
+	if err := ctx.Write("page", content); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	written, err := ctx.Read("page")
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if written == content {
+		t.Fatal("page written without front matter")
+	}
+
+	note, ok := blobNotes(t, ctx)[ctx.pageBlobs["page"]]
+	if !ok {
+		t.Fatal("page has no note")
+	}
+	if fmt.Sprint(note.Vector) != fmt.Sprint(testVector(written)) {
+		t.Error("note is not the embedding of the page as written")
+	}
+	if vector, _ := ctx.bai.DB().Vector("page"); fmt.Sprint(vector) != fmt.Sprint(testVector(written)) {
+		t.Error("search DB does not have the embedding of the page as written")
+	}
+}
+
+// TestWriteStamp checks that a page is embedded once, after stamping, and
+// that a write racing with a change of the page keeps the created date of the
+// changed page
+func TestWriteStamp(t *testing.T) {
+	var (
+		requests atomic.Int32
+		ctx      *ctx
+		change   atomic.Pointer[func()]
+	)
+	ctx = newTestCtxWith(t, embeddingsStandIn(t, func(r *http.Request) bool {
+		requests.Add(1)
+		if f := change.Swap(nil); f != nil {
+			(*f)()
+		}
+		return true
+	}))
+
+	if err := ctx.Write("page", "# Page\n"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("%d embedding requests for a write, want 1", n)
+	}
+
+	// the page changes while it is being embedded
+	created := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	changePage := func() {
+		changed := fmt.Sprintf("---\ncreated: %s\n---\n# Changed\n", created.Format(time.DateOnly))
+		if err := os.WriteFile(filepath.Join(ctx.config.WikiPath, "page.md"), []byte(changed), 0644); err != nil {
+			t.Error(err)
+		}
+	}
+	change.Store(&changePage)
+	requests.Store(0)
+	if err := ctx.Write("page", "# Page, edited\n"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("%d embedding requests for a write started over, want 2", n)
+	}
+
+	written, err := ctx.Read("page")
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	meta, body, err := frontmatter.Parse([]byte(written))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if string(body) != "# Page, edited\n" || !meta.Created.Equal(created) {
+		t.Errorf("page written as %q, want created %v", written, created)
+	}
+	if vector, _ := ctx.bai.DB().Vector("page"); fmt.Sprint(vector) != fmt.Sprint(testVector(written)) {
+		t.Error("search DB does not have the embedding of the page as written")
+	}
+}
+
+func TestAutoTag(t *testing.T) {
+	ctx := newTestCtx(t)
+
+	// the closest page to vector is tagged
+	vector := testVector("neighbour")
+	ctx.bai.DB().Add("neighbour", vector, time.Now())
+	ctx.pageChanged("neighbour", []byte("---\ntags: [infra]\n---\n# Neighbour\n"))
+
+	existing := "# Existing\n"
+	if err := ctx.Write("existing", existing); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		path    string
+		content string
+		tagged  bool
+	}{
+		{"new page", "new", "# New\n", true},
+		{"existing page", "existing", "# Existing, edited\n", false},
+		{"opted out", "new", "---\nautotag: false\n---\n# New\n", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			meta, _, err := frontmatter.Parse([]byte(autoTag(ctx, test.path, test.content, vector)))
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if tagged := meta.HasTag("infra"); tagged != test.tagged {
+				t.Errorf("tagged %v, want %v", tagged, test.tagged)
+			}
+		})
+	}
+}
+
+// TestAutotagApply checks that POST adds the tags of the reviewed proposals,
+// not those proposed anew
+func TestAutotagApply(t *testing.T) {
+	ctx := newTestCtx(t)
+	ctx.jobs = newJobQueue(ctx, 1, 0)
+
+	for _, path := range []string{"a", "b"} {
+		content := "# " + path + "\n"
+		if err := ctx.Write(path, content); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	body := `[{"path": "a", "add": ["#Reviewed"]}, {"path": "b", "add": []}]`
+	w := httptest.NewRecorder()
+	autotagHandler(ctx, w, httptest.NewRequest(http.MethodPost, "/autotag", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+
+	// the tagged page is indexed again in the background
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		ctx.writeMu.Lock()
+		blob, err := ctx.git.HashFile("a.md")
+		indexed := err == nil && ctx.pageBlobs["a"] == blob
+		ctx.writeMu.Unlock()
+		if indexed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("tagged page not indexed again")
+		}
+	}
+
+	for path, want := range map[string]bool{"a": true, "b": false} {
+		content, err := ctx.Read(path)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		meta, _, _ := frontmatter.Parse([]byte(content))
+		if tagged := meta.HasTag("reviewed"); tagged != want {
+			t.Errorf("%s tagged %v, want %v", path, tagged, want)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	autotagHandler(ctx, w, httptest.NewRequest(http.MethodPost, "/autotag", strings.NewReader(`[{"path": "missing", "add": ["x"]}]`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d for a missing page, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestGrepTruncation(t *testing.T) {
+	ctx := newTestCtx(t)
+
+	// two matches per page
+	for _, path := range []string{"b", "a", "c/d"} {
+		content := fmt.Sprintf("# %s\n\nneedle\nhay\nneedle\n", path)
+		if err := ctx.Write(path, content); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	exec, err := git.NewRepo(ctx.config.WikiPath, "", git.Options{Backend: git.BackendExec})
+	if err != nil {
+		t.Fatalf("NewRepo: %v", err)
+	}
+
+	matcher, err := grep.Compile(grep.Options{Pattern: "needle"})
+	if err != nil {
+		t.Fatalf("Compile: %v", err)
+	}
+
+	for _, source := range []struct {
+		name string
+		rev  string
+		repo git.Repo
+	}{
+		{"working tree", "", ctx.git},
+		{"go-git", "HEAD", ctx.git},
+		{"exec", "HEAD", exec},
+	} {
+		ctx.git = source.repo
+		for _, test := range []struct {
+			limit     int
+			want      string
+			truncated bool
+		}{
+			{1, "[a]", true},
+			{3, "[a a b]", true},
+			{5, "[a a b b c/d]", true},
+			{6, "[a a b b c/d c/d]", false},
+			{10, "[a a b b c/d c/d]", false},
+		} {
+			t.Run(fmt.Sprintf("%s/%d", source.name, test.limit), func(t *testing.T) {
+				result, err := grepPages(ctx, source.rev, "", matcher, test.limit)
+				if err != nil {
+					t.Fatalf("grepPages: %v", err)
+				}
+
+				paths := make([]string, len(result.Matches))
+				for i, match := range result.Matches {
+					paths[i] = match.Path
+				}
+				if got := fmt.Sprint(paths); got != test.want || result.Truncated != test.truncated {
+					t.Errorf("got %s, truncated %v; want %s, truncated %v", got, result.Truncated, test.want, test.truncated)
+				}
+			})
+		}
+	}
+}
+
+// writeFile writes a page outside wikai
+func writeFile(t *testing.T, ctx *ctx, path string, content string) {
+	t.Helper()
+
+	file := filepath.Join(ctx.config.WikiPath, path+".md")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexBatchCancelled(t *testing.T) {
+	ctx := newTestCtx(t)
+
+	paths := []string{"a", "b"}
+	for _, path := range paths {
+		writeFile(t, ctx, path, "# "+path+"\n")
+	}
+
+	rctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, result := range indexBatch(ctx, rctx, paths, "") {
+		if result.State != api.PageCancelled {
+			t.Errorf("%s is %q (%s), want cancelled", result.Path, result.State, result.Error)
+		}
+	}
+
+	if len(blobNotes(t, ctx)) != 0 {
+		t.Error("cancelled pages indexed")
+	}
+}
+
+// TestJobCancel submits a job through the handlers and cancels it while its
+// second batch is embedded
+func TestJobCancel(t *testing.T) {
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	ctx := newTestCtxWith(t, embeddingsStandIn(t, func(r *http.Request) bool {
+		arrived <- struct{}{}
+		select {
+		case <-release:
+			return true
+		case <-r.Context().Done():
+			return false
+		}
+	}))
+	ctx.jobs = newJobQueue(ctx, 1, 2)
+
+	paths := []string{"a", "missing", "b", "c", "d", "e"}
+	for _, path := range paths {
+		if path != "missing" {
+			writeFile(t, ctx, path, "# "+path+"\n")
+		}
+	}
+
+	w := httptest.NewRecorder()
+	indexHandler(ctx, w, httptest.NewRequest(http.MethodPost, api.IndexPath, strings.NewReader(strings.Join(paths, "\n"))))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got %d submitting the job: %s", w.Code, w.Body)
+	}
+	var job api.IndexJob
+	if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+	if job.Total != len(paths) {
+		t.Fatalf("job of %d pages, want %d", job.Total, len(paths))
+	}
+
+	status := func(method string) api.IndexJob {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		jobsHandler(ctx, w, httptest.NewRequest(method, api.JobsPath+job.ID, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d for %s of the job", w.Code, method)
+		}
+		var job api.IndexJob
+		if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+			t.Fatal(err)
+		}
+		return job
+	}
+
+	// the first batch is done, the second is embedded
+	<-arrived
+	release <- struct{}{}
+	<-arrived
+
+	deadline := time.Now().Add(5 * time.Second)
+	for job = status(http.MethodGet); job.Done < 2; job = status(http.MethodGet) {
+		if time.Now().After(deadline) {
+			t.Fatalf("first batch not done: %+v", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if job.State != api.JobRunning || job.Done != 2 || job.Failed != 1 {
+		t.Errorf("job %+v, want running with 2 pages done, 1 failed", job)
+	}
+
+	status(http.MethodDelete)
+
+	for job = status(http.MethodGet); !job.State.Finished(); job = status(http.MethodGet) {
+		if time.Now().After(deadline) {
+			t.Fatalf("job not finished: %+v", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if job.State != api.JobCancelled || job.Done != 2 || job.Failed != 1 {
+		t.Errorf("job %+v, want cancelled with 2 pages done, 1 failed", job)
+	}
+	want := []api.PageState{api.PageIndexed, api.PageFailed, api.PageCancelled, api.PageCancelled, api.PageCancelled, api.PageCancelled}
+	for i, result := range job.Results {
+		if result.State != want[i] {
+			t.Errorf("%s is %q, want %q", result.Path, result.State, want[i])
+		}
+	}
+
+	if notes := blobNotes(t, ctx); len(notes) != 1 {
+		t.Errorf("%d pages indexed, want 1", len(notes))
+	}
+}
+
+// reopen returns a ctx on the wiki of ctx, as on a restart
+func reopen(t *testing.T, ctx *ctx) *ctx {
+	t.Helper()
+
+	reopened := newTestCtx(t)
+	reopened.config.WikiPath = ctx.config.WikiPath
+
+	repo, err := git.NewRepo(ctx.config.WikiPath, "", git.Options{Identity: git.Identity{Name: "test", Email: "test@example.com"}})
+	if err != nil {
+		t.Fatalf("NewRepo: %v", err)
+	}
+	reopened.git = repo
+
+	return reopened
+}
+
+// commitFile commits a page written outside wikai
+func commitFile(t *testing.T, ctx *ctx, path string, content string) {
+	t.Helper()
+
+	writeFile(t, ctx, path, content)
+	if err := ctx.git.Add(path + ".md"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := ctx.git.Commit("edit "+path, false); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+}
+
+// TestLoadEmbeddings checks that pages get the embeddings attached to their
+// current blobs on a restart, or else those of the legacy commit notes
+func TestLoadEmbeddings(t *testing.T) {
+	ctx := newTestCtx(t)
+
+	for _, path := range []string{"a", "b"} {
+		content := "# " + path + "\n"
+		if err := ctx.Write(path, content); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	written := make(map[string][]float64)
+	for _, path := range []string{"a", "b"} {
+		written[path], _ = ctx.bai.DB().Vector(path)
+	}
+
+	// a copy has the blob, and so the embedding, of the page
+	content, err := ctx.Read("a")
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	commitFile(t, ctx, "copy", content)
+
+	// an edit outside wikai leaves the page without an embedding
+	commitFile(t, ctx, "b", "# b\n\nEdited.\n")
+
+	// a page indexed before embeddings were attached to blobs
+	commitFile(t, ctx, "legacy", "# legacy\n")
+	legacy := testVector("legacy")
+	note, err := json.Marshal(embedding.Embedding{ID: "legacy", Vector: legacy, Stamp: time.Now(), Encoding: embedding.Float64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("git", "-c", "user.name=test", "-c", "user.email=test@example.com", "notes", "add", "-m", string(note), "HEAD")
+	cmd.Dir = ctx.config.WikiPath
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git notes add: %v: %s", err, out)
+	}
+
+	reopened := reopen(t, ctx)
+	if err := loadEmbeddings(reopened); err != nil {
+		t.Fatalf("loadEmbeddings: %v", err)
+	}
+
+	for path, want := range map[string][]float64{"a": written["a"], "copy": written["a"], "legacy": legacy} {
+		if got, ok := reopened.bai.DB().Vector(path); !ok || fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("embedding of %s %v, want %v", path, got, want)
+		}
+	}
+	if _, ok := reopened.bai.DB().Vector("b"); ok {
+		t.Error("edited page has the embedding of its previous version")
+	}
+
+	blob, err := reopened.git.HashFile("copy.md")
+	if err != nil {
+		t.Fatalf("HashFile: %v", err)
+	}
+	if reopened.pageBlobs["copy"] != blob || reopened.pageBlobs["a"] != blob {
+		t.Errorf("page blobs %v, want %s for the page and its copy", reopened.pageBlobs, blob)
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	stamp := time.Unix(1745000000, 0)
+	for _, encoding := range []embedding.Encoding{embedding.Float64, embedding.Float32, embedding.Int8} {
+		t.Run(string(encoding), func(t *testing.T) {
+			s := &snapshot{Notes: "notes", Blobs: make(map[string]embedding.Embedding)}
+			for _, path := range []string{"a", "b/c"} {
+				s.Blobs["blob-"+path] = embedding.Embedding{ID: path, Vector: testVector(path), Stamp: stamp, Encoding: encoding}
+			}
+
+			decoded, err := decodeSnapshot(s.encode())
+			if err != nil {
+				t.Fatalf("decodeSnapshot: %v", err)
+			}
+			if decoded.Notes != s.Notes || len(decoded.Blobs) != len(s.Blobs) {
+				t.Fatalf("decoded %+v, want %+v", decoded, s)
+			}
+
+			for blob, emb := range s.Blobs {
+				got := decoded.Blobs[blob]
+				// as lossy as the note itself
+				buf, scale := embedding.EncodeVector(emb.Vector, encoding)
+				want, err := embedding.DecodeVector(buf, encoding, scale)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.ID != emb.ID || !got.Stamp.Equal(stamp) || got.Encoding != encoding || fmt.Sprint(got.Vector) != fmt.Sprint(want) {
+					t.Errorf("decoded %+v, want %+v", got, emb)
+				}
+			}
+		})
+	}
+}
+
+// TestSnapshotFallback checks that an unusable snapshot is replaced with one
+// read from all notes
+func TestSnapshotFallback(t *testing.T) {
+	ctx := newTestCtx(t)
+
+	for _, path := range []string{"a", "b"} {
+		content := "# " + path + "\n"
+		if err := ctx.Write(path, content); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	path, err := snapshotPath(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := loadBlobEmbeddings(ctx)
+	if err != nil {
+		t.Fatalf("loadBlobEmbeddings: %v", err)
+	}
+	if len(want) != 2 {
+		t.Fatalf("%d embeddings, want 2", len(want))
+	}
+	valid, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("snapshot not written: %v", err)
+	}
+	notes, err := ctx.git.NotesCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a snapshot of a notes commit that is gone, holding a note since removed
+	stale := &snapshot{Notes: strings.Repeat("0", 40), Blobs: map[string]embedding.Embedding{
+		"stale": {ID: "stale", Vector: testVector("stale"), Encoding: embedding.Float64},
+	}}
+
+	corrupt := bytes.Clone(valid)
+	corrupt[len(corrupt)/2] ^= 0xff
+
+	for _, test := range []struct {
+		name    string
+		data    []byte
+		corrupt bool
+	}{
+		{"corrupt", corrupt, true},
+		{"truncated", valid[:len(valid)-10], true},
+		{"notes commit mismatch", stale.encode(), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.corrupt {
+				if _, err := decodeSnapshot(test.data); !errors.Is(err, errSnapshotCorrupt) {
+					t.Errorf("decodeSnapshot: got %v, want %v", err, errSnapshotCorrupt)
+				}
+			}
+
+			if err := os.WriteFile(path, test.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := loadBlobEmbeddings(ctx)
+			if err != nil {
+				t.Fatalf("loadBlobEmbeddings: %v", err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+
+			if s, err := readSnapshot(path); err != nil || s.Notes != notes || fmt.Sprint(s.Blobs) != fmt.Sprint(want) {
+				t.Errorf("snapshot not rewritten: %v", err)
+			}
+		})
+	}
+}
+
+// waitJobs waits for the jobs submitted by w to finish
+func waitJobs(t *testing.T, w *watcher) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, id := range w.jobs {
+		for {
+			job, ok := w.ctx.jobs.status(id)
+			if !ok || job.State.Finished() {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("job %s not finished", id)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	// the next request fails once fail is set
+	var fail atomic.Bool
+	ctx := newTestCtxWith(t, embeddingsStandIn(t, func(r *http.Request) bool {
+		return !fail.CompareAndSwap(true, false)
+	}))
+	ctx.jobs = newJobQueue(ctx, 1, 0)
+
+	kept := "# Kept\n"
+	if err := ctx.Write("kept", kept); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	removed := "# Removed\n"
+	if err := ctx.Write("removed", removed); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	keptBlob := ctx.pageBlobs["kept"]
+
+	w := newWatcher(ctx, time.Hour, 0)
+	w.retryDelay = time.Hour
+
+	writeFile(t, ctx, "new", "# New\n")
+	if err := os.Remove(filepath.Join(ctx.config.WikiPath, "removed.md")); err != nil {
+		t.Fatal(err)
+	}
+
+	fail.Store(true)
+	w.tick()
+	waitJobs(t, w)
+
+	if _, ok := ctx.pageBlobs["removed"]; ok {
+		t.Error("deleted page still tracked")
+	}
+	if _, ok := ctx.bai.DB().Vector("removed"); ok {
+		t.Error("deleted page still in the search DB")
+	}
+	if _, ok := ctx.pageBlobs["new"]; ok {
+		t.Fatal("new page indexed despite the failure")
+	}
+	if _, ok := w.pending["new"]; ok {
+		t.Error("new page pending while its job runs")
+	}
+
+	// the failed page is retried after the delay, although it did not change
+	// since
+	w.tick()
+	if _, ok := w.pending["new"]; !ok || len(w.jobs) != 0 {
+		t.Fatalf("failed page not pending until the delay: pending %v, jobs %v", w.pending, w.jobs)
+	}
+	w.pending["new"] = time.Time{}
+	w.tick()
+	waitJobs(t, w)
+
+	if _, ok := ctx.bai.DB().Vector("new"); !ok {
+		t.Error("failed page not indexed on retry")
+	}
+	if ctx.pageBlobs["kept"] != keptBlob {
+		t.Error("unchanged page indexed again")
+	}
+
+	w.tick()
+	if len(w.pending) != 0 || len(w.jobs) != 0 {
+		t.Errorf("pending %v and jobs %v after indexing", w.pending, w.jobs)
+	}
+
+	// a change is left alone for the debounce period
+	w.debounce = time.Hour
+	writeFile(t, ctx, "kept", "# Kept\n\nEdited.\n")
+	w.tick()
+	if _, ok := w.pending["kept"]; !ok || len(w.jobs) != 0 {
+		t.Errorf("change not debounced: pending %v, jobs %v", w.pending, w.jobs)
+	}
+}
+
+// padVector pads a vector to the test dimensions
+func padVector(xs ...float64) []float64 {
+	v := make([]float64, testDimensions)
+	copy(v, xs)
+	return v
+}
+
+// TestRelated checks the related notes of a page, over the API and in the
+// panel under the page, and that they are recomputed when embeddings change
+func TestRelated(t *testing.T) {
+	ctx := newTestCtx(t)
+
+	vectors := map[string][]float64{
+		"alpha":      padVector(1, 0),
+		"team/beta":  padVector(1, 0.2),
+		"gamma":      padVector(0, 1),
+		"unembedded": padVector(1, 0.1),
+	}
+	for path, vector := range vectors {
+		content := fmt.Sprintf("---\ntitle: <%s>\n---\ntext\n", path)
+		if err := ctx.Write(path, content); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		ctx.bai.DB().Add(path, vector, time.Now())
+	}
+	ctx.bai.DB().Remove("unembedded")
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		relatedHandler(ctx, w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w
+	}
+	related := func(url string) []string {
+		t.Helper()
+
+		w := get(url)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", url, w.Code, w.Body)
+		}
+		var results []api.SearchResult
+		if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+			t.Fatal(err)
+		}
+
+		var paths []string
+		for _, result := range results {
+			if _, written := vectors[result.Path]; written && result.Title != "<"+result.Path+">" {
+				t.Errorf("%s has title %q", result.Path, result.Title)
+			}
+			paths = append(paths, result.Path)
+		}
+		return paths
+	}
+
+	if got := related(api.RelatedPath + "alpha"); !slices.Equal(got, []string{"team/beta", "gamma"}) {
+		t.Errorf("related to alpha %v, want team/beta, gamma", got)
+	}
+	if got := related(api.RelatedPath + "alpha.md?limit=1"); !slices.Equal(got, []string{"team/beta"}) {
+		t.Errorf("related to alpha with limit 1 %v, want team/beta", got)
+	}
+
+	for _, c := range []struct {
+		url  string
+		code int
+	}{
+		{api.RelatedPath + "alpha?limit=0", http.StatusBadRequest},
+		{api.RelatedPath + "alpha?limit=51", http.StatusBadRequest},
+		{api.RelatedPath + "alpha?limit=x", http.StatusBadRequest},
+		{api.RelatedPath + "../alpha", http.StatusBadRequest},
+		{api.RelatedPath + ".git/config", http.StatusBadRequest},
+		{api.RelatedPath + "missing", http.StatusNotFound},
+		{api.RelatedPath + "unembedded", http.StatusNotFound},
+	} {
+		if w := get(c.url); w.Code != c.code {
+			t.Errorf("GET %s: %d, want %d", c.url, w.Code, c.code)
+		}
+	}
+	w := httptest.NewRecorder()
+	relatedHandler(ctx, w, httptest.NewRequest(http.MethodPost, api.RelatedPath+"alpha", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	// a new neighbour replaces the cached results, and a removed one leaves
+	// them
+	ctx.bai.DB().Add("delta", padVector(1, 0.01), time.Now())
+	if got := related(api.RelatedPath + "alpha?limit=1"); !slices.Equal(got, []string{"delta"}) {
+		t.Errorf("related to alpha after adding delta %v, want delta", got)
+	}
+	ctx.bai.DB().Remove("delta")
+	if got := related(api.RelatedPath + "alpha?limit=1"); !slices.Equal(got, []string{"team/beta"}) {
+		t.Errorf("related to alpha after removing delta %v, want team/beta", got)
+	}
+
+	// the panel links to the related notes by title
+	w = httptest.NewRecorder()
+	wikiHandler(ctx, w, httptest.NewRequest(http.MethodGet, "/wikai/alpha", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /wikai/alpha: %d %s", w.Code, w.Body)
+	}
+	_, panel, ok := strings.Cut(w.Body.String(), `id="wiki-related"`)
+	if !ok {
+		t.Fatalf("no related notes panel in %s", w.Body)
+	}
+	for _, link := range []string{
+		`<a href="/wikai/team/beta">&lt;team/beta&gt;</a>`,
+		`<a href="/wikai/gamma">&lt;gamma&gt;</a>`,
+	} {
+		if !strings.Contains(panel, link) {
+			t.Errorf("panel lacks %s: %s", link, panel)
+		}
+	}
+	if strings.Contains(panel, `href="/wikai/alpha"`) {
+		t.Errorf("panel links to the page itself: %s", panel)
+	}
+
+	// pages without an embedding have no panel
+	w = httptest.NewRecorder()
+	wikiHandler(ctx, w, httptest.NewRequest(http.MethodGet, "/wikai/unembedded", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), `id="wiki-related"`) {
+		t.Errorf("GET /wikai/unembedded: %d, panel shown", w.Code)
+	}
+}
+
+// TestDuplicates checks the pairs of pages reported as likely duplicates
+func TestDuplicates(t *testing.T) {
+	ctx := newTestCtx(t)
+
+	vectors := map[string][]float64{
+		"rota":        padVector(1, 0),
+		"team/oncall": padVector(1, 0.1),
+		"recipes":     padVector(0, 1),
+		"cooking":     padVector(0.3, 1),
+	}
+	for path, vector := range vectors {
+		content := fmt.Sprintf("---\ntitle: %s notes\n---\ntext\n", path)
+		if err := ctx.Write(path, content); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		ctx.bai.DB().Add(path, vector, time.Now())
+	}
+
+	duplicates := func(query string) []string {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		duplicatesHandler(ctx, w, httptest.NewRequest(http.MethodGet, api.DuplicatesPath+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", query, w.Code, w.Body)
+		}
+		var response []api.Duplicate
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+
+		var pairs []string
+		for _, duplicate := range response {
+			for _, info := range []api.PageInfo{duplicate.A, duplicate.B} {
+				if info.Title != info.Path+" notes" {
+					t.Errorf("%s has title %q", info.Path, info.Title)
+				}
+			}
+			pairs = append(pairs, duplicate.A.Path+"~"+duplicate.B.Path)
+		}
+		return pairs
+	}
+
+	// the configured similarity is 0.9
+	if got := duplicates(""); !slices.Equal(got, []string{"rota~team/oncall", "cooking~recipes"}) {
+		t.Errorf("duplicates %v, want rota~team/oncall, cooking~recipes", got)
+	}
+	if got := duplicates("?threshold=0.99"); !slices.Equal(got, []string{"rota~team/oncall"}) {
+		t.Errorf("duplicates at 0.99 %v, want rota~team/oncall", got)
+	}
+	if got := duplicates("?threshold=1"); len(got) != 0 {
+		t.Errorf("duplicates at 1 %v, want none", got)
+	}
+
+	for _, query := range []string{"?threshold=0", "?threshold=1.1", "?threshold=x"} {
+		w := httptest.NewRecorder()
+		duplicatesHandler(ctx, w, httptest.NewRequest(http.MethodGet, api.DuplicatesPath+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+	w := httptest.NewRecorder()
+	duplicatesHandler(ctx, w, httptest.NewRequest(http.MethodPost, api.DuplicatesPath, nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
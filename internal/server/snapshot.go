@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/vasilisp/wikai/pkg/embedding"
+)
+
+// snapshotName is the file, inside the .git directory so that it is never
+// tracked, caching the parsed embedding notes
+const snapshotName = "wikai-snapshot"
+
+const snapshotMagic = "WKAISNAP"
+
+// snapshotVersion changes whenever the layout below does; snapshots of other
+// versions are discarded
+const snapshotVersion = 2
+
+var errSnapshotCorrupt = errors.New("corrupt snapshot")
+
+// snapshot holds the embeddings attached to page blobs, as of commit Notes
+// of the notes ref.
+//
+// Layout, little-endian:
+//
+//	magic [8]byte
+//	version uint32
+//	notes string
+//	count uint32
+//	count × (blob string, id string, stamp int64, encoding string,
+//	         scale float32, vector string)
+//	crc32 uint32 (IEEE, of everything before it)
+//
+// where a string is a uint32 length followed by its bytes, and vectors are
+// kept in the encoding of their note.
+type snapshot struct {
+	Notes string
+	Blobs map[string]embedding.Embedding
+}
+
+func snapshotPath(ctx *ctx) (string, error) {
+	wikiPath0, err := wikiPath(ctx.config)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(wikiPath0, ".git", snapshotName), nil
+}
+
+func (s *snapshot) encode() []byte {
+	var buf bytes.Buffer
+
+	writeUint32 := func(v uint32) {
+		buf.Write(binary.LittleEndian.AppendUint32(nil, v))
+	}
+	writeString := func(str string) {
+		writeUint32(uint32(len(str)))
+		buf.WriteString(str)
+	}
+
+	buf.WriteString(snapshotMagic)
+	writeUint32(snapshotVersion)
+	writeString(s.Notes)
+	writeUint32(uint32(len(s.Blobs)))
+
+	for blob, emb := range s.Blobs {
+		writeString(blob)
+		writeString(emb.ID)
+		buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(emb.Stamp.Unix())))
+		writeString(string(emb.Encoding))
+		vector, scale := embedding.EncodeVector(emb.Vector, emb.Encoding)
+		writeUint32(math.Float32bits(scale))
+		writeString(string(vector))
+	}
+
+	writeUint32(crc32.ChecksumIEEE(buf.Bytes()))
+
+	return buf.Bytes()
+}
+
+// snapshotReader reads from a buffer, remembering the first failure
+type snapshotReader struct {
+	buf []byte
+	err error
+}
+
+func (r *snapshotReader) take(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.buf) {
+		r.err = errSnapshotCorrupt
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *snapshotReader) uint32() uint32 {
+	b := r.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (r *snapshotReader) uint64() uint64 {
+	b := r.take(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (r *snapshotReader) string() string {
+	return string(r.take(int(r.uint32())))
+}
+
+func decodeSnapshot(data []byte) (*snapshot, error) {
+	if len(data) < len(snapshotMagic)+8 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, errSnapshotCorrupt
+	}
+
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, fmt.Errorf("%w: checksum mismatch", errSnapshotCorrupt)
+	}
+
+	r := &snapshotReader{buf: body[len(snapshotMagic):]}
+	if version := r.uint32(); version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+
+	s := &snapshot{Notes: r.string()}
+	count := r.uint32()
+	s.Blobs = make(map[string]embedding.Embedding, min(count, 1<<16))
+
+	for range count {
+		blob := r.string()
+		emb := embedding.Embedding{ID: r.string(), Stamp: time.Unix(int64(r.uint64()), 0)}
+		emb.Encoding = embedding.Encoding(r.string())
+		scale := math.Float32frombits(r.uint32())
+		vector := r.take(int(r.uint32()))
+		if r.err != nil {
+			return nil, errSnapshotCorrupt
+		}
+
+		var err error
+		emb.Vector, err = embedding.DecodeVector(vector, emb.Encoding, scale)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errSnapshotCorrupt, err)
+		}
+		s.Blobs[blob] = emb
+	}
+
+	if r.err != nil || len(r.buf) != 0 {
+		return nil, errSnapshotCorrupt
+	}
+
+	return s, nil
+}
+
+func readSnapshot(path string) (*snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeSnapshot(data)
+}
+
+func writeSnapshot(path string, s *snapshot) error {
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, s.encode(), 0644); err != nil {
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+
+	return nil
+}
+
+// loadBlobEmbeddings returns the embeddings attached to page blobs. It starts
+// from the on-disk snapshot and reads only the notes changed since; if the
+// snapshot is missing or unusable, all notes are read. The snapshot is
+// rewritten whenever it was out of date.
+func loadBlobEmbeddings(ctx *ctx) (map[string]embedding.Embedding, error) {
+	notes, err := ctx.git.NotesCommit()
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := snapshotPath(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get snapshot path: %w", err)
+	}
+
+	s, err := readSnapshot(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("ignoring snapshot %s: %v", path, err)
+		}
+		s = nil
+	}
+
+	if s != nil && s.Notes == notes {
+		return s.Blobs, nil
+	}
+
+	readNotes := func(s *snapshot) error {
+		if notes == "" {
+			clear(s.Blobs)
+			return nil
+		}
+
+		return ctx.git.GetBlobNotes(s.Notes, func(blob string, note string) {
+			var emb embedding.Embedding
+			if err := json.Unmarshal([]byte(note), &emb); err != nil {
+				log.Printf("failed to unmarshal embedding of blob %s: %v", blob, err)
+				delete(s.Blobs, blob)
+				return
+			}
+			s.Blobs[blob] = emb
+		}, func(blob string) {
+			delete(s.Blobs, blob)
+		})
+	}
+
+	updated := false
+	if s != nil && s.Notes != "" {
+		if err := readNotes(s); err != nil {
+			// e.g. the snapshot commit is gone after the notes were rewritten
+			log.Printf("failed to update snapshot, reading all notes: %v", err)
+		} else {
+			updated = true
+			log.Printf("updated snapshot from %s to %s", s.Notes, notes)
+		}
+	}
+
+	if !updated {
+		s = &snapshot{Blobs: make(map[string]embedding.Embedding)}
+		if err := readNotes(s); err != nil {
+			return nil, err
+		}
+	}
+
+	s.Notes = notes
+	if err := writeSnapshot(path, s); err != nil {
+		log.Printf("%v", err)
+	}
+
+	return s.Blobs, nil
+}
@@ -0,0 +1,394 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/vasilisp/wikai/internal/frontmatter"
+	"github.com/vasilisp/wikai/internal/util"
+	"github.com/vasilisp/wikai/pkg/api"
+	"github.com/vasilisp/wikai/pkg/search"
+	"gopkg.in/yaml.v3"
+)
+
+// vocabularyFile is the controlled vocabulary of tags, relative to the wiki:
+// a YAML mapping from each tag to a description of what it is about, e.g.
+//
+//	infra: servers, deployment and monitoring
+//	oncall: the on-call rota and incident handling
+const vocabularyFile = ".wikai/tags.yaml"
+
+const (
+	// front matter field which, set to false, stops tags being added to a
+	// page automatically
+	autoTagField = "autotag"
+	// similarity between a page and a vocabulary tag above which the tag is
+	// proposed, if not configured
+	defaultAutoTagSimilarity = 0.4
+	// most tags added to a page automatically
+	maxAutoTags = 3
+	// similar pages whose tags are proposed for a page
+	autoTagNeighbours = 5
+	// share of the similarity of the neighbours a tag needs for it to be
+	// proposed, i.e. a weighted majority
+	neighbourTagShare = 0.5
+)
+
+type vocabularyTag struct {
+	name   string
+	vector []float64
+}
+
+// vocabulary is the controlled vocabulary with the embedding of each tag,
+// reloaded when the file changes
+type vocabulary struct {
+	mu      sync.Mutex
+	content []byte
+	tags    []vocabularyTag
+}
+
+// load returns the tags of the vocabulary; none if there is no vocabulary
+func (v *vocabulary) load(ctx *ctx, rctx context.Context) ([]vocabularyTag, error) {
+	wikiPath0, err := wikiPath(ctx.config)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(filepath.Join(wikiPath0, vocabularyFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %v", vocabularyFile, err)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.content != nil && string(v.content) == string(content) {
+		return v.tags, nil
+	}
+
+	var descriptions map[string]string
+	if err := yaml.Unmarshal(content, &descriptions); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", vocabularyFile, err)
+	}
+
+	// embedded as "name: description", so that the description counts
+	texts := make(map[string]string, len(descriptions))
+	for name, description := range descriptions {
+		if name = frontmatter.NormalizeTag(name); name != "" {
+			texts[name] = strings.TrimSuffix(name+": "+strings.TrimSpace(description), ": ")
+		}
+	}
+
+	names := make([]string, 0, len(texts))
+	for name := range texts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	inputs := make([]string, len(names))
+	for i, name := range names {
+		inputs[i] = texts[name]
+	}
+
+	tags := make([]vocabularyTag, len(names))
+	for i, result := range ctx.bai.EmbedBatch(rctx, inputs) {
+		if result.Err != nil {
+			return nil, fmt.Errorf("failed to embed tag %s: %w", names[i], result.Err)
+		}
+		tags[i] = vocabularyTag{name: names[i], vector: result.Vector}
+	}
+
+	log.Printf("loaded %d vocabulary tags", len(tags))
+
+	v.content = append([]byte{}, content...)
+	v.tags = tags
+	return tags, nil
+}
+
+func cosineSimilarity(a, b []float64) float64 {
+	dot, normA, normB := 0.0, 0.0, 0.0
+	for i := range a[:min(len(a), len(b))] {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(normA*normB)
+}
+
+// autoTagged tells whether a page may be tagged automatically, i.e., its
+// front matter does not opt out
+func autoTagged(fields map[string]any) bool {
+	enabled, ok := fields[autoTagField].(bool)
+	return !ok || enabled
+}
+
+// proposeTags returns the tags to add to a page with the given embedding:
+// the vocabulary tags similar enough to the page, and the tags most of its
+// closest pages share, weighted by similarity. Tags the page has are left
+// out; the best maxAutoTags are returned.
+func proposeTags(ctx *ctx, vocabulary []vocabularyTag, path string, meta frontmatter.Meta, vector []float64) ([]string, error) {
+	util.Assert(ctx != nil, "proposeTags nil ctx")
+
+	scores := make(map[string]float64)
+
+	for _, tag := range vocabulary {
+		if similarity := cosineSimilarity(vector, tag.vector); similarity >= ctx.config.AutoTagSimilarity {
+			scores[tag.name] = max(scores[tag.name], similarity)
+		}
+	}
+
+	neighbours, err := ctx.bai.DB().Query(search.Query{
+		Vector: vector,
+		Deny:   []string{path},
+		Keep: func(id string) bool {
+			return !isTopicPage(id)
+		},
+		Limit: autoTagNeighbours,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	total := 0.0
+	votes := make(map[string]float64)
+	for _, neighbour := range neighbours {
+		similarity := max(1-neighbour.Distance, 0)
+		total += similarity
+
+		info, _ := ctx.meta.info(neighbour.Path)
+		for _, tag := range info.Tags {
+			votes[tag] += similarity
+		}
+	}
+	for tag, vote := range votes {
+		if total > 0 && vote/total >= neighbourTagShare {
+			scores[tag] = max(scores[tag], vote/total)
+		}
+	}
+
+	tags := make([]string, 0, len(scores))
+	for tag := range scores {
+		if !meta.HasTag(tag) {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if scores[tags[i]] != scores[tags[j]] {
+			return scores[tags[i]] > scores[tags[j]]
+		}
+		return tags[i] < tags[j]
+	})
+
+	return tags[:min(len(tags), maxAutoTags)], nil
+}
+
+// autoTag adds the proposed tags to the metadata of a new page about to be
+// written, unless it opts out; existing pages keep the tags they are given.
+// On failure, the page is written as it is.
+func autoTag(ctx *ctx, path string, content string, vector []float64) string {
+	meta, body, err := frontmatter.Parse([]byte(content))
+	if err != nil || !autoTagged(meta.Fields) || pageExists(ctx, path) {
+		return content
+	}
+
+	vocabulary, err := ctx.vocabulary.load(ctx, context.Background())
+	if err != nil {
+		log.Printf("failed to tag %s: %v", path, err)
+		return content
+	}
+
+	tags, err := proposeTags(ctx, vocabulary, path, meta, vector)
+	if err != nil {
+		log.Printf("failed to tag %s: %v", path, err)
+		return content
+	}
+	if len(tags) == 0 {
+		return content
+	}
+
+	meta.Tags = append(meta.Tags, tags...)
+	tagged, err := frontmatter.Format(meta, body)
+	if err != nil {
+		log.Printf("failed to tag %s: %v", path, err)
+		return content
+	}
+
+	log.Printf("tagged %s with %v", path, tags)
+	return string(tagged)
+}
+
+// proposeAllTags returns the tags proposed for every page with an embedding,
+// except the generated topic pages and the pages opting out; pages with
+// nothing to add are left out
+func proposeAllTags(ctx *ctx, rctx context.Context) ([]api.TagProposal, error) {
+	vocabulary, err := ctx.vocabulary.load(ctx, rctx)
+	if err != nil {
+		return nil, err
+	}
+
+	proposals := make([]api.TagProposal, 0)
+	for _, info := range ctx.meta.list(pageFilter{}) {
+		if isTopicPage(info.Path) || !autoTagged(info.Fields) {
+			continue
+		}
+
+		vector, ok := ctx.bai.DB().Vector(info.Path)
+		if !ok {
+			continue
+		}
+
+		tags, err := proposeTags(ctx, vocabulary, info.Path, frontmatter.Meta{Tags: info.Tags}, vector)
+		if err != nil {
+			return nil, err
+		}
+		if len(tags) > 0 {
+			proposals = append(proposals, api.TagProposal{Path: info.Path, Tags: info.Tags, Add: tags})
+		}
+	}
+
+	return proposals, nil
+}
+
+// applyTags adds the proposed tags to the front matter of the pages in one
+// commit, and reindexes them in the background
+func applyTags(ctx *ctx, proposals []api.TagProposal) error {
+	if len(proposals) == 0 {
+		return nil
+	}
+
+	paths := make([]string, len(proposals))
+	err := func() error {
+		ctx.writeMu.Lock()
+		defer ctx.writeMu.Unlock()
+
+		t, err := beginTxn(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+
+		for i, proposal := range proposals {
+			paths[i] = proposal.Path
+
+			content, err := ctx.Read(proposal.Path)
+			if err != nil {
+				return t.abort(err)
+			}
+
+			meta, body, err := frontmatter.Parse([]byte(content))
+			if err != nil {
+				return t.abort(fmt.Errorf("page %s: %w", proposal.Path, err))
+			}
+			// the page may have changed since the proposal
+			for _, tag := range proposal.Add {
+				if !meta.HasTag(tag) {
+					meta.Tags = append(meta.Tags, tag)
+				}
+			}
+
+			tagged, err := frontmatter.Format(meta, body)
+			if err != nil {
+				return t.abort(err)
+			}
+
+			file := proposal.Path + ".md"
+			if err := t.writeFile(file, tagged); err != nil {
+				return t.abort(err)
+			}
+			if _, err := t.stage(file); err != nil {
+				return t.abort(err)
+			}
+		}
+
+		if err := t.commit(fmt.Sprintf("Tag %d pages", len(proposals)), nil); err != nil {
+			return t.abort(err)
+		}
+
+		t.finish()
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	_, err = syncPages(ctx, paths, "autotag")
+	return err
+}
+
+// parseProposals reads reviewed tag proposals, normalizing their tags and
+// leaving out those with nothing to add
+func parseProposals(ctx *ctx, r io.Reader) ([]api.TagProposal, error) {
+	var reviewed []api.TagProposal
+	if err := json.NewDecoder(r).Decode(&reviewed); err != nil {
+		return nil, fmt.Errorf("invalid proposals: %v", err)
+	}
+
+	proposals := make([]api.TagProposal, 0, len(reviewed))
+	for _, proposal := range reviewed {
+		if err := util.ValidatePagePath(proposal.Path); err != nil || !pageExists(ctx, proposal.Path) {
+			return nil, fmt.Errorf("no page %q", proposal.Path)
+		}
+
+		add := make([]string, 0, len(proposal.Add))
+		for _, tag := range proposal.Add {
+			if tag = frontmatter.NormalizeTag(tag); tag != "" {
+				add = append(add, tag)
+			}
+		}
+		if len(add) > 0 {
+			proposal.Add = add
+			proposals = append(proposals, proposal)
+		}
+	}
+
+	return proposals, nil
+}
+
+// autotagHandler reports the tags it would add to every page on GET, and
+// adds the tags of the proposals in the body, once reviewed, on POST
+func autotagHandler(ctx *ctx, w http.ResponseWriter, r *http.Request) {
+	var proposals []api.TagProposal
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		proposals, err = proposeAllTags(ctx, r.Context())
+		if err != nil {
+			log.Printf("autotag error: %v", err)
+			apiError(w, err, "Failed to propose tags")
+			return
+		}
+	case http.MethodPost:
+		defer r.Body.Close()
+		proposals, err = parseProposals(ctx, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := applyTags(ctx, proposals); err != nil {
+			log.Printf("autotag error: %v", err)
+			http.Error(w, "Failed to tag pages", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("tagged %d pages", len(proposals))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(proposals)
+}
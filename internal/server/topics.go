@@ -0,0 +1,328 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/vasilisp/wikai/internal/frontmatter"
+	"github.com/vasilisp/wikai/internal/util"
+	"github.com/vasilisp/wikai/pkg/api"
+	"github.com/vasilisp/wikai/pkg/search"
+)
+
+const (
+	// directory of the generated topic pages, which are not clustered
+	// themselves
+	topicsNamespace = "topics"
+	// front matter field marking the pages wikai generated, and may replace
+	// or remove
+	generatedField = "generated"
+	generatedBy    = "wikai topics"
+	// seed of the clustering when none is given
+	defaultTopicsSeed = 1
+	// notes of each topic shown to the model to name it, the most central
+	// first
+	topicSampleSize = 8
+	// longest note description shown to the model, in characters
+	topicSampleLength = 100
+)
+
+// isTopicPage tells whether a page is in the topics directory
+func isTopicPage(path string) bool {
+	return strings.HasPrefix(path, topicsNamespace+"/")
+}
+
+// isGenerated tells whether front matter marks a page as generated by wikai;
+// generated pages are not embedded, so that they do not show up in searches
+// or among related pages next to the notes they list
+func isGenerated(meta frontmatter.Meta) bool {
+	return meta.Fields[generatedField] == generatedBy
+}
+
+// isGeneratedPage tells whether a loaded page is generated
+func (ctx *ctx) isGeneratedPage(path string) bool {
+	info, _ := ctx.meta.info(path)
+	return info.Fields[generatedField] == generatedBy
+}
+
+// describeNote returns the title of a note or else its first line, for
+// naming its topic
+func describeNote(ctx *ctx, path string) string {
+	if info, ok := ctx.meta.info(path); ok && info.Title != "" {
+		return info.Title
+	}
+
+	content, err := ctx.Read(path)
+	if err != nil {
+		return path
+	}
+
+	_, body, _ := frontmatter.Parse([]byte(content))
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(line, "#"))
+		if line == "" {
+			continue
+		}
+		if utf8.RuneCountInString(line) > topicSampleLength {
+			line = string([]rune(line)[:topicSampleLength]) + "…"
+		}
+		return line
+	}
+
+	return path
+}
+
+// topicSlug turns a topic name into a page name: lowercase letters, digits
+// and hyphens
+func topicSlug(name string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+	return b.String()
+}
+
+// topicPage is the content of the page listing the notes of a topic
+func topicPage(ctx *ctx, name string, notes []string) ([]byte, error) {
+	var body bytes.Buffer
+	body.WriteString("Notes on this topic, most central first. This page is generated; edits are lost when topics are refreshed.\n\n")
+	for _, path := range notes {
+		if info, ok := ctx.meta.info(path); ok && info.Title != "" {
+			fmt.Fprintf(&body, "- [[%s|%s]]\n", path, info.Title)
+		} else {
+			fmt.Fprintf(&body, "- [[%s]]\n", path)
+		}
+	}
+
+	return frontmatter.Format(frontmatter.Meta{
+		Title:  name,
+		Tags:   []string{"topic"},
+		Fields: map[string]any{generatedField: generatedBy},
+	}, body.Bytes())
+}
+
+// topicPages returns the pages in the topics directory, and whether wikai
+// generated each
+func topicPages(ctx *ctx) (map[string]bool, error) {
+	wikiPath0, err := wikiPath(ctx.config)
+	if err != nil {
+		return nil, err
+	}
+
+	pages, err := scanPages(wikiPath0)
+	if err != nil {
+		return nil, err
+	}
+
+	generated := make(map[string]bool)
+	for path := range pages {
+		if !isTopicPage(path) {
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(wikiPath0, path+".md"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		meta, _, _ := frontmatter.Parse(content)
+		generated[path] = isGenerated(meta)
+	}
+
+	return generated, nil
+}
+
+// refreshTopics clusters the notes into k topics, k chosen from the number of
+// notes if zero, names the topics and commits a page per topic, removing the
+// generated pages of topics that no longer exist.
+func refreshTopics(ctx *ctx, rctx context.Context, k int, seed int64) (api.Topics, error) {
+	util.Assert(ctx != nil, "refreshTopics nil ctx")
+
+	if k == 0 {
+		notes := 0
+		ctx.writeMu.Lock()
+		for path := range ctx.pageBlobs {
+			if !isTopicPage(path) {
+				notes++
+			}
+		}
+		ctx.writeMu.Unlock()
+		k = search.DefaultClusters(notes)
+	}
+
+	clusters, err := ctx.bai.DB().Cluster(k, seed, func(path string) bool {
+		return !isTopicPage(path)
+	})
+	if err != nil {
+		return api.Topics{}, err
+	}
+
+	samples := make([][]string, len(clusters))
+	for i, cluster := range clusters {
+		for _, path := range cluster.IDs[:min(len(cluster.IDs), topicSampleSize)] {
+			samples[i] = append(samples[i], describeNote(ctx, path))
+		}
+	}
+
+	names, err := ctx.bai.NameTopics(rctx, samples)
+	if err != nil {
+		return api.Topics{}, fmt.Errorf("failed to name topics: %w", err)
+	}
+
+	existing, err := topicPages(ctx)
+	if err != nil {
+		return api.Topics{}, err
+	}
+
+	result := api.Topics{Topics: make([]api.Topic, len(clusters))}
+	contents := make([][]byte, len(clusters))
+	taken := make(map[string]bool)
+	for i, cluster := range clusters {
+		name := strings.TrimSpace(names[i])
+		slug := topicSlug(name)
+		if slug == "" {
+			name = fmt.Sprintf("Topic %d", i+1)
+			slug = fmt.Sprintf("topic-%d", i+1)
+		}
+
+		// pages written by hand are left alone
+		path := topicsNamespace + "/" + slug
+		for n := 2; taken[path] || handWritten(existing, path); n++ {
+			path = fmt.Sprintf("%s/%s-%d", topicsNamespace, slug, n)
+		}
+		taken[path] = true
+
+		if contents[i], err = topicPage(ctx, name, cluster.IDs); err != nil {
+			return api.Topics{}, err
+		}
+		result.Topics[i] = api.Topic{Name: name, Path: path, Pages: cluster.IDs}
+	}
+
+	for path, generated := range existing {
+		if generated && !taken[path] {
+			result.Removed = append(result.Removed, path)
+		}
+	}
+	slices.Sort(result.Removed)
+
+	if err := commitTopics(ctx, result, contents); err != nil {
+		return api.Topics{}, err
+	}
+
+	log.Printf("refreshed %d topics, removed %d", len(result.Topics), len(result.Removed))
+
+	return result, nil
+}
+
+// handWritten tells whether there is a topic page that wikai did not
+// generate
+func handWritten(existing map[string]bool, path string) bool {
+	generated, ok := existing[path]
+	return ok && !generated
+}
+
+// commitTopics writes the topic pages and removes the stale ones in one
+// commit
+func commitTopics(ctx *ctx, topics api.Topics, contents [][]byte) error {
+	ctx.writeMu.Lock()
+	defer ctx.writeMu.Unlock()
+
+	t, err := beginTxn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	blobs := make([]string, len(topics.Topics))
+	for i, topic := range topics.Topics {
+		file := topic.Path + ".md"
+		if err := t.writeFile(file, contents[i]); err != nil {
+			return t.abort(err)
+		}
+		if blobs[i], err = t.stage(file); err != nil {
+			return t.abort(err)
+		}
+	}
+
+	for _, path := range topics.Removed {
+		if err := t.deleteFile(path + ".md"); err != nil {
+			return t.abort(err)
+		}
+	}
+
+	if err := t.commit(fmt.Sprintf("Refresh %d topic pages", len(topics.Topics)), nil); err != nil {
+		return t.abort(err)
+	}
+
+	t.finish()
+
+	for i, topic := range topics.Topics {
+		// a page may have been embedded before it was generated
+		ctx.bai.DB().Remove(topic.Path)
+		ctx.pageBlobs[topic.Path] = blobs[i]
+		ctx.pageChanged(topic.Path, contents[i])
+	}
+	for _, path := range topics.Removed {
+		ctx.bai.DB().Remove(path)
+		delete(ctx.pageBlobs, path)
+		ctx.pageRemoved(path)
+	}
+
+	return nil
+}
+
+// topicsHandler refreshes the topic pages, with the number of topics and the
+// seed of the clustering given by the k and seed parameters
+func topicsHandler(ctx *ctx, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+
+	k := 0
+	if s := query.Get("k"); s != "" {
+		var err error
+		if k, err = strconv.Atoi(s); err != nil || k <= 0 {
+			http.Error(w, "Invalid k", http.StatusBadRequest)
+			return
+		}
+	}
+
+	seed := int64(defaultTopicsSeed)
+	if s := query.Get("seed"); s != "" {
+		var err error
+		if seed, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, "Invalid seed", http.StatusBadRequest)
+			return
+		}
+	}
+
+	topics, err := refreshTopics(ctx, r.Context(), k, seed)
+	if err != nil {
+		log.Printf("topics error: %v", err)
+		apiError(w, err, "Failed to refresh topics")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(topics)
+}
@@ -0,0 +1,393 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/vasilisp/wikai/internal/git"
+	"github.com/vasilisp/wikai/internal/util"
+)
+
+// journalName is the file, inside the .git directory, recording the
+// transaction in progress
+const journalName = "wikai-txn.json"
+
+type journalFile struct {
+	Path string `json:"path"`
+	// Written is set if the transaction overwrote or deleted the file, in
+	// which case Existed and Content describe what was there before
+	Written bool   `json:"written,omitempty"`
+	Existed bool   `json:"existed,omitempty"`
+	Content []byte `json:"content,omitempty"`
+}
+
+// journal records what a transaction has done so far, so that it can be
+// rolled back, even after a crash
+type journal struct {
+	// Head is the commit HEAD pointed to before the transaction; empty if
+	// there were no commits
+	Head  string        `json:"head"`
+	Files []journalFile `json:"files"`
+	// Commit is the commit created by the transaction, once created
+	Commit string `json:"commit,omitempty"`
+	// Noted is set once the embeddings are attached; from then on the
+	// transaction is complete as far as the repository is concerned
+	Noted bool `json:"noted,omitempty"`
+}
+
+// txn makes a page write, its commit and its embedding note a unit: either
+// all of them happen or, on failure, the file is restored and the commit is
+// reset. The caller must hold ctx.writeMu for the lifetime of the txn.
+type txn struct {
+	ctx     *ctx
+	path    string
+	journal journal
+}
+
+// errTxnStuck is returned by beginTxn when a transaction left behind by a
+// failed rollback cannot be rolled back either; until the repository is
+// fixed, no page can be written
+var errTxnStuck = errors.New("an earlier transaction cannot be rolled back; fix the wiki repo, then restart wikai or retry")
+
+func journalPath(ctx *ctx) (string, error) {
+	wikiPath0, err := wikiPath(ctx.config)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(wikiPath0, ".git", journalName), nil
+}
+
+func beginTxn(ctx *ctx) (*txn, error) {
+	util.Assert(ctx != nil, "beginTxn nil ctx")
+
+	path, err := journalPath(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get journal path: %w", err)
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		// left behind by a failed rollback; the caller holds writeMu, so it is
+		// not in progress
+		log.Printf("retrying the rollback of an unfinished transaction")
+		if err := recoverTxn(ctx); err != nil {
+			return nil, fmt.Errorf("%w: %w", errTxnStuck, err)
+		}
+	}
+
+	head, err := ctx.git.Head()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get HEAD: %w", err)
+	}
+
+	t := &txn{ctx: ctx, path: path, journal: journal{Head: head}}
+	if err := t.save(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *txn) save() error {
+	data, err := json.Marshal(t.journal)
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal: %v", err)
+	}
+
+	tmpPath := t.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, t.path); err != nil {
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+
+	return nil
+}
+
+func (t *txn) fullPath(file string) (string, error) {
+	wikiPath0, err := wikiPath(t.ctx.config)
+	if err != nil {
+		return "", fmt.Errorf("failed to get wiki path: %w", err)
+	}
+	return filepath.Join(wikiPath0, file), nil
+}
+
+// writeFile writes a file relative to the wiki, remembering its previous
+// content
+func (t *txn) writeFile(file string, content []byte) error {
+	fullPath, err := t.fullPath(file)
+	if err != nil {
+		return err
+	}
+
+	entry := journalFile{Path: file, Written: true}
+	previous, err := os.ReadFile(fullPath)
+	switch {
+	case err == nil:
+		entry.Existed = true
+		entry.Content = previous
+	case !os.IsNotExist(err):
+		return fmt.Errorf("failed to read %s: %v", file, err)
+	}
+
+	// journal first, so that a crash during the write can be undone
+	t.journal.Files = append(t.journal.Files, entry)
+	if err := t.save(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", file, err)
+	}
+
+	if err := os.WriteFile(fullPath, content, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", file, err)
+	}
+
+	return nil
+}
+
+// stage adds a file relative to the wiki to the index, returning its blob
+func (t *txn) stage(file string) (string, error) {
+	written := false
+	for _, entry := range t.journal.Files {
+		written = written || entry.Path == file
+	}
+	if !written {
+		t.journal.Files = append(t.journal.Files, journalFile{Path: file})
+		if err := t.save(); err != nil {
+			return "", err
+		}
+	}
+
+	if err := t.ctx.git.Add(file); err != nil {
+		return "", fmt.Errorf("failed to add %s to git: %w", file, err)
+	}
+
+	blob, err := t.ctx.git.BlobID(file)
+	if err != nil {
+		return "", err
+	}
+
+	return blob, nil
+}
+
+// deleteFile deletes a file relative to the wiki, remembering its content,
+// and stages its removal
+func (t *txn) deleteFile(file string) error {
+	fullPath, err := t.fullPath(file)
+	if err != nil {
+		return err
+	}
+
+	previous, err := os.ReadFile(fullPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", file, err)
+	}
+
+	t.journal.Files = append(t.journal.Files, journalFile{Path: file, Written: true, Existed: true, Content: previous})
+	if err := t.save(); err != nil {
+		return err
+	}
+
+	if err := os.Remove(fullPath); err != nil {
+		return fmt.Errorf("failed to delete %s: %v", file, err)
+	}
+
+	if err := t.ctx.git.Remove(file); err != nil {
+		return fmt.Errorf("failed to remove %s from git: %w", file, err)
+	}
+
+	return nil
+}
+
+// remove stages the removal of a file relative to the wiki
+func (t *txn) remove(file string) error {
+	t.journal.Files = append(t.journal.Files, journalFile{Path: file})
+	if err := t.save(); err != nil {
+		return err
+	}
+
+	if err := t.ctx.git.Remove(file); err != nil {
+		return fmt.Errorf("failed to remove %s from git: %w", file, err)
+	}
+
+	return nil
+}
+
+// commit commits the staged files and attaches the notes, given by blob. If
+// the files are already committed as they are, e.g. when re-indexing, only
+// the notes are attached.
+func (t *txn) commit(message string, notes map[string]string) error {
+	err := t.ctx.git.Commit(message, false)
+	switch {
+	case errors.Is(err, git.ErrNothingToCommit):
+	case err != nil:
+		return fmt.Errorf("failed to commit: %w", err)
+	default:
+		head, err := t.ctx.git.Head()
+		if err != nil {
+			return fmt.Errorf("failed to get HEAD: %w", err)
+		}
+		if head == t.journal.Head {
+			return errors.New("commit did not move HEAD")
+		}
+
+		t.journal.Commit = head
+		if err := t.save(); err != nil {
+			return err
+		}
+	}
+
+	if err := t.ctx.git.SetBlobNotes(notes); err != nil {
+		return fmt.Errorf("failed to add notes: %w", err)
+	}
+
+	t.journal.Noted = true
+	return t.save()
+}
+
+// finish ends a successful transaction
+func (t *txn) finish() {
+	if err := os.Remove(t.path); err != nil {
+		log.Printf("failed to remove journal %s: %v", t.path, err)
+	}
+}
+
+// abort rolls the transaction back, returning err together with any error
+// from the rollback
+func (t *txn) abort(err error) error {
+	if rollbackErr := t.rollback(); rollbackErr != nil {
+		return errors.Join(err, fmt.Errorf("rollback failed: %w", rollbackErr))
+	}
+
+	return err
+}
+
+func (t *txn) rollback() error {
+	if t.journal.Commit != "" && t.journal.Commit != t.journal.Head {
+		head, err := t.ctx.git.Head()
+		if err != nil {
+			return fmt.Errorf("failed to get HEAD: %w", err)
+		}
+		switch head {
+		case t.journal.Commit:
+		case t.journal.Head:
+			// reset by an earlier attempt at rolling back
+		default:
+			return fmt.Errorf("HEAD moved to %s after commit %s, not resetting", head, t.journal.Commit)
+		}
+
+		// notes are keyed by content and stay valid, so only the commit is
+		// undone
+		if head != t.journal.Head {
+			if err := t.ctx.git.Reset(t.journal.Head); err != nil {
+				return err
+			}
+		}
+	}
+
+	files := make([]string, 0, len(t.journal.Files))
+	for _, entry := range t.journal.Files {
+		files = append(files, entry.Path)
+	}
+	if err := t.ctx.git.Unstage(t.journal.Head, files...); err != nil {
+		return err
+	}
+
+	for _, entry := range t.journal.Files {
+		if !entry.Written {
+			continue
+		}
+
+		fullPath, err := t.fullPath(entry.Path)
+		if err != nil {
+			return err
+		}
+
+		if entry.Existed {
+			err = os.WriteFile(fullPath, entry.Content, 0644)
+		} else {
+			err = os.Remove(fullPath)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %v", entry.Path, err)
+		}
+	}
+
+	log.Printf("rolled back transaction on %v", files)
+
+	t.finish()
+	return nil
+}
+
+// recoverTxn completes or rolls back a transaction interrupted by a crash, or
+// whose rollback failed
+func recoverTxn(ctx *ctx) error {
+	path, err := journalPath(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get journal path: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read journal: %v", err)
+	}
+
+	t := &txn{ctx: ctx, path: path}
+	if err := json.Unmarshal(data, &t.journal); err != nil {
+		return fmt.Errorf("failed to parse journal %s: %v", path, err)
+	}
+
+	if t.journal.Noted {
+		// the embeddings are loaded from the notes, nothing is missing
+		log.Printf("found completed transaction for commit %s", t.journal.Commit)
+		t.finish()
+		return nil
+	}
+
+	if t.journal.Commit == "" {
+		if err := t.findCommit(); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("rolling back interrupted transaction")
+	return t.rollback()
+}
+
+// findCommit records the commit of a transaction interrupted after making it
+// but before saving it in the journal: HEAD has moved to a child of the
+// journal's HEAD
+func (t *txn) findCommit() error {
+	head, err := t.ctx.git.Head()
+	if err != nil {
+		return fmt.Errorf("failed to get HEAD: %w", err)
+	}
+	if head == "" || head == t.journal.Head {
+		return nil
+	}
+
+	parents, err := t.ctx.git.Parents(head)
+	if err != nil {
+		return err
+	}
+
+	if (t.journal.Head == "" && len(parents) == 0) || (len(parents) == 1 && parents[0] == t.journal.Head) {
+		log.Printf("found unrecorded commit %s of interrupted transaction", head)
+		t.journal.Commit = head
+	}
+
+	return nil
+}
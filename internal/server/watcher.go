@@ -0,0 +1,313 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vasilisp/wikai/internal/util"
+	"github.com/vasilisp/wikai/pkg/api"
+)
+
+// default time a page must be left alone before it is indexed
+const defaultWatchDebounce = 2 * time.Second
+
+// time after which a page that failed to index is tried again
+const watchRetryDelay = time.Minute
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// watcher polls the wiki for pages created, modified, deleted or renamed
+// outside wikai, and indexes them once they have been left alone for the
+// debounce period. A rename is a deletion and a creation.
+type watcher struct {
+	ctx      *ctx
+	interval time.Duration
+	debounce time.Duration
+	// seen is the state of the pages at the last scan
+	seen map[string]fileState
+	// pending maps changed pages to the time of their last change
+	pending map[string]time.Time
+	// jobs are the indexing jobs submitted and not seen finished; the pages
+	// they do not index are pending again after retryDelay
+	jobs       []string
+	retryDelay time.Duration
+}
+
+// startWatcher polls the wiki every interval in the background. Pages that
+// changed while the server was not running are picked up by the first scan.
+func startWatcher(ctx *ctx, interval time.Duration, debounce time.Duration) {
+	util.Assert(interval > 0, "startWatcher non-positive interval")
+
+	w := newWatcher(ctx, interval, debounce)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			w.tick()
+		}
+	}()
+}
+
+// newWatcher returns a watcher with every page pending, without starting it
+func newWatcher(ctx *ctx, interval time.Duration, debounce time.Duration) *watcher {
+	util.Assert(ctx != nil, "newWatcher nil ctx")
+
+	w := &watcher{
+		ctx:        ctx,
+		interval:   interval,
+		debounce:   debounce,
+		seen:       make(map[string]fileState),
+		pending:    make(map[string]time.Time),
+		retryDelay: watchRetryDelay,
+	}
+
+	// every page and every indexed page is checked once; unchanged ones are
+	// recognised by their blob
+	ctx.writeMu.Lock()
+	for path := range ctx.pageBlobs {
+		w.pending[path] = time.Time{}
+	}
+	ctx.writeMu.Unlock()
+
+	pages, err := w.scan()
+	if err != nil {
+		log.Printf("watcher: %v", err)
+	}
+	for path, state := range pages {
+		w.seen[path] = state
+		w.pending[path] = time.Time{}
+	}
+
+	log.Printf("watching %d pages every %v", len(pages), interval)
+
+	return w
+}
+
+// scan returns the state of every page in the wiki
+func (w *watcher) scan() (map[string]fileState, error) {
+	wikiPath0, err := wikiPath(w.ctx.config)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanPages(wikiPath0)
+}
+
+// scanPages returns the state of every page under wikiPath0, including the
+// pages in subdirectories
+func scanPages(wikiPath0 string) (map[string]fileState, error) {
+	pages := make(map[string]fileState)
+	err := filepath.WalkDir(wikiPath0, func(fullPath string, entry os.DirEntry, err error) error {
+		if err != nil {
+			if fullPath == wikiPath0 {
+				return err
+			}
+			// removed since its directory was read
+			return nil
+		}
+
+		if entry.IsDir() {
+			// skips .git, among others
+			if fullPath != wikiPath0 && util.ValidatePageSegment(entry.Name()) != nil {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(wikiPath0, fullPath)
+		if err != nil {
+			return nil
+		}
+		path, ok := strings.CutSuffix(filepath.ToSlash(rel), ".md")
+		if !ok || !entry.Type().IsRegular() || util.ValidatePagePath(path) != nil {
+			return nil
+		}
+
+		fi, err := entry.Info()
+		if err != nil {
+			// removed since the directory was read
+			return nil
+		}
+		pages[path] = fileState{modTime: fi.ModTime(), size: fi.Size()}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", wikiPath0, err)
+	}
+
+	return pages, nil
+}
+
+func (w *watcher) tick() {
+	pages, err := w.scan()
+	if err != nil {
+		log.Printf("watcher: %v", err)
+		return
+	}
+
+	now := time.Now()
+	w.collect(now)
+
+	for path, state := range pages {
+		if seen, ok := w.seen[path]; !ok || seen != state {
+			w.pending[path] = now
+		}
+	}
+	for path := range w.seen {
+		if _, ok := pages[path]; !ok {
+			w.pending[path] = now
+		}
+	}
+	w.seen = pages
+
+	var ready []string
+	for path, changed := range w.pending {
+		if now.Sub(changed) >= w.debounce {
+			ready = append(ready, path)
+		}
+	}
+	if len(ready) == 0 {
+		return
+	}
+
+	id, err := syncPages(w.ctx, ready, "watcher")
+	if err != nil {
+		// retried on the next tick
+		log.Printf("watcher: %v", err)
+		return
+	}
+
+	for _, path := range ready {
+		delete(w.pending, path)
+	}
+	if id != "" {
+		w.jobs = append(w.jobs, id)
+	}
+}
+
+// collect makes the pages that finished jobs did not index, e.g. because
+// they failed or were cancelled, pending again
+func (w *watcher) collect(now time.Time) {
+	running := w.jobs[:0]
+	for _, id := range w.jobs {
+		job, ok := w.ctx.jobs.status(id)
+		if !ok {
+			continue
+		}
+		if !job.State.Finished() {
+			running = append(running, id)
+			continue
+		}
+
+		retry := 0
+		for _, result := range job.Results {
+			if result.State == api.PageIndexed {
+				continue
+			}
+			// ready once retryDelay has passed; a later change keeps its own
+			// time
+			if _, ok := w.pending[result.Path]; !ok {
+				w.pending[result.Path] = now.Add(w.retryDelay - w.debounce)
+				retry++
+			}
+		}
+		if retry > 0 {
+			log.Printf("watcher: job %s did not index %d pages, retrying in %v", id, retry, w.retryDelay)
+		}
+	}
+	w.jobs = running
+}
+
+// syncPages indexes the pages among paths that changed outside wikai and
+// removes the deleted ones, returning the indexing job if one was submitted;
+// source prefixes the log messages
+func syncPages(ctx *ctx, paths []string, source string) (string, error) {
+	wikiPath0, err := wikiPath(ctx.config)
+	if err != nil {
+		return "", err
+	}
+
+	var modified, deleted []string
+
+	ctx.writeMu.Lock()
+	for _, path := range paths {
+		indexedBlob, indexed := ctx.pageBlobs[path]
+
+		if _, err := os.Stat(filepath.Join(wikiPath0, path+".md")); os.IsNotExist(err) {
+			if indexed {
+				deleted = append(deleted, path)
+			}
+			continue
+		}
+
+		blob, err := ctx.git.HashFile(path + ".md")
+		if err != nil {
+			log.Printf("%s: %v", source, err)
+			continue
+		}
+		if blob != indexedBlob {
+			modified = append(modified, path)
+		}
+	}
+	ctx.writeMu.Unlock()
+
+	if len(deleted) > 0 {
+		if err := removePages(ctx, deleted, " deleted outside wikai"); err != nil {
+			return "", err
+		}
+		log.Printf("%s: removed %d pages", source, len(deleted))
+	}
+
+	if len(modified) == 0 {
+		return "", nil
+	}
+
+	job, err := ctx.jobs.submit(modified, " edited outside wikai")
+	if err != nil {
+		return "", fmt.Errorf("failed to index %d pages: %w", len(modified), err)
+	}
+	log.Printf("%s: indexing %d pages in job %s", source, len(modified), job.ID)
+
+	return job.ID, nil
+}
+
+// removePages commits the removal of deleted pages and drops them from the
+// search DB
+func removePages(ctx *ctx, paths []string, reason string) error {
+	ctx.writeMu.Lock()
+	defer ctx.writeMu.Unlock()
+
+	t, err := beginTxn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	for _, path := range paths {
+		if err := t.remove(path + ".md"); err != nil {
+			return t.abort(err)
+		}
+	}
+
+	if err := t.commit(fmt.Sprintf("Remove %d pages%s", len(paths), reason), nil); err != nil {
+		return t.abort(err)
+	}
+
+	t.finish()
+
+	for _, path := range paths {
+		ctx.bai.DB().Remove(path)
+		delete(ctx.pageBlobs, path)
+		ctx.pageRemoved(path)
+	}
+
+	return nil
+}
@@ -3,13 +3,28 @@ package util
 import (
 	"fmt"
 	"regexp"
+	"strings"
 )
 
 var pageBasePathRegex = regexp.MustCompile(`^[a-zA-Z0-9]+(?:-[a-zA-Z0-9]+)*$`)
 
+// ValidatePageSegment checks one component of a page path, e.g. a directory
+// name
+func ValidatePageSegment(segment string) error {
+	if !pageBasePathRegex.MatchString(segment) {
+		return fmt.Errorf("invalid path segment: %s", segment)
+	}
+	return nil
+}
+
+// ValidatePagePath checks a page path, e.g. team/infra/oncall. Paths are
+// slash-separated slugs, so that no path can leave the wiki or point into
+// .git.
 func ValidatePagePath(path string) error {
-	if !pageBasePathRegex.MatchString(path) {
-		return fmt.Errorf("invalid path: %s", path)
+	for _, segment := range strings.Split(path, "/") {
+		if ValidatePageSegment(segment) != nil {
+			return fmt.Errorf("invalid path: %s", path)
+		}
 	}
 	return nil
 }
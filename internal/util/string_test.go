@@ -0,0 +1,35 @@
+package util
+
+import "testing"
+
+func TestValidatePagePath(t *testing.T) {
+	cases := []struct {
+		path  string
+		valid bool
+	}{
+		{"oncall", true},
+		{"team/infra/oncall", true},
+		{"Q3-plan-2024", true},
+		{"", false},
+		{"..", false},
+		{"../secrets", false},
+		{"team/../../etc/passwd", false},
+		{"team//oncall", false},
+		{"team/", false},
+		{"/etc/passwd", false},
+		{".git", false},
+		{".git/config", false},
+		{"team/.git", false},
+		{"notes.md", false},
+		{"-draft", false},
+		{"draft-", false},
+		{"team\\oncall", false},
+		{"on call", false},
+	}
+
+	for _, c := range cases {
+		if err := ValidatePagePath(c.path); (err == nil) != c.valid {
+			t.Errorf("ValidatePagePath(%q) = %v, want valid %v", c.path, err, c.valid)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Package wikilink is a goldmark extension for links between pages, written
+// [[page-path]] or [[page-path|label]]. Page paths are relative to the root of
+// the wiki.
+package wikilink
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/vasilisp/wikai/internal/util"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	gutil "github.com/yuin/goldmark/util"
+)
+
+// Class is the class of rendered links; links to missing pages also have
+// ClassMissing
+const (
+	Class        = "wikilink"
+	ClassMissing = "missing"
+)
+
+var KindWikiLink = ast.NewNodeKind("WikiLink")
+
+// Node is a link to a page
+type Node struct {
+	ast.BaseInline
+	// Target is the page path
+	Target string
+	// Label is the text of the link, the target if not given
+	Label []byte
+}
+
+func (n *Node) Kind() ast.NodeKind {
+	return KindWikiLink
+}
+
+func (n *Node) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Target": n.Target, "Label": string(n.Label)}, nil)
+}
+
+// parse reads a link from the start of line, returning its length in bytes
+func parse(line []byte) (*Node, int) {
+	if !bytes.HasPrefix(line, []byte("[[")) {
+		return nil, 0
+	}
+
+	end := bytes.Index(line, []byte("]]"))
+	if end < 0 {
+		return nil, 0
+	}
+
+	inner := line[2:end]
+	target, label, hasLabel := bytes.Cut(inner, []byte("|"))
+
+	target = bytes.TrimSpace(target)
+	target = bytes.TrimPrefix(target, []byte("/"))
+	target = bytes.TrimSuffix(target, []byte(".md"))
+	if util.ValidatePagePath(string(target)) != nil {
+		return nil, 0
+	}
+
+	label = bytes.TrimSpace(label)
+	if !hasLabel || len(label) == 0 {
+		label = target
+	}
+
+	return &Node{Target: string(target), Label: bytes.Clone(label)}, end + 2
+}
+
+type linkParser struct{}
+
+func (p *linkParser) Trigger() []byte {
+	return []byte{'['}
+}
+
+func (p *linkParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, _ := block.PeekLine()
+	node, n := parse(line)
+	if node == nil {
+		return nil
+	}
+
+	block.Advance(n)
+	return node
+}
+
+type linkRenderer struct {
+	prefix string
+	exists func(path string) bool
+}
+
+func (r *linkRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindWikiLink, r.render)
+}
+
+func (r *linkRenderer) render(w gutil.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+
+	n := node.(*Node)
+
+	class := Class
+	if r.exists != nil && !r.exists(n.Target) {
+		class += " " + ClassMissing
+	}
+
+	fmt.Fprintf(w, `<a href="%s/%s" class="%s">`, gutil.EscapeHTML([]byte(r.prefix)), n.Target, class)
+	w.Write(gutil.EscapeHTML(n.Label))
+	w.WriteString("</a>")
+
+	return ast.WalkSkipChildren, nil
+}
+
+type extension struct {
+	prefix string
+	exists func(path string) bool
+}
+
+// New returns the extension, linking to prefix/path. Links for which exists
+// returns false are marked missing; a nil exists marks none.
+func New(prefix string, exists func(path string) bool) goldmark.Extender {
+	return &extension{prefix: prefix, exists: exists}
+}
+
+func (e *extension) Extend(m goldmark.Markdown) {
+	// ahead of regular links, which also start with [
+	m.Parser().AddOptions(parser.WithInlineParsers(gutil.Prioritized(&linkParser{}, 199)))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(gutil.Prioritized(&linkRenderer{prefix: e.prefix, exists: e.exists}, 199)))
+}
+
+var targetsParser = goldmark.New(goldmark.WithExtensions(New("", nil))).Parser()
+
+// Targets returns the pages a page links to, without duplicates, in the order
+// they first appear. Links in code are not links.
+func Targets(source []byte) []string {
+	doc := targetsParser.Parse(text.NewReader(source))
+
+	var targets []string
+	seen := make(map[string]bool)
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if n, ok := node.(*Node); ok && entering && !seen[n.Target] {
+			seen[n.Target] = true
+			targets = append(targets, n.Target)
+		}
+		return ast.WalkContinue, nil
+	})
+
+	return targets
+}
@@ -0,0 +1,96 @@
+package wikilink
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/yuin/goldmark"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		line   string
+		target string
+		label  string
+		n      int
+	}{
+		{"[[a]]", "a", "a", 5},
+		{"[[a|b]] rest", "a", "b", 7},
+		{"[[ a | b c ]]", "a", "b c", 13},
+		{"[[a|]]", "a", "a", 6},
+		{"[[a/b.md]]", "a/b", "a/b", 10},
+		{"[[/a/b]]", "a/b", "a/b", 8},
+		{"[[a]] and [[b]]", "a", "a", 5},
+		{"[[a", "", "", 0},
+		{"[[a\n]]", "", "", 0},
+		{"[[]]", "", "", 0},
+		{"[[../a]]", "", "", 0},
+		{"[[.git/config]]", "", "", 0},
+		{"[a]]", "", "", 0},
+		{"text [[a]]", "", "", 0},
+	}
+
+	for _, c := range cases {
+		// the parser sees a line at a time
+		line, _, _ := strings.Cut(c.line, "\n")
+		node, n := parse([]byte(line))
+		if c.n == 0 {
+			if node != nil {
+				t.Errorf("parse(%q) = %q, want no link", c.line, node.Target)
+			}
+			continue
+		}
+		if node == nil {
+			t.Errorf("parse(%q) = no link, want %q", c.line, c.target)
+			continue
+		}
+		if node.Target != c.target || string(node.Label) != c.label || n != c.n {
+			t.Errorf("parse(%q) = %q, %q, %d; want %q, %q, %d", c.line, node.Target, node.Label, n, c.target, c.label, c.n)
+		}
+	}
+}
+
+func TestTargets(t *testing.T) {
+	cases := []struct {
+		name   string
+		source string
+		want   []string
+	}{
+		{"none", "no links here", nil},
+		{"label", "see [[a|the a page]]", []string{"a"}},
+		{"extension", "see [[a/b.md]]", []string{"a/b"}},
+		{"order and duplicates", "[[b]] [[a]] [[b|again]] [[a.md]]", []string{"b", "a"}},
+		{"code span", "`[[a]]` and [[b]]", []string{"b"}},
+		{"code block", "```\n[[a]]\n```\n\n[[b]]\n", []string{"b"}},
+		{"indented code", "    [[a]]\n\n[[b]]\n", []string{"b"}},
+		{"unterminated", "[[a and [[b]]", []string{"b"}},
+		{"unterminated at end", "see [[a", nil},
+		{"across lines", "[[a\nb]]", nil},
+		{"invalid", "[[../a]] [[a b]]", nil},
+		{"heading and list", "# [[a]]\n\n- [[b]]\n", []string{"a", "b"}},
+	}
+
+	for _, c := range cases {
+		if got := Targets([]byte(c.source)); !slices.Equal(got, c.want) {
+			t.Errorf("%s: Targets(%q) = %q, want %q", c.name, c.source, got, c.want)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	md := goldmark.New(goldmark.WithExtensions(New("/wiki", func(path string) bool {
+		return path == "a"
+	})))
+
+	var buf bytes.Buffer
+	if err := md.Convert([]byte("[[a|<A>]] [[b]]"), &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `<p><a href="/wiki/a" class="wikilink">&lt;A&gt;</a> <a href="/wiki/b" class="wikilink missing">b</a></p>` + "\n"
+	if buf.String() != want {
+		t.Errorf("rendered %q, want %q", buf.String(), want)
+	}
+}
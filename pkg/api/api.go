@@ -2,6 +2,17 @@ package api
 
 const PostPath = "/ai"
 const IndexPath = "/index"
+const StatsPath = "/stats"
+const JobsPath = "/jobs/"
+const ReloadPath = "/reload"
+const LinksPath = "/links/"
+const PagesPath = "/pages"
+const SearchPath = "/search"
+const RelatedPath = "/related/"
+const DuplicatesPath = "/duplicates"
+const TopicsPath = "/topics"
+const AutotagPath = "/autotag"
+const GrepPath = "/grep"
 
 type Page struct {
 	Title   string `json:"title"`
@@ -10,6 +21,119 @@ type Page struct {
 	Stamp   int64  `json:"stamp"`
 }
 
+// PageInfo is the metadata of a page, from its front matter
+type PageInfo struct {
+	Path    string         `json:"path"`
+	Title   string         `json:"title,omitempty"`
+	Tags    []string       `json:"tags,omitempty"`
+	Aliases []string       `json:"aliases,omitempty"`
+	Created int64          `json:"created,omitempty"`
+	Updated int64          `json:"updated,omitempty"`
+	Fields  map[string]any `json:"fields,omitempty"`
+}
+
+type SearchResult struct {
+	PageInfo
+	Distance float64 `json:"distance"`
+}
+
+// Duplicate is a pair of pages similar enough to be likely duplicates
+type Duplicate struct {
+	A          PageInfo `json:"a"`
+	B          PageInfo `json:"b"`
+	Similarity float64  `json:"similarity"`
+}
+
+// Topic is a group of similar pages and the generated page listing them
+type Topic struct {
+	Name  string   `json:"name"`
+	Path  string   `json:"path"`
+	Pages []string `json:"pages"`
+}
+
+// Topics are the topic pages written by a refresh, and the stale ones it
+// removed
+type Topics struct {
+	Topics  []Topic  `json:"topics"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// TagProposal is the tags proposed for a page, on top of those it has
+type TagProposal struct {
+	Path string   `json:"path"`
+	Tags []string `json:"tags,omitempty"`
+	Add  []string `json:"add"`
+}
+
+// GrepMatch is a line of a page matching a grep, numbered from 1, with the
+// lines around it
+type GrepMatch struct {
+	Path   string   `json:"path"`
+	Line   int      `json:"line"`
+	Text   string   `json:"text"`
+	Before []string `json:"before,omitempty"`
+	After  []string `json:"after,omitempty"`
+}
+
+// GrepResult is the matches of a grep; Truncated is set if there were more
+// than the limit
+type GrepResult struct {
+	Matches   []GrepMatch `json:"matches"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+type Link struct {
+	Path   string `json:"path"`
+	Exists bool   `json:"exists"`
+}
+
+// Links are the [[links]] from and to a page
+type Links struct {
+	Path     string `json:"path"`
+	Outbound []Link `json:"outbound"`
+	Inbound  []Link `json:"inbound"`
+}
+
+type PageState string
+
+const (
+	PagePending   PageState = "pending"
+	PageIndexed   PageState = "indexed"
+	PageFailed    PageState = "failed"
+	PageCancelled PageState = "cancelled"
+)
+
+type IndexResult struct {
+	Path  string    `json:"path"`
+	State PageState `json:"state,omitempty"`
+	Error string    `json:"error,omitempty"`
+}
+
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobDone      JobState = "done"
+	JobCancelled JobState = "cancelled"
+)
+
+// Finished reports whether a job in this state will make no more progress
+func (s JobState) Finished() bool {
+	return s == JobDone || s == JobCancelled
+}
+
+type IndexJob struct {
+	ID      string        `json:"id"`
+	State   JobState      `json:"state"`
+	Total   int           `json:"total"`
+	Done    int           `json:"done"`
+	Failed  int           `json:"failed"`
+	Results []IndexResult `json:"results"`
+	Created int64         `json:"created"`
+	Updated int64         `json:"updated"`
+}
+
 type HistoryEntry struct {
 	Text   string `json:"text"`
 	IsUser bool   `json:"is_user"`
@@ -24,4 +148,39 @@ type PostResponse struct {
 	References      []string `json:"references,omitempty" jsonschema:"description:IDs of relevant documents; NOT the whole content of each document"`
 	ReferencePrefix string   `json:"reference_prefix,omitempty" jsonschema:"description:Web path for the reference IDs"`
 	ChatID          string   `json:"chat_id"`
+	Truncated       []string `json:"truncated,omitempty" jsonschema:"-"`
+}
+
+// Usage counts the tokens of model calls. PromptTokens and CompletionTokens
+// are those reported by the API; the usage of chat calls is not exposed, so
+// their tokens are estimated from the text of the messages and counted apart.
+// Cost includes both.
+type Usage struct {
+	Requests                  int64   `json:"requests"`
+	PromptTokens              int64   `json:"prompt_tokens"`
+	CompletionTokens          int64   `json:"completion_tokens"`
+	EstimatedPromptTokens     int64   `json:"estimated_prompt_tokens,omitempty"`
+	EstimatedCompletionTokens int64   `json:"estimated_completion_tokens,omitempty"`
+	Cost                      float64 `json:"cost"`
+}
+
+type ChatUsage struct {
+	Usage
+	LastDay string `json:"last_day"`
+}
+
+type UsageStats struct {
+	ByChat           map[string]ChatUsage `json:"by_chat"`
+	ByOperation      map[string]Usage     `json:"by_operation"`
+	ByDay            map[string]Usage     `json:"by_day"`
+	DailySpendingCap float64              `json:"daily_spending_cap,omitempty"`
+	EmbeddingCache   *CacheStats          `json:"embedding_cache,omitempty"`
+}
+
+type CacheStats struct {
+	Entries   int   `json:"entries"`
+	Capacity  int   `json:"capacity"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
 }
@@ -3,9 +3,11 @@
 package backai
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
 	"unicode"
@@ -14,16 +16,31 @@ import (
 	"github.com/google/uuid"
 	"github.com/vasilisp/lingograph"
 	"github.com/vasilisp/lingograph/openai"
+	"github.com/vasilisp/lingograph/pkg/slicev"
 	"github.com/vasilisp/lingograph/store"
 	"github.com/vasilisp/wikai/internal/data"
+	"github.com/vasilisp/wikai/internal/frontmatter"
+	"github.com/vasilisp/wikai/internal/grep"
 	"github.com/vasilisp/wikai/internal/util"
 	"github.com/vasilisp/wikai/pkg/api"
+	"github.com/vasilisp/wikai/pkg/embedding"
 	"github.com/vasilisp/wikai/pkg/search"
 )
 
+// chatModel is the model used by all chat pipelines
+const chatModel = openai.GPT41Mini
+
 type WikiRW interface {
 	Read(path string) (string, error)
-	Write(path string, content string, embedding []float64) error
+	// Write stores a page and makes it searchable, embedding it as stored;
+	// on failure, nothing is stored
+	Write(path string, content string) error
+	// Grep finds the lines of the pages under prefix that match, at most
+	// limit of them
+	Grep(options grep.Options, prefix string, limit int) (api.GrepResult, error)
+	// Dated returns a filter, for search.Query.Keep, accepting the pages
+	// whose front matter dates them on or after from
+	Dated(from time.Time) func(path string) bool
 }
 
 const recentChatsLimit = 10
@@ -69,79 +86,370 @@ func (s *recentChats) get(key string) (value lingograph.Chat, ok bool) {
 // Ctx represents the context of the backai package
 type Ctx interface {
 	// Embed converts a string into a vector of float64 values
-	Embed(content string) ([]float64, error)
+	Embed(rctx context.Context, content string) ([]float64, error)
+	// EmbedBatch converts many strings at once, reporting failures per input
+	EmbedBatch(rctx context.Context, contents []string) []BatchResult
 	// Query sends a query to the backend LLM, possibly using the chat history
 	// represented by the chatId
-	Query(userQuery string, chatId string) (api.PostResponse, error)
+	Query(rctx context.Context, userQuery string, chatId string) (api.PostResponse, error)
+	// Search returns the pages closest to a text that the query selects; the
+	// vector of the query is the embedding of the text
+	Search(rctx context.Context, text string, query search.Query) ([]search.Result, error)
+	// NameTopics names groups of notes, each given by the titles or first
+	// lines of its notes; there is one name per group
+	NameTopics(rctx context.Context, topics [][]string) ([]string, error)
 	// DB provides access to the underlying database handle
 	DB() search.DB
+	// Usage returns the token usage and cost counters
+	Usage() api.UsageStats
+	// Close saves the counters whose saving is pending; it is called on
+	// shutdown
+	Close()
 	seal()
 }
 
+// vars holds the store variables shared by the pipelines of a chat
+type vars struct {
+	doSummarize store.Var[bool]
+	truncated   store.Var[[]string]
+	response    store.Var[api.PostResponse]
+	chatID      store.Var[string]
+	request     store.Var[context.Context]
+	op          store.Var[Operation]
+	mark        store.Var[int]
+	toolTokens  store.Var[int64]
+	topics      store.Var[[]string]
+}
+
+func freshVars() vars {
+	return vars{
+		doSummarize: store.FreshVar[bool](),
+		truncated:   store.FreshVar[[]string](),
+		response:    store.FreshVar[api.PostResponse](),
+		chatID:      store.FreshVar[string](),
+		request:     store.FreshVar[context.Context](),
+		op:          store.FreshVar[Operation](),
+		mark:        store.FreshVar[int](),
+		toolTokens:  store.FreshVar[int64](),
+		topics:      store.FreshVar[[]string](),
+	}
+}
+
+// embedder wraps an EmbeddingClient, recording token usage
+type embedder struct {
+	client EmbeddingClient
+	usage  *usageTracker
+}
+
+func (e embedder) embed(rctx context.Context, op Operation, chatID string, str string) ([]float64, error) {
+	vector, tokens, err := e.client.Embed(rctx, str)
+	if err != nil {
+		return nil, err
+	}
+
+	// cache hits consume no tokens and make no API call
+	if tokens > 0 {
+		e.usage.record(op, chatID, string(embeddingModel), tokens, 0, false)
+	}
+
+	return vector, nil
+}
+
 type ctx struct {
 	pipelineSearch    lingograph.Pipeline
 	pipelineSummarize lingograph.Pipeline
-	doSummarizeVar    store.Var[bool]
-	responseVar       store.Var[api.PostResponse]
+	pipelineTopics    lingograph.Pipeline
+	vars              vars
 	wikiPrefix        string
-	embeddingClient   EmbeddingClient
+	embedder          embedder
+	embeddingCache    *cachingEmbeddingClient
+	usage             *usageTracker
 	db                search.DB
 	recentChats       recentChats
+	queryTimeout      time.Duration
 }
 
 func (ctx *ctx) seal() {}
 
+func (ctx *ctx) Close() {
+	ctx.usage.flush()
+}
+
 func (ctx *ctx) DB() search.DB {
 	return ctx.db
 }
 
-func (ctx *ctx) Embed(content string) ([]float64, error) {
+func (ctx *ctx) Usage() api.UsageStats {
+	stats := ctx.usage.snapshot()
+	cacheStats := ctx.embeddingCache.stats()
+	stats.EmbeddingCache = &cacheStats
+	return stats
+}
+
+func (ctx *ctx) Embed(rctx context.Context, content string) ([]float64, error) {
+	util.Assert(ctx != nil, "Ctx is nil")
+	return ctx.embedder.embed(rctx, OpIndex, "", content)
+}
+
+func (ctx *ctx) Search(rctx context.Context, text string, query search.Query) ([]search.Result, error) {
+	util.Assert(ctx != nil, "Ctx is nil")
+
+	vector, err := ctx.embedder.embed(rctx, OpSearch, "", text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to vectorize query: %w", err)
+	}
+
+	query.Vector = vector
+	results, err := ctx.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("search failed: %v", err)
+	}
+
+	return results, nil
+}
+
+func (ctx *ctx) EmbedBatch(rctx context.Context, contents []string) []BatchResult {
 	util.Assert(ctx != nil, "Ctx is nil")
-	return ctx.embeddingClient.Embed(content)
+
+	results, tokens := ctx.embedder.client.EmbedBatch(rctx, contents)
+	if tokens > 0 {
+		ctx.usage.record(OpIndex, "", string(embeddingModel), tokens, 0, false)
+	}
+
+	return results
+}
+
+// setRequest returns a pipeline that stores the request context and chat ID
+// for use by tools
+func setRequest(vars vars, rctx context.Context, chatID string) lingograph.Pipeline {
+	return lingograph.NewActorUnsafe(lingograph.Assistant, func(history slicev.RO[lingograph.Message], r store.Store) ([]lingograph.Message, error) {
+		store.Set(r, vars.request, rctx)
+		store.Set(r, vars.chatID, chatID)
+		return nil, nil
+	}).Pipeline(nil, false, 1)
+}
+
+// request returns the request context and chat ID stored by setRequest
+func request(r store.Store, vars vars) (context.Context, string) {
+	rctx, ok := store.Get(r, vars.request)
+	if !ok {
+		rctx = context.Background()
+	}
+	chatID, _ := store.Get(r, vars.chatID)
+	return rctx, chatID
 }
 
 type WriteArgs struct {
-	Path    string `json:"path" jsonschema:"title=Note Path,description=The note path, suitable for a web URL; must be lowercase letters (a-z), digits (0-9), or hyphens (-) only, with no slashes or subdirectories.,pattern=^[a-z0-9-]+$,examples=[\"daily-notes\", \"meeting-20250424\"]"`
-	Content string `json:"content" jsonschema:"title=Note Content,description=Markdown-formatted content to write"`
+	Path    string   `json:"path" jsonschema:"title=Note Path,description=The note path, suitable for a web URL; segments of lowercase letters (a-z), digits (0-9), or hyphens (-) only, separated by slashes to place the note in a directory.,pattern=^[a-z0-9-]+(/[a-z0-9-]+)*$,examples=[\"daily-notes\", \"meetings/meeting-20250424\"]"`
+	Content string   `json:"content" jsonschema:"title=Note Content,description=Markdown-formatted content to write"`
+	Title   string   `json:"title" jsonschema:"title=Note Title,description=Human-readable title of the note"`
+	Tags    []string `json:"tags,omitempty" jsonschema:"title=Note Tags,description=A few short lowercase topic tags for the note"`
+	Force   bool     `json:"force,omitempty" jsonschema:"title=Force,description=Save as a new note even if similar notes exist; only when the user asked to"`
+}
+
+type SimilarArgs struct {
+	Content string `json:"content" jsonschema:"description=Content of the note to find existing similar notes for"`
 }
 
 type SearchArgs struct {
-	Query string
+	Query     string
+	Namespace string   `json:"namespace,omitempty" jsonschema:"description=Only search notes under this directory; e.g. team/infra"`
+	Tags      []string `json:"tags,omitempty" jsonschema:"description=Only search notes having all of these tags"`
+	LastDays  int      `json:"last_days,omitempty" jsonschema:"description=Only search notes written or updated in this many past days; e.g. 7 for the last week"`
+}
+
+type GrepArgs struct {
+	Pattern    string `json:"pattern" jsonschema:"description=Exact text to find, e.g. an error message, hostname or config key; a regular expression if regex is set"`
+	Regex      bool   `json:"regex,omitempty" jsonschema:"description=Interpret the pattern as a regular expression (RE2 syntax)"`
+	IgnoreCase bool   `json:"ignore_case,omitempty" jsonschema:"description=Match regardless of case"`
+	Namespace  string `json:"namespace,omitempty" jsonschema:"description=Only search notes under this directory; e.g. team/infra"`
+}
+
+const (
+	// matches the grep tool returns
+	grepToolMatches = 50
+	// lines of context around each match of the grep tool
+	grepToolContext = 2
+)
+
+// grepDocs groups the matches of a grep by page, as documents for the
+// summarizer
+func grepDocs(result api.GrepResult) []string {
+	var docs []string
+	var builder strings.Builder
+	for i, match := range result.Matches {
+		if i == 0 || match.Path != result.Matches[i-1].Path {
+			if builder.Len() > 0 {
+				docs = append(docs, builder.String())
+				builder.Reset()
+			}
+			fmt.Fprintf(&builder, "relevant document %s (matching lines only)\n---\n", match.Path)
+		} else {
+			builder.WriteString("[...]\n")
+		}
+
+		for j, line := range match.Before {
+			fmt.Fprintf(&builder, "%d  %s\n", match.Line-len(match.Before)+j, line)
+		}
+		fmt.Fprintf(&builder, "%d: %s\n", match.Line, match.Text)
+		for j, line := range match.After {
+			fmt.Fprintf(&builder, "%d  %s\n", match.Line+1+j, line)
+		}
+	}
+	if builder.Len() > 0 {
+		docs = append(docs, builder.String())
+	}
+
+	if result.Truncated {
+		docs = append(docs, fmt.Sprintf("only the first %d matches are shown", len(result.Matches)))
+	}
+
+	return docs
 }
 
-func doSearch(embeddingClient EmbeddingClient, db search.DB, query string) ([]string, error) {
-	vector, err := embeddingClient.Embed(query)
+// query turns the filters of the arguments into a search query; pages are
+// dated by their front matter, like in the search API
+func (args SearchArgs) query(wiki WikiRW, now time.Time) search.Query {
+	query := search.Query{Limit: 5}
+
+	if namespace := strings.Trim(args.Namespace, "/"); namespace != "" {
+		query.Prefix = namespace + "/"
+	}
+	for _, tag := range args.Tags {
+		if tag = frontmatter.NormalizeTag(tag); tag != "" {
+			query.Tags = append(query.Tags, tag)
+		}
+	}
+	if args.LastDays > 0 {
+		query.Keep = wiki.Dated(now.AddDate(0, 0, -args.LastDays))
+	}
+
+	return query
+}
+
+// DefaultSearchMMRLambda is the MMR lambda of the search tool when none is
+// configured; it keeps relevance first while skipping near-duplicates
+const DefaultSearchMMRLambda = 0.7
+
+func doSearch(rctx context.Context, embedder embedder, chatID string, db search.DB, wiki WikiRW, args SearchArgs, mmrLambda float64) ([]search.Result, error) {
+	vector, err := embedder.embed(rctx, OpSearch, chatID, args.Query)
 	if err != nil {
-		return nil, fmt.Errorf("failed to vectorize query: %v", err)
+		return nil, fmt.Errorf("failed to vectorize query: %w", err)
 	}
 
-	results, err := db.Search(vector, 5)
+	query := args.query(wiki, time.Now())
+	query.Vector = vector
+	query.MMR = true
+	query.MMRLambda = mmrLambda
+
+	results, err := db.Query(query)
 	if err != nil {
 		return nil, fmt.Errorf("search failed: %v", err)
 	}
 
-	paths := make([]string, len(results))
-	for i, result := range results {
+	return results, nil
+}
+
+// DefaultDuplicateSimilarity is the cosine similarity above which two notes
+// are considered likely duplicates, when none is configured
+const DefaultDuplicateSimilarity = 0.9
+
+// maxSimilar is the number of similar notes offered for merging
+const maxSimilar = 3
+
+// findSimilar returns the notes likely duplicating a vector, other than the
+// note at path
+func findSimilar(db search.DB, path string, vector []float64, minSimilarity float64) ([]search.Result, error) {
+	results, err := db.Query(search.Query{
+		Vector:        vector,
+		Deny:          []string{path},
+		MinSimilarity: minSimilarity,
+		Limit:         maxSimilar,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("similarity search failed: %v", err)
+	}
+
+	return results, nil
+}
+
+// duplicatesOf returns the paths of the notes a write likely duplicates;
+// none if it overwrites a note or is forced, in which case the note is not
+// embedded
+func duplicatesOf(db search.DB, args WriteArgs, embed func() ([]float64, error), minSimilarity float64) ([]string, error) {
+	if _, exists := db.DocStamp(args.Path); exists || args.Force {
+		return nil, nil
+	}
+
+	vector, err := embed()
+	if err != nil {
+		return nil, err
+	}
+
+	similar, err := findSimilar(db, args.Path, vector, minSimilarity)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, len(similar))
+	for i, result := range similar {
 		paths[i] = result.Path
 	}
 
 	return paths, nil
 }
 
-func pipelineSearch(client openai.Client, db search.DB, embeddingClient EmbeddingClient, wiki WikiRW, wikiPrefix string, doSummarizeVar store.Var[bool], responseVar store.Var[api.PostResponse]) lingograph.Pipeline {
-	actor := openai.NewActor(client, openai.GPT41Mini, data.SystemPrompt, nil)
+func searchTokenBudget(budgets map[string]int) int {
+	if budget, ok := budgets[string(chatModel.ToOpenAI())]; ok && budget > 0 {
+		return budget
+	}
+	return DefaultSearchTokenBudget
+}
+
+func pipelineSearch(client openai.Client, db search.DB, embedder embedder, wiki WikiRW, wikiPrefix string, tokenBudget int, mmrLambda float64, duplicateSimilarity float64, vars vars) lingograph.Pipeline {
+	actor := openai.NewActor(client, chatModel, data.SystemPrompt, nil)
 
 	openai.AddFunction(actor, "write", "Write a new note", func(args WriteArgs, r store.Store) (api.PostResponse, error) {
-		embedding, err := embeddingClient.Embed(args.Content)
+		store.Set(r, vars.op, OpWrite)
+		countArgs(r, vars.toolTokens, args)
+
+		if err := util.ValidatePagePath(args.Path); err != nil {
+			return api.PostResponse{}, err
+		}
+
+		content, err := frontmatter.Format(frontmatter.Meta{Title: args.Title, Tags: args.Tags}, []byte(args.Content))
+		if err != nil {
+			return api.PostResponse{}, err
+		}
+
+		// a new note that repeats existing ones is offered for merging instead;
+		// the wiki embeds the note again as written
+		rctx, chatID := request(r, vars)
+		paths, err := duplicatesOf(db, args, func() ([]float64, error) {
+			embedding, err := embedder.embed(rctx, OpWrite, chatID, string(content))
+			if err != nil {
+				return nil, fmt.Errorf("failed to embed content: %w", err)
+			}
+			return embedding, nil
+		}, duplicateSimilarity)
 		if err != nil {
-			return api.PostResponse{}, fmt.Errorf("failed to embed content: %v", err)
+			return api.PostResponse{}, err
 		}
+		if len(paths) > 0 {
+			log.Printf("not writing %s, similar to %v", args.Path, paths)
 
-		err = wiki.Write(args.Path, args.Content, embedding)
+			response := api.PostResponse{
+				Message:         fmt.Sprintf("You already have a similar note: %s. Should I merge the new content into it, or save %s as a separate note anyway?", strings.Join(paths, ", "), args.Path),
+				References:      paths,
+				ReferencePrefix: wikiPrefix,
+			}
 
-		db.Add(args.Path, embedding, time.Now())
+			store.Set(r, vars.response, response)
 
-		if err != nil {
+			return response, nil
+		}
+
+		if err := wiki.Write(args.Path, string(content)); err != nil {
 			return api.PostResponse{}, err
 		}
 
@@ -151,37 +459,123 @@ func pipelineSearch(client openai.Client, db search.DB, embeddingClient Embeddin
 			ReferencePrefix: wikiPrefix,
 		}
 
-		store.Set(r, responseVar, response)
+		store.Set(r, vars.response, response)
+
+		return response, nil
+	})
+
+	openai.AddFunctionUnsafe(actor, "find_similar", "Find existing notes similar to the content of a note, with their contents, to merge the note into one of them", func(args SimilarArgs, r store.Store) ([]string, error) {
+		store.Set(r, vars.op, OpSearch)
+		countArgs(r, vars.toolTokens, args)
+
+		rctx, chatID := request(r, vars)
+		vector, err := embedder.embed(rctx, OpSearch, chatID, args.Content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to vectorize content: %w", err)
+		}
+
+		results, err := findSimilar(db, "", vector, duplicateSimilarity)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(results) == 0 {
+			return []string{"no similar notes found"}, nil
+		}
+
+		docs := make([]searchDoc, 0, len(results))
+		for _, result := range results {
+			content, err := wiki.Read(result.Path)
+			if err != nil {
+				return nil, err
+			}
+
+			docs = append(docs, searchDoc{path: result.Path, distance: result.Distance, content: content})
+		}
+
+		response := make([]string, 0, len(docs))
+		for _, doc := range allocateBudget(docs, args.Content, tokenBudget) {
+			response = append(response, doc.String())
+		}
 
 		return response, nil
 	})
 
-	openai.AddFunctionUnsafe(actor, "search", "Search for notes", func(query SearchArgs, r store.Store) ([]string, error) {
-		log.Printf("search query: %s", query.Query)
+	openai.AddFunctionUnsafe(actor, "grep", "Find notes containing exact text, such as error messages, hostnames, identifiers or config keys, or matching a regular expression", func(args GrepArgs, r store.Store) ([]string, error) {
+		log.Printf("grep: %q (regex %v, ignore case %v, namespace %q)", args.Pattern, args.Regex, args.IgnoreCase, args.Namespace)
+
+		store.Set(r, vars.op, OpSearch)
+		countArgs(r, vars.toolTokens, args)
+		store.Set(r, vars.truncated, nil)
+
+		prefix := ""
+		if namespace := strings.Trim(args.Namespace, "/"); namespace != "" {
+			prefix = namespace + "/"
+		}
+
+		result, err := wiki.Grep(grep.Options{
+			Pattern:    args.Pattern,
+			Regexp:     args.Regex,
+			IgnoreCase: args.IgnoreCase,
+			Context:    grepToolContext,
+		}, prefix, grepToolMatches)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(result.Matches) == 0 {
+			return []string{"no matches found"}, nil
+		}
+
+		store.Set(r, vars.doSummarize, true)
+
+		return grepDocs(result), nil
+	})
+
+	openai.AddFunctionUnsafe(actor, "search", "Search for notes, optionally only among the notes in a namespace, with some tags, or from the last days", func(query SearchArgs, r store.Store) ([]string, error) {
+		log.Printf("search query: %s (namespace %q, tags %v, last %d days)", query.Query, query.Namespace, query.Tags, query.LastDays)
 
-		pages, err := doSearch(embeddingClient, db, query.Query)
+		store.Set(r, vars.op, OpSearch)
+		countArgs(r, vars.toolTokens, query)
+
+		rctx, chatID := request(r, vars)
+		results, err := doSearch(rctx, embedder, chatID, db, wiki, query, mmrLambda)
 		if err != nil {
 			return nil, err
 		}
 
-		if len(pages) == 0 {
+		store.Set(r, vars.truncated, nil)
+
+		if len(results) == 0 {
 			return []string{"nothing relevant found"}, nil
 		}
 
-		store.Set(r, doSummarizeVar, true)
+		store.Set(r, vars.doSummarize, true)
 
-		log.Printf("search results: %v", pages)
+		log.Printf("search results: %v", results)
 
-		response := make([]string, 0, len(pages))
-		for _, page := range pages {
-			content, err := wiki.Read(page)
+		docs := make([]searchDoc, 0, len(results))
+		for _, result := range results {
+			content, err := wiki.Read(result.Path)
 			if err != nil {
 				return nil, err
 			}
 
-			response = append(response, fmt.Sprintf("relevant document %s\n---\n%s", page, content))
+			docs = append(docs, searchDoc{path: result.Path, distance: result.Distance, content: content})
+		}
+
+		response := make([]string, 0, len(docs))
+		truncated := make([]string, 0)
+		for _, doc := range allocateBudget(docs, query.Query, tokenBudget) {
+			if doc.truncated {
+				log.Printf("truncated %s to ~%d of ~%d tokens", doc.path, doc.tokens, doc.total)
+				truncated = append(truncated, doc.path)
+			}
+			response = append(response, doc.String())
 		}
 
+		store.Set(r, vars.truncated, truncated)
+
 		return response, nil
 	})
 
@@ -194,45 +588,151 @@ type Summary struct {
 	Irrelevant []string `json:"irrelevant" jsonschema:"description:List of opaque document IDs that are irrelevant (do not summarize or rephrase)"`
 }
 
-func pipelineSummarize(client openai.Client, wikiPrefix string, responseVar store.Var[api.PostResponse]) lingograph.Pipeline {
-	actor := openai.NewActor(client, openai.GPT41Mini, data.SystemPromptSummarize, nil)
+func pipelineSummarize(client openai.Client, wikiPrefix string, vars vars) lingograph.Pipeline {
+	actor := openai.NewActor(client, chatModel, data.SystemPromptSummarize, nil)
 
 	openai.AddFunction(actor, "summarize", "Summarize notes", func(summary Summary, r store.Store) (api.PostResponse, error) {
+		countArgs(r, vars.toolTokens, summary)
+
 		response := api.PostResponse{
 			Message:         summary.Text,
 			References:      summary.Relevant,
 			ReferencePrefix: wikiPrefix,
 		}
 
-		store.Set(r, responseVar, response)
+		store.Set(r, vars.response, response)
 		return response, nil
 	})
 
 	return actor.Pipeline(nil, false, 3)
 }
 
-func NewCtx(wiki WikiRW, wikiPrefix string, apiKey string, embeddingDimensions int) Ctx {
-	client := openai.NewClient(apiKey)
+type TopicNames struct {
+	Names []string `json:"names" jsonschema:"description=One topic name per group of notes, in the order of the groups"`
+}
+
+func pipelineTopics(client openai.Client, vars vars) lingograph.Pipeline {
+	actor := openai.NewActor(client, chatModel, data.SystemPromptTopics, nil)
+
+	openai.AddFunction(actor, "name_topics", "Name groups of notes by topic", func(topics TopicNames, r store.Store) (string, error) {
+		countArgs(r, vars.toolTokens, topics)
+		store.Set(r, vars.topics, topics.Names)
+		return "ok", nil
+	})
+
+	return actor.Pipeline(nil, false, 3)
+}
+
+// Options configures a Ctx
+type Options struct {
+	WikiPrefix          string
+	APIKey              string
+	EmbeddingDimensions int
+	// EmbeddingBaseURL overrides the API endpoint of embedding requests,
+	// e.g., for a proxy
+	EmbeddingBaseURL string
+	// SearchTokenBudgets maps chat model names (e.g., "gpt-4.1-mini") to the
+	// number of tokens the search tool may spend on document contents
+	SearchTokenBudgets map[string]int
+	// UsagePath is where token usage counters are persisted; counters are
+	// kept in memory only if empty
+	UsagePath string
+	// DailySpendingCap is the maximum daily cost in USD, after which Query
+	// fails; zero disables the cap
+	DailySpendingCap float64
+	// EmbeddingCachePath is the directory where cached embeddings are
+	// persisted; the cache is kept in memory only if empty
+	EmbeddingCachePath string
+	// EmbeddingCacheSize is the maximum number of cached embeddings
+	EmbeddingCacheSize int
+	// Retry is the retry policy for embedding and chat completion requests;
+	// DefaultRetryPolicy is used if zero
+	Retry RetryPolicy
+	// RequestsPerMinute limits the rate of embedding requests, and separately
+	// that of chat completion requests, since the API limits each model on
+	// its own; zero means no limit
+	RequestsPerMinute int
+	// QueryTimeout bounds the tool calls made while answering a query; zero
+	// means no timeout
+	QueryTimeout time.Duration
+	// VectorEncoding is how the search DB keeps vectors in memory
+	VectorEncoding embedding.Encoding
+	// SearchMMRLambda diversifies the results of the search tool, see
+	// search.Query.MMRLambda; nil means DefaultSearchMMRLambda, and 1 ranks
+	// by relevance alone
+	SearchMMRLambda *float64
+	// DuplicateSimilarity is the cosine similarity above which the write
+	// tool offers to merge a new note into an existing one; zero means
+	// DefaultDuplicateSimilarity
+	DuplicateSimilarity float64
+}
 
-	doSummarizeVar := store.FreshVar[bool]()
-	responseVar := store.FreshVar[api.PostResponse]()
+// NewCtx creates a Ctx. Its chat completions go through a client of their
+// own, which applies the retry policy and the rate limit.
+func NewCtx(wiki WikiRW, options Options) Ctx {
+	retry := options.Retry
+	if retry == (RetryPolicy{}) {
+		retry = DefaultRetryPolicy
+	}
+	client := newChatClient(options.APIKey, newChatHTTPClient(retry, newRateLimiter(options.RequestsPerMinute)))
+
+	vars := freshVars()
+
+	usage := newUsageTracker(options.UsagePath, options.DailySpendingCap)
+	embeddingCache := newCachingEmbeddingClient(
+		NewEmbeddingClient(options.APIKey, options.EmbeddingDimensions, EmbeddingClientOptions{
+			BaseURL:           options.EmbeddingBaseURL,
+			Retry:             retry,
+			RequestsPerMinute: options.RequestsPerMinute,
+		}),
+		string(embeddingModel),
+		options.EmbeddingDimensions,
+		options.EmbeddingCachePath,
+		options.EmbeddingCacheSize,
+	)
+	embedder := embedder{
+		client: embeddingCache,
+		usage:  usage,
+	}
+	db := search.NewDB(options.VectorEncoding)
 
-	embeddingClient := NewEmbeddingClient(apiKey, embeddingDimensions)
-	db := search.NewDB()
+	wikiPrefix := options.WikiPrefix
+	tokenBudget := searchTokenBudget(options.SearchTokenBudgets)
+	mmrLambda := DefaultSearchMMRLambda
+	if options.SearchMMRLambda != nil {
+		mmrLambda = *options.SearchMMRLambda
+	}
+	duplicateSimilarity := options.DuplicateSimilarity
+	if duplicateSimilarity == 0 {
+		duplicateSimilarity = DefaultDuplicateSimilarity
+	}
 
 	return &ctx{
-		pipelineSearch:    pipelineSearch(client, db, embeddingClient, wiki, wikiPrefix, doSummarizeVar, responseVar),
-		pipelineSummarize: pipelineSummarize(client, wikiPrefix, responseVar),
-		responseVar:       responseVar,
-		doSummarizeVar:    doSummarizeVar,
+		pipelineSearch:    pipelineSearch(client, db, embedder, wiki, wikiPrefix, tokenBudget, mmrLambda, duplicateSimilarity, vars),
+		pipelineSummarize: pipelineSummarize(client, wikiPrefix, vars),
+		pipelineTopics:    pipelineTopics(client, vars),
+		vars:              vars,
 		wikiPrefix:        wikiPrefix,
-		embeddingClient:   embeddingClient,
+		embedder:          embedder,
+		embeddingCache:    embeddingCache,
+		usage:             usage,
 		db:                db,
 		recentChats:       recentChats{cache: lru.New(recentChatsLimit)},
+		queryTimeout:      options.QueryTimeout,
 	}
 }
 
-func (ctx *ctx) Query(userQuery string, chatId string) (api.PostResponse, error) {
+func (ctx *ctx) Query(rctx context.Context, userQuery string, chatId string) (api.PostResponse, error) {
+	if err := ctx.usage.checkCap(); err != nil {
+		return api.PostResponse{}, err
+	}
+
+	if ctx.queryTimeout > 0 {
+		var cancel context.CancelFunc
+		rctx, cancel = context.WithTimeout(rctx, ctx.queryTimeout)
+		defer cancel()
+	}
+
 	chat, ok := ctx.recentChats.get(chatId)
 	if !ok {
 		chatId = uuid.New().String()
@@ -241,21 +741,43 @@ func (ctx *ctx) Query(userQuery string, chatId string) (api.PostResponse, error)
 		ctx.recentChats.add(chatId, chat)
 	}
 
+	vars := ctx.vars
+
 	pipeline := lingograph.Chain(
+		setRequest(vars, rctx, chatId),
 		lingograph.UserPrompt(userQuery, false),
+		probeStart(vars.mark, vars.toolTokens),
 		ctx.pipelineSearch,
+		probeEnd(ctx.usage, data.SystemPrompt, OpSearch, vars.mark, vars.toolTokens, vars.op, vars.chatID),
 		lingograph.If(
 			func(r store.StoreRO) bool {
-				doSummarize, ok := store.GetRO(r, ctx.doSummarizeVar)
+				doSummarize, ok := store.GetRO(r, vars.doSummarize)
 				return ok && doSummarize
 			},
-			ctx.pipelineSummarize,
+			lingograph.Chain(
+				probeStart(vars.mark, vars.toolTokens),
+				ctx.pipelineSummarize,
+				probeEnd(ctx.usage, data.SystemPromptSummarize, OpSummarize, vars.mark, vars.toolTokens, vars.op, vars.chatID),
+			),
 			lingograph.Chain(),
 		),
 	)
 
+	// lingograph does not take a context, so chat completions themselves
+	// cannot be cancelled; they are bounded by the timeout of the retry
+	// policy, and tool calls honour rctx
 	err := pipeline.Execute(chat)
 	if err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
+			return api.PostResponse{}, err
+		}
+		if apiErr := classify(err); apiErr != nil {
+			return api.PostResponse{}, apiErr
+		}
+		if rctx.Err() != nil {
+			return api.PostResponse{}, &APIError{Kind: ErrTimeout, Err: err}
+		}
 		return api.PostResponse{}, err
 	}
 
@@ -265,12 +787,15 @@ func (ctx *ctx) Query(userQuery string, chatId string) (api.PostResponse, error)
 		return api.PostResponse{}, errors.New("no messages")
 	}
 
-	responseVal, ok := lingograph.Get(chat, ctx.responseVar)
+	responseVal, ok := lingograph.Get(chat, vars.response)
 	if ok {
+		if truncated, ok := lingograph.Get(chat, vars.truncated); ok {
+			responseVal.Truncated = truncated
+		}
 		return responseVal, nil
 	}
 
-	doSummarize, ok := lingograph.Get(chat, ctx.doSummarizeVar)
+	doSummarize, ok := lingograph.Get(chat, vars.doSummarize)
 	if ok && doSummarize {
 		return api.PostResponse{}, errors.New("internal error: no response")
 	}
@@ -280,3 +805,52 @@ func (ctx *ctx) Query(userQuery string, chatId string) (api.PostResponse, error)
 		ChatID:  chatId,
 	}, nil
 }
+
+func (ctx *ctx) NameTopics(rctx context.Context, topics [][]string) ([]string, error) {
+	util.Assert(ctx != nil, "Ctx is nil")
+
+	if len(topics) == 0 {
+		return nil, nil
+	}
+
+	if err := ctx.usage.checkCap(); err != nil {
+		return nil, err
+	}
+
+	var prompt strings.Builder
+	for i, notes := range topics {
+		fmt.Fprintf(&prompt, "Group %d:\n", i+1)
+		for _, note := range notes {
+			fmt.Fprintf(&prompt, "- %s\n", note)
+		}
+		prompt.WriteString("\n")
+	}
+
+	vars := ctx.vars
+	chat := lingograph.NewChat()
+
+	pipeline := lingograph.Chain(
+		setRequest(vars, rctx, ""),
+		lingograph.UserPrompt(prompt.String(), false),
+		probeStart(vars.mark, vars.toolTokens),
+		ctx.pipelineTopics,
+		probeEnd(ctx.usage, data.SystemPromptTopics, OpTopics, vars.mark, vars.toolTokens, vars.op, vars.chatID),
+	)
+
+	if err := pipeline.Execute(chat); err != nil {
+		if apiErr := classify(err); apiErr != nil {
+			return nil, apiErr
+		}
+		return nil, err
+	}
+
+	names, ok := lingograph.Get(chat, vars.topics)
+	if !ok {
+		return nil, errors.New("no topic names")
+	}
+	if len(names) != len(topics) {
+		return nil, fmt.Errorf("got %d topic names for %d topics", len(names), len(topics))
+	}
+
+	return names, nil
+}
@@ -0,0 +1,65 @@
+package backai
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/vasilisp/wikai/pkg/embedding"
+	"github.com/vasilisp/wikai/pkg/search"
+)
+
+func TestDuplicatesOf(t *testing.T) {
+	db := search.NewDB(embedding.Float64)
+	now := time.Now()
+
+	db.Add("rota", []float64{1, 0}, now)
+	db.Add("oncall", []float64{1, 0.2}, now)
+	db.Add("schedule", []float64{1, 0.4}, now)
+	db.Add("handover", []float64{1, 0.3}, now)
+	db.Add("recipes", []float64{0, 1}, now)
+
+	vector := []float64{1, 0.05}
+
+	cases := []struct {
+		name          string
+		args          WriteArgs
+		minSimilarity float64
+		want          []string
+	}{
+		{"new note", WriteArgs{Path: "new"}, 0.9, []string{"rota", "oncall", "handover"}},
+		{"threshold", WriteArgs{Path: "new"}, 0.985, []string{"rota", "oncall"}},
+		{"unlike", WriteArgs{Path: "new"}, 0.999, nil},
+		{"forced", WriteArgs{Path: "new", Force: true}, 0.9, nil},
+		{"overwrite", WriteArgs{Path: "rota"}, 0.9, nil},
+	}
+
+	for _, c := range cases {
+		embedded := false
+		got, err := duplicatesOf(db, c.args, func() ([]float64, error) {
+			embedded = true
+			return vector, nil
+		}, c.minSimilarity)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		// only new notes are checked, so only they are embedded
+		if checked := c.args.Path == "new" && !c.args.Force; embedded != checked {
+			t.Errorf("%s: embedded %v, want %v", c.name, embedded, checked)
+		}
+		if !slices.Equal(got, c.want) {
+			t.Errorf("%s: duplicates %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	// the note itself is never its own duplicate
+	results, err := findSimilar(db, "rota", []float64{1, 0}, 0.9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if result.Path == "rota" {
+			t.Error("findSimilar returned the note itself")
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// token budgeting for the documents returned by the search tool
+
+package backai
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/vasilisp/wikai/internal/util"
+)
+
+// DefaultSearchTokenBudget is the number of tokens the search tool may spend
+// on document contents when no model-specific budget is configured
+const DefaultSearchTokenBudget = 8000
+
+// minimum share of the budget a single result receives, as a fraction of an
+// even split; keeps weak matches from being reduced to nothing
+const minShareFraction = 0.25
+
+// estimateTokens approximates the number of tokens in a string, using the
+// rule of thumb of ~4 characters per token for English text
+func estimateTokens(s string) int {
+	return (utf8.RuneCountInString(s) + 3) / 4
+}
+
+type searchDoc struct {
+	path     string
+	distance float64
+	content  string
+}
+
+type budgetedDoc struct {
+	path      string
+	content   string
+	tokens    int
+	total     int
+	truncated bool
+}
+
+// allocateBudget distributes budget tokens across docs, proportionally to
+// their relevance. Documents that fit in their share are kept whole and the
+// leftover is redistributed among the rest. Documents that do not fit are
+// trimmed to the chunks most relevant to the query.
+func allocateBudget(docs []searchDoc, query string, budget int) []budgetedDoc {
+	util.Assert(budget > 0, "allocateBudget non-positive budget")
+
+	result := make([]budgetedDoc, len(docs))
+	if len(docs) == 0 {
+		return result
+	}
+
+	sizes := make([]int, len(docs))
+	weights := make([]float64, len(docs))
+	for i, doc := range docs {
+		sizes[i] = estimateTokens(doc.content)
+		weights[i] = math.Max(1-doc.distance, 0)
+	}
+
+	shares := waterFill(sizes, weights, budget)
+
+	terms := queryTerms(query)
+	for i, doc := range docs {
+		result[i] = budgetedDoc{
+			path:    doc.path,
+			content: doc.content,
+			tokens:  sizes[i],
+			total:   sizes[i],
+		}
+
+		if sizes[i] <= shares[i] {
+			continue
+		}
+
+		content := trimToChunks(doc.content, terms, shares[i])
+		result[i].content = content
+		result[i].tokens = estimateTokens(content)
+		result[i].truncated = true
+	}
+
+	return result
+}
+
+// waterFill computes per-document token shares. Each round splits the
+// remaining budget among the unsatisfied documents by weight; documents whose
+// full size fits are satisfied and return their surplus to the pool.
+func waterFill(sizes []int, weights []float64, budget int) []int {
+	n := len(sizes)
+	shares := make([]int, n)
+	satisfied := make([]bool, n)
+	remaining := budget
+
+	for {
+		var weightSum float64
+		open := 0
+		for i := range n {
+			if !satisfied[i] {
+				weightSum += weights[i]
+				open++
+			}
+		}
+		if open == 0 {
+			return shares
+		}
+
+		floor := float64(remaining) / float64(open) * minShareFraction
+		tentative := make([]float64, n)
+		var tentativeSum float64
+		for i := range n {
+			if satisfied[i] {
+				continue
+			}
+			share := floor
+			if weightSum > 0 {
+				share = math.Max(floor, float64(remaining)*weights[i]/weightSum)
+			}
+			tentative[i] = share
+			tentativeSum += share
+		}
+
+		// nothing left to split, e.g. when the satisfied documents took the
+		// whole budget
+		if remaining <= 0 || tentativeSum == 0 {
+			for i := range n {
+				if !satisfied[i] {
+					shares[i] = 0
+				}
+			}
+			return shares
+		}
+
+		progress := false
+		for i := range n {
+			if satisfied[i] {
+				continue
+			}
+			// normalise, since the floor can push the sum over the budget
+			share := int(tentative[i] * float64(remaining) / tentativeSum)
+			if sizes[i] <= share {
+				shares[i] = sizes[i]
+				satisfied[i] = true
+				progress = true
+			} else {
+				shares[i] = share
+			}
+		}
+
+		if !progress {
+			return shares
+		}
+
+		remaining = budget
+		for i := range n {
+			if satisfied[i] {
+				remaining -= shares[i]
+			}
+		}
+	}
+}
+
+func queryTerms(query string) map[string]struct{} {
+	terms := make(map[string]struct{})
+	for _, word := range strings.FieldsFunc(strings.ToLower(query), isSeparator) {
+		if len(word) > 2 {
+			terms[word] = struct{}{}
+		}
+	}
+	return terms
+}
+
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// splitChunks splits Markdown content at blank lines, further splitting
+// paragraphs that are too long to be useful as a single unit
+func splitChunks(content string, maxTokens int) []string {
+	var chunks []string
+	for _, paragraph := range strings.Split(content, "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph == "" {
+			continue
+		}
+		if estimateTokens(paragraph) <= maxTokens {
+			chunks = append(chunks, paragraph)
+			continue
+		}
+		chunks = append(chunks, *splitTextIntoChunks(paragraph, maxTokens*4)...)
+	}
+	return chunks
+}
+
+func scoreChunk(chunk string, terms map[string]struct{}) float64 {
+	if len(terms) == 0 {
+		return 0
+	}
+
+	seen := make(map[string]struct{})
+	for _, word := range strings.FieldsFunc(strings.ToLower(chunk), isSeparator) {
+		if _, ok := terms[word]; ok {
+			seen[word] = struct{}{}
+		}
+	}
+
+	return float64(len(seen)) / float64(len(terms))
+}
+
+// trimToChunks keeps the chunks of content that best match the query terms,
+// within budget tokens, preserving their original order. The first chunk
+// (usually the title) is preferred on ties.
+func trimToChunks(content string, terms map[string]struct{}, budget int) string {
+	const marker = "[...]"
+
+	chunks := splitChunks(content, max(budget/2, 64))
+
+	order := make([]int, len(chunks))
+	scores := make([]float64, len(chunks))
+	for i, chunk := range chunks {
+		order[i] = i
+		scores[i] = scoreChunk(chunk, terms)
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return scores[order[a]] > scores[order[b]]
+	})
+
+	markerTokens := estimateTokens(marker)
+	keep := make([]bool, len(chunks))
+	used := 0
+	for _, i := range order {
+		cost := estimateTokens(chunks[i]) + markerTokens
+		if used+cost > budget {
+			continue
+		}
+		keep[i] = true
+		used += cost
+	}
+
+	var builder strings.Builder
+	skipped := false
+	for i, chunk := range chunks {
+		if !keep[i] {
+			skipped = true
+			continue
+		}
+		if skipped {
+			builder.WriteString(marker + "\n\n")
+		}
+		skipped = false
+		builder.WriteString(chunk)
+		builder.WriteString("\n\n")
+	}
+	if skipped {
+		builder.WriteString(marker)
+	}
+
+	return strings.TrimSpace(builder.String())
+}
+
+func (doc budgetedDoc) String() string {
+	if !doc.truncated {
+		return fmt.Sprintf("relevant document %s\n---\n%s", doc.path, doc.content)
+	}
+
+	return fmt.Sprintf("relevant document %s (truncated to ~%d of ~%d tokens; omitted parts marked [...])\n---\n%s", doc.path, doc.tokens, doc.total, doc.content)
+}
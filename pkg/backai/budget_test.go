@@ -0,0 +1,94 @@
+package backai
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestWaterFill(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		sizes   []int
+		weights []float64
+		budget  int
+		want    []int
+	}{
+		{"exact fit", []int{30, 70}, []float64{0.5, 0.5}, 100, []int{30, 70}},
+		{"all fit", []int{10, 20}, []float64{0.9, 0.1}, 100, []int{10, 20}},
+		{"zero budget", []int{10, 20}, []float64{0.9, 0.1}, 0, []int{0, 0}},
+		{"zero weights", []int{100, 100}, []float64{0, 0}, 100, []int{50, 50}},
+		{"zero weights and budget", []int{100, 100}, []float64{0, 0}, 0, []int{0, 0}},
+		// the small document is kept whole and the rest goes to the large one
+		{"surplus redistributed", []int{10, 1000}, []float64{0.5, 0.5}, 100, []int{10, 90}},
+		{"single oversize document", []int{1000}, []float64{0.8}, 100, []int{100}},
+		// an irrelevant document still gets its floor
+		{"floor", []int{50, 50, 1000}, []float64{1, 1, 0}, 100, []int{46, 46, 7}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := waterFill(test.sizes, test.weights, test.budget)
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+
+			total := 0
+			for i, share := range got {
+				if share < 0 || share > test.sizes[i] {
+					t.Errorf("share %d of document %d of size %d", share, i, test.sizes[i])
+				}
+				total += share
+			}
+			if total > test.budget {
+				t.Errorf("shares add up to %d, over the budget of %d", total, test.budget)
+			}
+		})
+	}
+}
+
+func TestAllocateBudget(t *testing.T) {
+	short := "# Short\n\nA short note."
+	long := "# Long\n\n" + strings.Repeat("Filler text about nothing in particular. ", 40) + "\n\nThe paragraph about kubernetes deployments.\n\n" + strings.Repeat("More filler that does not matter. ", 40)
+
+	docs := allocateBudget([]searchDoc{
+		{path: "short", distance: 0.2, content: short},
+		{path: "long", distance: 0.3, content: long},
+	}, "kubernetes deployments", 100)
+
+	if docs[0].truncated || docs[0].content != short {
+		t.Errorf("short document changed: %+v", docs[0])
+	}
+
+	if !docs[1].truncated {
+		t.Fatal("long document not truncated")
+	}
+	if docs[1].tokens > 100-docs[0].tokens {
+		t.Errorf("long document has %d tokens, over its share", docs[1].tokens)
+	}
+	if !strings.Contains(docs[1].content, "kubernetes deployments") {
+		t.Errorf("truncated document lost the matching chunk: %q", docs[1].content)
+	}
+	if !strings.Contains(docs[1].content, "[...]") {
+		t.Errorf("truncated document has no marker: %q", docs[1].content)
+	}
+}
+
+func TestTrimToChunks(t *testing.T) {
+	content := "# Title\n\nfirst paragraph\n\nsecond about apples\n\nthird about pears"
+
+	for _, test := range []struct {
+		name   string
+		budget int
+		want   string
+	}{
+		{"everything fits", 100, "# Title\n\nfirst paragraph\n\nsecond about apples\n\nthird about pears"},
+		{"best chunk", 8, "[...]\n\nsecond about apples\n\n[...]"},
+		{"nothing fits", 0, "[...]"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := trimToChunks(content, queryTerms("apples"), test.budget)
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+// persistent embedding cache
+
+package backai
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/golang/groupcache/lru"
+	"github.com/vasilisp/wikai/internal/util"
+	"github.com/vasilisp/wikai/pkg/api"
+)
+
+// DefaultEmbeddingCacheSize is the maximum number of cached embeddings when
+// no size is configured
+const DefaultEmbeddingCacheSize = 10000
+
+type cachingEmbeddingClient struct {
+	inner      EmbeddingClient
+	model      string
+	dimensions int
+	dir        string
+
+	mu        sync.Mutex
+	entries   *lru.Cache
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+func (c *cachingEmbeddingClient) seal() {}
+
+// newCachingEmbeddingClient wraps inner with a cache keyed by model,
+// dimensions and content hash. Entries are persisted under dir (if not empty)
+// and at most maxEntries are kept, evicting the least recently used.
+func newCachingEmbeddingClient(inner EmbeddingClient, model string, dimensions int, dir string, maxEntries int) *cachingEmbeddingClient {
+	util.Assert(inner != nil, "newCachingEmbeddingClient nil inner")
+
+	if maxEntries <= 0 {
+		maxEntries = DefaultEmbeddingCacheSize
+	}
+
+	c := &cachingEmbeddingClient{
+		inner:      inner,
+		model:      model,
+		dimensions: dimensions,
+		dir:        dir,
+		entries:    lru.New(maxEntries),
+	}
+
+	c.entries.OnEvicted = func(key lru.Key, value interface{}) {
+		c.evictions++
+		if c.dir == "" {
+			return
+		}
+		if err := os.Remove(c.entryPath(key.(string))); err != nil && !os.IsNotExist(err) {
+			log.Printf("failed to remove cached embedding: %v", err)
+		}
+	}
+
+	if dir != "" {
+		if err := c.load(); err != nil {
+			log.Printf("failed to load embedding cache from %s: %v", dir, err)
+		}
+	}
+
+	return c
+}
+
+func (c *cachingEmbeddingClient) key(str string) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%d\x00", c.model, c.dimensions)
+	hash.Write([]byte(str))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (c *cachingEmbeddingClient) entryPath(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// load registers the entries found on disk, least recently used first;
+// vectors are read lazily on first use
+func (c *cachingEmbeddingClient) load() error {
+	paths, err := filepath.Glob(filepath.Join(c.dir, "*", "*"))
+	if err != nil {
+		return err
+	}
+
+	type entry struct {
+		key   string
+		mtime int64
+	}
+	entries := make([]entry, 0, len(paths))
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		entries = append(entries, entry{key: filepath.Base(path), mtime: fi.ModTime().UnixNano()})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].mtime < entries[j].mtime
+	})
+
+	for _, entry := range entries {
+		c.entries.Add(entry.key, []float64(nil))
+	}
+	// entries loaded from disk are not evictions of this session
+	c.evictions = 0
+
+	return nil
+}
+
+func (c *cachingEmbeddingClient) read(key string) ([]float64, error) {
+	buf, err := os.ReadFile(c.entryPath(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 || len(buf)%8 != 0 {
+		return nil, fmt.Errorf("corrupt cache entry %s", key)
+	}
+
+	vector := make([]float64, len(buf)/8)
+	for i := range vector {
+		vector[i] = math.Float64frombits(binary.LittleEndian.Uint64(buf[i*8:]))
+	}
+
+	return vector, nil
+}
+
+func (c *cachingEmbeddingClient) write(key string, vector []float64) error {
+	buf := make([]byte, len(vector)*8)
+	for i, v := range vector {
+		binary.LittleEndian.PutUint64(buf[i*8:], math.Float64bits(v))
+	}
+
+	path := c.entryPath(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// lookup returns the cached vector for key, counting a hit or a miss. Entries
+// registered from disk are read outside the lock, so that lookups do not wait
+// for each other's IO.
+func (c *cachingEmbeddingClient) lookup(key string) ([]float64, bool) {
+	c.mu.Lock()
+	value, ok := c.entries.Get(key)
+	var vector []float64
+	if !ok {
+		c.misses++
+	} else if vector = value.([]float64); vector != nil {
+		c.hits++
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+	if vector != nil {
+		return vector, true
+	}
+
+	vector, err := c.read(key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// the entry may have been evicted, or filled in, meanwhile
+	value, ok = c.entries.Get(key)
+	if err != nil {
+		if ok && value.([]float64) == nil {
+			log.Printf("failed to read cached embedding: %v", err)
+			c.entries.Remove(key)
+		}
+		c.misses++
+		return nil, false
+	}
+
+	if ok && value.([]float64) == nil {
+		c.entries.Add(key, vector)
+	}
+	c.hits++
+	return vector, true
+}
+
+func (c *cachingEmbeddingClient) Embed(ctx context.Context, str string) ([]float64, int64, error) {
+	key := c.key(str)
+
+	if vector, ok := c.lookup(key); ok {
+		return vector, 0, nil
+	}
+
+	vector, tokens, err := c.inner.Embed(ctx, str)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries.Add(key, vector)
+	if c.dir != "" {
+		if err := c.write(key, vector); err != nil {
+			log.Printf("failed to persist cached embedding: %v", err)
+		}
+	}
+
+	return vector, tokens, nil
+}
+
+func (c *cachingEmbeddingClient) EmbedBatch(ctx context.Context, strs []string) ([]BatchResult, int64) {
+	results := make([]BatchResult, len(strs))
+	keys := make([]string, len(strs))
+	var missing []int
+
+	for i, str := range strs {
+		keys[i] = c.key(str)
+		if vector, ok := c.lookup(keys[i]); ok {
+			results[i].Vector = vector
+		} else {
+			missing = append(missing, i)
+		}
+	}
+
+	if len(missing) == 0 {
+		return results, 0
+	}
+
+	missingStrs := make([]string, len(missing))
+	for j, i := range missing {
+		missingStrs[j] = strs[i]
+	}
+
+	missingResults, tokens := c.inner.EmbedBatch(ctx, missingStrs)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for j, i := range missing {
+		results[i] = missingResults[j]
+		if missingResults[j].Err != nil {
+			continue
+		}
+
+		c.entries.Add(keys[i], missingResults[j].Vector)
+		if c.dir != "" {
+			if err := c.write(keys[i], missingResults[j].Vector); err != nil {
+				log.Printf("failed to persist cached embedding: %v", err)
+			}
+		}
+	}
+
+	return results, tokens
+}
+
+func (c *cachingEmbeddingClient) stats() api.CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return api.CacheStats{
+		Entries:   c.entries.Len(),
+		Capacity:  c.entries.MaxEntries,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
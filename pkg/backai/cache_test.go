@@ -0,0 +1,191 @@
+package backai
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// countingClient embeds strings as their length, counting the strings it
+// was asked to embed
+type countingClient struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (c *countingClient) seal() {}
+
+func (c *countingClient) vector(str string) []float64 {
+	return []float64{float64(len(str)), 1}
+}
+
+func (c *countingClient) Embed(ctx context.Context, str string) ([]float64, int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.calls++
+	return c.vector(str), 1, nil
+}
+
+func (c *countingClient) EmbedBatch(ctx context.Context, strs []string) ([]BatchResult, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	results := make([]BatchResult, len(strs))
+	for i, str := range strs {
+		c.calls++
+		results[i].Vector = c.vector(str)
+	}
+	return results, int64(len(strs))
+}
+
+func TestCacheKey(t *testing.T) {
+	inner := &countingClient{}
+	base := newCachingEmbeddingClient(inner, "model", 8, "", 0)
+
+	if base.key("content") != base.key("content") {
+		t.Error("key not deterministic")
+	}
+
+	cases := []struct {
+		name   string
+		client *cachingEmbeddingClient
+		str    string
+	}{
+		{"model", newCachingEmbeddingClient(inner, "other", 8, "", 0), "content"},
+		{"dimensions", newCachingEmbeddingClient(inner, "model", 16, "", 0), "content"},
+		{"content", base, "other content"},
+	}
+
+	for _, c := range cases {
+		if c.client.key(c.str) == base.key("content") {
+			t.Errorf("key does not depend on %s", c.name)
+		}
+	}
+}
+
+func TestCacheRestart(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	inner := &countingClient{}
+	cache := newCachingEmbeddingClient(inner, "model", 2, dir, 0)
+
+	if _, _, err := cache.Embed(ctx, "alpha"); err != nil {
+		t.Fatal(err)
+	}
+	cache.EmbedBatch(ctx, []string{"beta", "gamma"})
+	if inner.calls != 3 {
+		t.Fatalf("%d strings embedded, want 3", inner.calls)
+	}
+
+	inner = &countingClient{}
+	cache = newCachingEmbeddingClient(inner, "model", 2, dir, 0)
+
+	vector, tokens, err := cache.Embed(ctx, "alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(vector, inner.vector("alpha")) || tokens != 0 {
+		t.Errorf("cached vector %v (%d tokens), want %v", vector, tokens, inner.vector("alpha"))
+	}
+
+	results, _ := cache.EmbedBatch(ctx, []string{"beta", "delta"})
+	if !slices.Equal(results[0].Vector, inner.vector("beta")) {
+		t.Errorf("cached vector %v, want %v", results[0].Vector, inner.vector("beta"))
+	}
+	if inner.calls != 1 {
+		t.Errorf("%d strings embedded after restart, want 1", inner.calls)
+	}
+
+	stats := cache.stats()
+	if stats.Entries != 4 || stats.Hits != 2 || stats.Misses != 1 || stats.Evictions != 0 {
+		t.Errorf("stats %+v, want 4 entries, 2 hits, 1 miss", stats)
+	}
+
+	// a different model misses the entries on disk
+	inner = &countingClient{}
+	cache = newCachingEmbeddingClient(inner, "other", 2, dir, 0)
+	if _, _, err := cache.Embed(ctx, "alpha"); err != nil {
+		t.Fatal(err)
+	}
+	if inner.calls != 1 {
+		t.Errorf("%d strings embedded for another model, want 1", inner.calls)
+	}
+}
+
+func TestCacheCorruptEntry(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	cache := newCachingEmbeddingClient(&countingClient{}, "model", 2, dir, 0)
+	if _, _, err := cache.Embed(ctx, "alpha"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cache.entryPath(cache.key("alpha")), []byte("bad"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	inner := &countingClient{}
+	cache = newCachingEmbeddingClient(inner, "model", 2, dir, 0)
+
+	vector, _, err := cache.Embed(ctx, "alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(vector, inner.vector("alpha")) || inner.calls != 1 {
+		t.Errorf("corrupt entry returned %v after %d calls", vector, inner.calls)
+	}
+	if stats := cache.stats(); stats.Hits != 0 || stats.Misses != 1 {
+		t.Errorf("stats %+v, want a single miss", stats)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	inner := &countingClient{}
+	cache := newCachingEmbeddingClient(inner, "model", 2, dir, 2)
+
+	for _, str := range []string{"a", "bb", "a", "ccc"} {
+		if _, _, err := cache.Embed(ctx, str); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// "bb" is the least recently used
+	if _, err := os.Stat(cache.entryPath(cache.key("bb"))); !os.IsNotExist(err) {
+		t.Errorf("evicted entry still on disk: %v", err)
+	}
+	for _, str := range []string{"a", "ccc"} {
+		if _, err := os.Stat(cache.entryPath(cache.key(str))); err != nil {
+			t.Errorf("entry %q not on disk: %v", str, err)
+		}
+	}
+
+	stats := cache.stats()
+	if stats.Entries != 2 || stats.Capacity != 2 || stats.Hits != 1 || stats.Misses != 3 || stats.Evictions != 1 {
+		t.Errorf("stats %+v, want 2 of 2 entries, 1 hit, 3 misses, 1 eviction", stats)
+	}
+
+	if _, _, err := cache.Embed(ctx, "bb"); err != nil {
+		t.Fatal(err)
+	}
+	if inner.calls != 4 {
+		t.Errorf("%d strings embedded, want evicted entry embedded again", inner.calls)
+	}
+
+	// a smaller cache keeps the most recently used entries on disk
+	cache = newCachingEmbeddingClient(&countingClient{}, "model", 2, dir, 1)
+	paths, err := filepath.Glob(filepath.Join(dir, "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := cache.stats(); len(paths) != 1 || stats.Entries != 1 || stats.Evictions != 0 {
+		t.Errorf("%d entries on disk, stats %+v, want 1 entry", len(paths), stats)
+	}
+}
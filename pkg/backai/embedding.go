@@ -10,28 +10,63 @@ import (
 )
 
 type EmbeddingClient interface {
-	// Embed converts a string into a vector of float64 values
-	Embed(str string) ([]float64, error)
+	// Embed converts a string into a vector of float64 values, also returning
+	// the number of tokens consumed
+	Embed(ctx context.Context, str string) ([]float64, int64, error)
+	// EmbedBatch converts many strings at once, using as few requests as the
+	// API limits allow. Failures are reported per input; the number of tokens
+	// consumed is returned as well.
+	EmbedBatch(ctx context.Context, strs []string) ([]BatchResult, int64)
 	seal()
 }
 
+// BatchResult is the outcome of embedding one input of a batch
+type BatchResult struct {
+	Vector []float64
+	Err    error
+}
+
+// EmbeddingClientOptions configures an EmbeddingClient
+type EmbeddingClientOptions struct {
+	// BaseURL overrides the API endpoint, e.g., for a proxy
+	BaseURL string
+	// Retry is the retry policy; DefaultRetryPolicy is used if zero
+	Retry RetryPolicy
+	// RequestsPerMinute limits the request rate; zero means no limit
+	RequestsPerMinute int
+}
+
 type embeddingClient struct {
 	client              *openai.Client
 	embeddingDimensions int
+	retry               RetryPolicy
+	limiter             *rateLimiter
 }
 
 func (e *embeddingClient) seal() {}
 
 // NewEmbeddingClient creates a new instance of the embedding client
-func NewEmbeddingClient(token string, embeddingDimensions int) EmbeddingClient {
+func NewEmbeddingClient(token string, embeddingDimensions int, options EmbeddingClientOptions) EmbeddingClient {
 	util.Assert(token != "", "NewClient empty token")
 	util.Assert(embeddingDimensions > 0, "NewClient non-positive embeddingDimensions")
 
-	client := openai.NewClient(option.WithAPIKey(token))
+	// retries are handled by withRetries, which also applies the rate limit
+	requestOptions := []option.RequestOption{option.WithAPIKey(token), option.WithMaxRetries(0)}
+	if options.BaseURL != "" {
+		requestOptions = append(requestOptions, option.WithBaseURL(options.BaseURL))
+	}
+	client := openai.NewClient(requestOptions...)
+
+	retry := options.Retry
+	if retry == (RetryPolicy{}) {
+		retry = DefaultRetryPolicy
+	}
 
 	return &embeddingClient{
 		client:              &client,
 		embeddingDimensions: embeddingDimensions,
+		retry:               retry,
+		limiter:             newRateLimiter(options.RequestsPerMinute),
 	}
 }
 
@@ -50,25 +85,107 @@ func splitTextIntoChunks(text string, chunkSize int) *[]string {
 	return &chunks
 }
 
-func (c *embeddingClient) Embed(str string) ([]float64, error) {
+// embeddingModel is the model used for all embeddings
+const embeddingModel = openai.EmbeddingModelTextEmbedding3Small
+
+func (c *embeddingClient) Embed(ctx context.Context, str string) ([]float64, int64, error) {
 	util.Assert(str != "", "embed empty string")
 
 	strings := *splitTextIntoChunks(str, 512)
 
-	embedding, err := c.client.Embeddings.New(context.TODO(), openai.EmbeddingNewParams{
-		Input:      openai.EmbeddingNewParamsInputUnion{OfArrayOfStrings: strings},
-		Model:      openai.EmbeddingModelTextEmbedding3Small,
-		Dimensions: openai.Opt(int64(c.embeddingDimensions)),
+	var embedding *openai.CreateEmbeddingResponse
+	err := withRetries(ctx, c.retry, c.limiter, func(ctx context.Context) error {
+		var err error
+		embedding, err = c.client.Embeddings.New(ctx, openai.EmbeddingNewParams{
+			Input:      openai.EmbeddingNewParamsInputUnion{OfArrayOfStrings: strings},
+			Model:      embeddingModel,
+			Dimensions: openai.Opt(int64(c.embeddingDimensions)),
+		})
+		return err
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create embedding: %v", err)
+		return nil, 0, fmt.Errorf("failed to create embedding: %w", err)
 	}
 
 	if len(embedding.Data) == 0 {
-		return nil, fmt.Errorf("no embedding data returned")
+		return nil, 0, fmt.Errorf("no embedding data returned")
 	}
 
 	vector := embedding.Data[0].Embedding
 
-	return vector, nil
+	return vector, embedding.Usage.PromptTokens, nil
+}
+
+// limits of a single embeddings request
+const (
+	maxBatchInputs = 2048
+	maxBatchTokens = 250000
+)
+
+func (c *embeddingClient) EmbedBatch(ctx context.Context, strs []string) ([]BatchResult, int64) {
+	results := make([]BatchResult, len(strs))
+	var tokens int64
+
+	// as in Embed, every string is split into chunks and the vector of its
+	// first chunk is used
+	var inputs []string
+	owners := make(map[int]int)
+	batchTokens := 0
+
+	flush := func() {
+		if len(inputs) == 0 {
+			return
+		}
+
+		var embedding *openai.CreateEmbeddingResponse
+		err := withRetries(ctx, c.retry, c.limiter, func(ctx context.Context) error {
+			var err error
+			embedding, err = c.client.Embeddings.New(ctx, openai.EmbeddingNewParams{
+				Input:      openai.EmbeddingNewParamsInputUnion{OfArrayOfStrings: inputs},
+				Model:      embeddingModel,
+				Dimensions: openai.Opt(int64(c.embeddingDimensions)),
+			})
+			return err
+		})
+
+		if err == nil {
+			tokens += embedding.Usage.PromptTokens
+			for _, data := range embedding.Data {
+				if i, ok := owners[int(data.Index)]; ok {
+					results[i].Vector = data.Embedding
+				}
+			}
+		}
+
+		for _, i := range owners {
+			switch {
+			case err != nil:
+				results[i].Err = fmt.Errorf("failed to create embedding: %w", err)
+			case results[i].Vector == nil:
+				results[i].Err = fmt.Errorf("no embedding data returned")
+			}
+		}
+
+		inputs = nil
+		owners = make(map[int]int)
+		batchTokens = 0
+	}
+
+	for i, str := range strs {
+		util.Assert(str != "", "EmbedBatch empty string")
+
+		chunks := *splitTextIntoChunks(str, 512)
+		size := estimateTokens(str)
+
+		if len(inputs)+len(chunks) > maxBatchInputs || batchTokens+size > maxBatchTokens {
+			flush()
+		}
+
+		owners[len(inputs)] = i
+		inputs = append(inputs, chunks...)
+		batchTokens += size
+	}
+	flush()
+
+	return results, tokens
 }
@@ -0,0 +1,330 @@
+// retries, timeouts and rate limiting for API calls
+
+package backai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+	lingopenai "github.com/vasilisp/lingograph/openai"
+	"github.com/vasilisp/wikai/internal/util"
+)
+
+var (
+	// ErrRateLimited is returned when the API keeps rejecting requests with
+	// 429 after all retries
+	ErrRateLimited = errors.New("rate limited by the API")
+	// ErrUnavailable is returned when the API cannot be reached or keeps
+	// failing with server errors
+	ErrUnavailable = errors.New("API unavailable")
+	// ErrTimeout is returned when a request does not complete in time
+	ErrTimeout = errors.New("API request timed out")
+)
+
+// APIError describes a failed API call; it unwraps to one of ErrRateLimited,
+// ErrUnavailable or ErrTimeout, and to the underlying error
+type APIError struct {
+	Kind error
+	// RetryAfter is the delay suggested by the API, if any
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+}
+
+func (e *APIError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// RetryPolicy configures how failed API calls are retried
+type RetryPolicy struct {
+	// MaxRetries is the number of retries after the first attempt
+	MaxRetries int
+	// BaseDelay is the delay before the first retry; it doubles on every
+	// subsequent retry, up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Timeout bounds each attempt; zero means no per-attempt timeout
+	Timeout time.Duration
+}
+
+// DefaultRetryPolicy is used when no policy is configured
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 4,
+	BaseDelay:  500 * time.Millisecond,
+	MaxDelay:   30 * time.Second,
+	Timeout:    30 * time.Second,
+}
+
+// classify wraps err in an APIError if it is retryable, returning nil
+// otherwise
+func classify(err error) *APIError {
+	var apiErr *openai.Error
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.StatusCode == http.StatusTooManyRequests:
+			return &APIError{Kind: ErrRateLimited, RetryAfter: retryAfter(apiErr.Response), Err: err}
+		case apiErr.StatusCode == http.StatusRequestTimeout:
+			return &APIError{Kind: ErrTimeout, Err: err}
+		case apiErr.StatusCode >= 500:
+			return &APIError{Kind: ErrUnavailable, RetryAfter: retryAfter(apiErr.Response), Err: err}
+		}
+		return nil
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &APIError{Kind: ErrTimeout, Err: err}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return &APIError{Kind: ErrTimeout, Err: err}
+		}
+		return &APIError{Kind: ErrUnavailable, Err: err}
+	}
+
+	return nil
+}
+
+// retryAfter parses the Retry-After headers of resp, in either of the forms
+// used by the API
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+
+	if ms, err := strconv.ParseFloat(resp.Header.Get("Retry-After-Ms"), 64); err == nil && ms > 0 {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+
+	value := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+
+	return 0
+}
+
+// backoff returns the delay before retry number attempt (starting at 0), with
+// full jitter
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << attempt
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	return time.Duration(rand.Int64N(int64(delay) + 1))
+}
+
+// withRetries calls fn until it succeeds, fails with a non-retryable error,
+// or the retries are exhausted. Each attempt waits for the limiter and runs
+// under the policy timeout.
+func withRetries(ctx context.Context, policy RetryPolicy, limiter *rateLimiter, fn func(context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		if err := limiter.wait(ctx); err != nil {
+			return &APIError{Kind: ErrTimeout, Err: err}
+		}
+
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if policy.Timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, policy.Timeout)
+		}
+		err := fn(attemptCtx)
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+
+		apiErr := classify(err)
+		if apiErr == nil {
+			return err
+		}
+
+		if ctx.Err() != nil || attempt >= policy.MaxRetries {
+			return apiErr
+		}
+
+		if apiErr.RetryAfter > policy.MaxDelay {
+			// not worth waiting, let the caller report it
+			return apiErr
+		}
+		delay := max(apiErr.RetryAfter, policy.backoff(attempt))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return apiErr
+		case <-timer.C:
+		}
+	}
+}
+
+// rateLimiter spaces requests evenly; a nil rateLimiter does not limit
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{interval: time.Minute / time.Duration(perMinute)}
+}
+
+// wait blocks until the next request may be sent, or ctx is done
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return ctx.Err()
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	slot := l.next
+	if slot.Before(now) {
+		slot = now
+	}
+	l.next = slot.Add(l.interval)
+	l.mu.Unlock()
+
+	delay := time.Until(slot)
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// chatCompletionsPath ends the URL of the chat completion requests
+const chatCompletionsPath = "/chat/completions"
+
+// retryTransport applies a retry policy and a rate limit to the chat
+// completion requests going through it, and passes other requests to base
+// unchanged. The final response carries X-Should-Retry: false, so that the
+// API client does not retry on top of the policy.
+type retryTransport struct {
+	base    http.RoundTripper
+	policy  RetryPolicy
+	limiter *rateLimiter
+}
+
+// newChatHTTPClient returns a client whose chat completions go through the
+// policy and the limiter
+func newChatHTTPClient(policy RetryPolicy, limiter *rateLimiter) *http.Client {
+	return &http.Client{
+		Transport: &retryTransport{base: http.DefaultTransport, policy: policy, limiter: limiter},
+	}
+}
+
+// newChatClient creates a lingograph client sending its requests through
+// httpClient. lingograph creates its API client without options, so the
+// option is added to the chat service of the API client it wraps.
+func newChatClient(apiKey string, httpClient *http.Client) lingopenai.Client {
+	client := lingopenai.NewClient(apiKey)
+
+	field := reflect.ValueOf(client).Elem().FieldByName("client")
+	util.Assert(field.IsValid() && field.Type() == reflect.TypeOf((*openai.Client)(nil)), "newChatClient unexpected lingograph client")
+
+	inner := (*openai.Client)(field.UnsafePointer())
+	inner.Chat.Completions.Options = append(inner.Chat.Completions.Options, option.WithHTTPClient(httpClient))
+
+	return client
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(req.URL.Path, chatCompletionsPath) || (req.Body != nil && req.GetBody == nil) {
+		return t.base.RoundTrip(req)
+	}
+
+	var res *http.Response
+	err := withRetries(req.Context(), t.policy, t.limiter, func(ctx context.Context) error {
+		res = nil
+
+		attempt := req.Clone(ctx)
+		if req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return err
+			}
+			attempt.Body = body
+		}
+
+		response, err := t.base.RoundTrip(attempt)
+		if err != nil {
+			return err
+		}
+
+		// the body is read within the attempt, whose context ends with it
+		body, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return err
+		}
+		response.Body = io.NopCloser(bytes.NewReader(body))
+		res = response
+
+		if res.StatusCode >= http.StatusBadRequest {
+			return &openai.Error{StatusCode: res.StatusCode, Request: attempt, Response: res}
+		}
+		return nil
+	})
+
+	if err == nil {
+		return res, nil
+	}
+
+	if res == nil {
+		// no response to pass on; the error is reported as one, so that it is
+		// not retried either
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, ErrTimeout) {
+			status = http.StatusRequestTimeout
+		}
+		message, _ := json.Marshal(err.Error())
+		res = &http.Response{
+			Status:     http.StatusText(status),
+			StatusCode: status,
+			Proto:      req.Proto,
+			ProtoMajor: req.ProtoMajor,
+			ProtoMinor: req.ProtoMinor,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(fmt.Sprintf(`{"error":{"message":%s,"type":"wikai"}}`, message))),
+			Request:    req,
+		}
+	}
+
+	res.Header.Set("X-Should-Retry", "false")
+	return res, nil
+}
@@ -0,0 +1,397 @@
+package backai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vasilisp/lingograph"
+	lingopenai "github.com/vasilisp/lingograph/openai"
+)
+
+const testEmbeddingResponse = `{"object":"list","data":[{"object":"embedding","index":0,"embedding":[0.1,0.2,0.3]}],"model":"text-embedding-3-small","usage":{"prompt_tokens":3,"total_tokens":3}}`
+
+// apiStandIn serves the embeddings endpoint, answering the nth request, from
+// 0, with the status handle returns; 200 is a valid embedding
+func apiStandIn(t *testing.T, handle func(n int, w http.ResponseWriter, r *http.Request) int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1)) - 1
+		status := handle(n, w, r)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			fmt.Fprint(w, testEmbeddingResponse)
+		} else {
+			fmt.Fprintf(w, `{"error":{"message":"status %d","type":"test"}}`, status)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func testClient(server *httptest.Server, policy RetryPolicy, perMinute int) EmbeddingClient {
+	return NewEmbeddingClient("test", 3, EmbeddingClientOptions{
+		BaseURL:           server.URL + "/",
+		Retry:             policy,
+		RequestsPerMinute: perMinute,
+	})
+}
+
+var fastPolicy = RetryPolicy{
+	MaxRetries: 3,
+	BaseDelay:  time.Millisecond,
+	MaxDelay:   time.Second,
+	Timeout:    5 * time.Second,
+}
+
+func TestRetryAfter(t *testing.T) {
+	server, requests := apiStandIn(t, func(n int, w http.ResponseWriter, r *http.Request) int {
+		if n == 0 {
+			w.Header().Set("Retry-After", "0.2")
+			return http.StatusTooManyRequests
+		}
+		return http.StatusOK
+	})
+
+	start := time.Now()
+	vector, tokens, err := testClient(server, fastPolicy, 0).Embed(context.Background(), "hello")
+	if err != nil {
+		t.Fatalf("Embed: %v", err)
+	}
+
+	if len(vector) != 3 || tokens != 3 {
+		t.Errorf("got %d dimensions and %d tokens, want 3 and 3", len(vector), tokens)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("got %d requests, want 2", got)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("retried after %v, before Retry-After", elapsed)
+	}
+}
+
+func TestServerErrorBackoff(t *testing.T) {
+	server, requests := apiStandIn(t, func(n int, w http.ResponseWriter, r *http.Request) int {
+		if n < 2 {
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	})
+
+	if _, _, err := testClient(server, fastPolicy, 0).Embed(context.Background(), "hello"); err != nil {
+		t.Fatalf("Embed: %v", err)
+	}
+
+	if got := requests.Load(); got != 3 {
+		t.Errorf("got %d requests, want 3", got)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	for attempt, bound := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	} {
+		for range 100 {
+			if delay := policy.backoff(attempt); delay < 0 || delay > bound {
+				t.Fatalf("backoff(%d) = %v, want within [0, %v]", attempt, delay, bound)
+			}
+		}
+	}
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	for _, test := range []struct {
+		status int
+		kind   error
+	}{
+		{http.StatusTooManyRequests, ErrRateLimited},
+		{http.StatusServiceUnavailable, ErrUnavailable},
+	} {
+		t.Run(http.StatusText(test.status), func(t *testing.T) {
+			server, requests := apiStandIn(t, func(n int, w http.ResponseWriter, r *http.Request) int {
+				return test.status
+			})
+
+			policy := fastPolicy
+			policy.MaxRetries = 2
+
+			_, _, err := testClient(server, policy, 0).Embed(context.Background(), "hello")
+			if !errors.Is(err, test.kind) {
+				t.Errorf("got error %v, want %v", err, test.kind)
+			}
+
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Errorf("got error %T, want *APIError", err)
+			}
+
+			if got := requests.Load(); got != 3 {
+				t.Errorf("got %d requests, want 3", got)
+			}
+		})
+	}
+}
+
+func TestNonRetryableError(t *testing.T) {
+	server, requests := apiStandIn(t, func(n int, w http.ResponseWriter, r *http.Request) int {
+		return http.StatusBadRequest
+	})
+
+	_, _, err := testClient(server, fastPolicy, 0).Embed(context.Background(), "hello")
+	if err == nil {
+		t.Fatal("Embed succeeded on 400")
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		t.Errorf("got retryable error %v for 400", err)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server, requests := apiStandIn(t, func(n int, w http.ResponseWriter, r *http.Request) int {
+		if n == 0 {
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+		}
+		return http.StatusOK
+	})
+	// cleanups run in reverse, so the hanging handler returns before the
+	// server is closed
+	t.Cleanup(func() { close(release) })
+
+	policy := fastPolicy
+	policy.Timeout = 100 * time.Millisecond
+	policy.MaxRetries = 0
+
+	start := time.Now()
+	_, _, err := testClient(server, policy, 0).Embed(context.Background(), "hello")
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("got error %v, want %v", err, ErrTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("timed out after %v", elapsed)
+	}
+
+	// a timed out attempt is retried
+	policy.MaxRetries = 1
+	requests.Store(0)
+	if _, _, err := testClient(server, policy, 0).Embed(context.Background(), "hello"); err != nil {
+		t.Errorf("Embed after timeout: %v", err)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("got %d requests, want 2", got)
+	}
+}
+
+func TestRateLimiterSpacing(t *testing.T) {
+	var mu sync.Mutex
+	var stamps []time.Time
+	server, _ := apiStandIn(t, func(n int, w http.ResponseWriter, r *http.Request) int {
+		mu.Lock()
+		stamps = append(stamps, time.Now())
+		mu.Unlock()
+		return http.StatusOK
+	})
+
+	// one request every 100ms
+	client := testClient(server, fastPolicy, 600)
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := client.Embed(context.Background(), "hello"); err != nil {
+				t.Errorf("Embed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(stamps) != 4 {
+		t.Fatalf("got %d requests, want 4", len(stamps))
+	}
+	if elapsed := stamps[3].Sub(stamps[0]); elapsed < 250*time.Millisecond {
+		t.Errorf("4 requests within %v, want them 100ms apart", elapsed)
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	limiter := newRateLimiter(1)
+	if err := limiter.wait(context.Background()); err != nil {
+		t.Fatalf("first wait: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := limiter.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v waiting for the next minute, want deadline exceeded", err)
+	}
+}
+
+// chatStandIn serves any path, answering the nth request, from 0, with the
+// status handle returns
+func chatStandIn(t *testing.T, handle func(n int, r *http.Request) int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1)) - 1
+		if body, _ := io.ReadAll(r.Body); string(body) != `{"model":"test"}` {
+			t.Errorf("request %d has body %q", n, body)
+		}
+		w.WriteHeader(handle(n, r))
+		fmt.Fprintf(w, `{"n":%d}`, n)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func chatClient(policy RetryPolicy) *http.Client {
+	return newChatHTTPClient(policy, nil)
+}
+
+func post(t *testing.T, client *http.Client, url string) (*http.Response, string) {
+	t.Helper()
+
+	res, err := client.Post(url, "application/json", strings.NewReader(`{"model":"test"}`))
+	if err != nil {
+		t.Fatalf("POST %s: %v", url, err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	return res, string(body)
+}
+
+func TestChatRetries(t *testing.T) {
+	server, requests := chatStandIn(t, func(n int, r *http.Request) int {
+		if n < 2 {
+			return http.StatusTooManyRequests
+		}
+		return http.StatusOK
+	})
+
+	res, body := post(t, chatClient(fastPolicy), server.URL+chatCompletionsPath)
+	if res.StatusCode != http.StatusOK || body != `{"n":2}` {
+		t.Errorf("got %d %s, want the third response", res.StatusCode, body)
+	}
+	if got := requests.Load(); got != 3 {
+		t.Errorf("got %d requests, want 3", got)
+	}
+}
+
+func TestChatRetriesExhausted(t *testing.T) {
+	server, requests := chatStandIn(t, func(n int, r *http.Request) int {
+		return http.StatusServiceUnavailable
+	})
+
+	policy := fastPolicy
+	policy.MaxRetries = 1
+
+	res, body := post(t, chatClient(policy), server.URL+chatCompletionsPath)
+	if res.StatusCode != http.StatusServiceUnavailable || body != `{"n":1}` {
+		t.Errorf("got %d %s, want the last response", res.StatusCode, body)
+	}
+	if res.Header.Get("X-Should-Retry") != "false" {
+		t.Error("the client may retry the final response")
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("got %d requests, want 2", got)
+	}
+}
+
+func TestChatTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server, _ := chatStandIn(t, func(n int, r *http.Request) int {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+		return http.StatusOK
+	})
+	t.Cleanup(func() { close(release) })
+
+	policy := fastPolicy
+	policy.Timeout = 100 * time.Millisecond
+	policy.MaxRetries = 0
+
+	res, _ := post(t, chatClient(policy), server.URL+chatCompletionsPath)
+	if res.StatusCode != http.StatusRequestTimeout || res.Header.Get("X-Should-Retry") != "false" {
+		t.Errorf("got %d, want a final %d", res.StatusCode, http.StatusRequestTimeout)
+	}
+}
+
+func TestChatPolicyOtherPaths(t *testing.T) {
+	server, requests := chatStandIn(t, func(n int, r *http.Request) int {
+		return http.StatusTooManyRequests
+	})
+
+	res, _ := post(t, chatClient(fastPolicy), server.URL+"/other")
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("X-Should-Retry") != "" {
+		t.Errorf("got %d, want the response untouched", res.StatusCode)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+}
+
+func TestChatClient(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("OPENAI_BASE_URL", server.URL)
+
+	policy := fastPolicy
+	policy.MaxRetries = 0
+
+	client := newChatClient("key", newChatHTTPClient(policy, nil))
+	actor := lingopenai.NewActor(client, chatModel, "system prompt", nil)
+	pipeline := lingograph.Chain(lingograph.UserPrompt("hello", false), actor.Pipeline(nil, false, 1))
+
+	if err := pipeline.Execute(lingograph.NewChat()); err == nil {
+		t.Error("chat succeeded against a failing API")
+	}
+
+	// the API client would retry on its own, were the policy not applied
+	if got := requests.Load(); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+	if http.DefaultClient.Transport != nil {
+		t.Error("http.DefaultClient modified")
+	}
+}
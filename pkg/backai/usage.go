@@ -0,0 +1,369 @@
+// token usage and cost accounting
+
+package backai
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/vasilisp/lingograph"
+	"github.com/vasilisp/lingograph/pkg/slicev"
+	"github.com/vasilisp/lingograph/store"
+	"github.com/vasilisp/wikai/internal/util"
+	"github.com/vasilisp/wikai/pkg/api"
+)
+
+// Operation identifies what a model call was made for
+type Operation string
+
+const (
+	OpSearch    Operation = "search"
+	OpSummarize Operation = "summarize"
+	OpWrite     Operation = "write"
+	OpIndex     Operation = "index"
+	OpTopics    Operation = "topics"
+)
+
+// ErrSpendingCapReached is returned by Query when the daily spending cap has
+// been reached
+var ErrSpendingCapReached = errors.New("daily spending cap reached")
+
+// price in USD per million tokens
+type price struct {
+	input  float64
+	output float64
+}
+
+var prices = map[string]price{
+	"gpt-4.1":                {input: 2.00, output: 8.00},
+	"gpt-4.1-mini":           {input: 0.40, output: 1.60},
+	"gpt-4.1-nano":           {input: 0.10, output: 0.40},
+	"text-embedding-3-small": {input: 0.02},
+}
+
+func cost(model string, promptTokens, completionTokens int64) float64 {
+	p, ok := prices[model]
+	if !ok {
+		log.Printf("no price for model %s", model)
+		return 0
+	}
+
+	return (float64(promptTokens)*p.input + float64(completionTokens)*p.output) / 1e6
+}
+
+// days of per-day and per-chat counters to keep
+const usageRetentionDays = 90
+
+const dayFormat = "2006-01-02"
+
+// usageSaveDelay is how long the counters may go unsaved after a change, so
+// that bulk indexing does not rewrite the file for every embedding
+const usageSaveDelay = 5 * time.Second
+
+type usageTracker struct {
+	mu       sync.Mutex
+	path     string
+	dailyCap float64
+	stats    api.UsageStats
+	// now tells the day of the counters; time.Now but in tests
+	now func() time.Time
+	// saveTimer is pending while there are unsaved changes
+	saveTimer *time.Timer
+	// saveMu serialises writes of the file; it is taken before mu
+	saveMu    sync.Mutex
+	saveError bool
+}
+
+func newUsageTracker(path string, dailyCap float64) *usageTracker {
+	tracker := usageTracker{
+		path:     path,
+		dailyCap: dailyCap,
+		now:      time.Now,
+		stats: api.UsageStats{
+			ByChat:      make(map[string]api.ChatUsage),
+			ByOperation: make(map[string]api.Usage),
+			ByDay:       make(map[string]api.Usage),
+		},
+	}
+
+	if path == "" {
+		return &tracker
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("failed to read usage from %s: %v", path, err)
+		}
+		return &tracker
+	}
+
+	var stats api.UsageStats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		log.Printf("failed to parse usage from %s: %v", path, err)
+		return &tracker
+	}
+
+	for k, v := range stats.ByChat {
+		tracker.stats.ByChat[k] = v
+	}
+	for k, v := range stats.ByOperation {
+		tracker.stats.ByOperation[k] = v
+	}
+	for k, v := range stats.ByDay {
+		tracker.stats.ByDay[k] = v
+	}
+
+	return &tracker
+}
+
+func addUsage(a api.Usage, b api.Usage) api.Usage {
+	return api.Usage{
+		Requests:                  a.Requests + b.Requests,
+		PromptTokens:              a.PromptTokens + b.PromptTokens,
+		CompletionTokens:          a.CompletionTokens + b.CompletionTokens,
+		EstimatedPromptTokens:     a.EstimatedPromptTokens + b.EstimatedPromptTokens,
+		EstimatedCompletionTokens: a.EstimatedCompletionTokens + b.EstimatedCompletionTokens,
+		Cost:                      a.Cost + b.Cost,
+	}
+}
+
+// record accounts for a single model call; chatID may be empty for calls made
+// outside a chat (e.g., indexing). The tokens are estimates rather than the
+// counts reported by the API if estimated is set.
+func (t *usageTracker) record(op Operation, chatID string, model string, promptTokens, completionTokens int64, estimated bool) {
+	util.Assert(t != nil, "record nil tracker")
+
+	usage := api.Usage{
+		Requests: 1,
+		Cost:     cost(model, promptTokens, completionTokens),
+	}
+	if estimated {
+		usage.EstimatedPromptTokens = promptTokens
+		usage.EstimatedCompletionTokens = completionTokens
+	} else {
+		usage.PromptTokens = promptTokens
+		usage.CompletionTokens = completionTokens
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	day := t.now().Format(dayFormat)
+
+	t.stats.ByOperation[string(op)] = addUsage(t.stats.ByOperation[string(op)], usage)
+	t.stats.ByDay[day] = addUsage(t.stats.ByDay[day], usage)
+	if chatID != "" {
+		chatUsage := t.stats.ByChat[chatID]
+		chatUsage.Usage = addUsage(chatUsage.Usage, usage)
+		chatUsage.LastDay = day
+		t.stats.ByChat[chatID] = chatUsage
+	}
+
+	t.prune()
+	t.scheduleSave()
+}
+
+// prune drops counters older than the retention period; must be called with
+// the lock held
+func (t *usageTracker) prune() {
+	cutoff := t.now().AddDate(0, 0, -usageRetentionDays).Format(dayFormat)
+
+	for day := range t.stats.ByDay {
+		if day < cutoff {
+			delete(t.stats.ByDay, day)
+		}
+	}
+	for chatID, usage := range t.stats.ByChat {
+		if usage.LastDay < cutoff {
+			delete(t.stats.ByChat, chatID)
+		}
+	}
+}
+
+// scheduleSave persists the counters after usageSaveDelay, together with any
+// other change made meanwhile; must be called with the lock held
+func (t *usageTracker) scheduleSave() {
+	if t.path == "" || t.saveTimer != nil {
+		return
+	}
+
+	t.saveTimer = time.AfterFunc(usageSaveDelay, t.save)
+}
+
+// flush saves the counters now if they have unsaved changes, e.g. on
+// shutdown, or waits for the save in progress
+func (t *usageTracker) flush() {
+	t.mu.Lock()
+	pending := t.saveTimer != nil
+	if pending {
+		t.saveTimer.Stop()
+	}
+	t.mu.Unlock()
+
+	if pending {
+		t.save()
+		return
+	}
+
+	t.saveMu.Lock()
+	t.saveMu.Unlock()
+}
+
+// save persists the counters
+func (t *usageTracker) save() {
+	// held from the snapshot to the write, so that saves land in order
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+
+	t.mu.Lock()
+	t.saveTimer = nil
+	data, err := json.Marshal(t.stats)
+	t.mu.Unlock()
+
+	if err != nil {
+		log.Printf("failed to marshal usage: %v", err)
+		return
+	}
+
+	err = writeJSONFile(t.path, json.RawMessage(data))
+	if err != nil && !t.saveError {
+		// log once, the tracker keeps counting in memory
+		log.Printf("failed to save usage to %s: %v", t.path, err)
+	}
+	t.saveError = err != nil
+}
+
+func writeJSONFile(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write: %v", err)
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// checkCap returns ErrSpendingCapReached if today's cost is at or above the
+// daily cap
+func (t *usageTracker) checkCap() error {
+	if t.dailyCap <= 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	today := t.stats.ByDay[t.now().Format(dayFormat)]
+	if today.Cost >= t.dailyCap {
+		return fmt.Errorf("%w: spent $%.4f of $%.4f", ErrSpendingCapReached, today.Cost, t.dailyCap)
+	}
+
+	return nil
+}
+
+func (t *usageTracker) snapshot() api.UsageStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := api.UsageStats{
+		ByChat:           make(map[string]api.ChatUsage, len(t.stats.ByChat)),
+		ByOperation:      make(map[string]api.Usage, len(t.stats.ByOperation)),
+		ByDay:            make(map[string]api.Usage, len(t.stats.ByDay)),
+		DailySpendingCap: t.dailyCap,
+	}
+	for k, v := range t.stats.ByChat {
+		stats.ByChat[k] = v
+	}
+	for k, v := range t.stats.ByOperation {
+		stats.ByOperation[k] = v
+	}
+	for k, v := range t.stats.ByDay {
+		stats.ByDay[k] = v
+	}
+
+	return stats
+}
+
+// The chat pipelines are driven by lingograph, which does not expose the
+// usage reported by the API. Chat tokens are therefore estimated from the
+// messages each model call sees and produces, and from the arguments of the
+// tool calls it makes, which the tools count as they run.
+
+// countArgs adds the estimated tokens of the arguments of a tool call to the
+// output of the model calls since the last probeStart
+func countArgs(r store.Store, toolTokensVar store.Var[int64], args any) {
+	data, err := json.Marshal(args)
+	if err != nil {
+		return
+	}
+
+	tokens, _ := store.Get(r, toolTokensVar)
+	store.Set(r, toolTokensVar, tokens+int64(estimateTokens(string(data))))
+}
+
+// probeStart returns a pipeline that marks the current position in the chat
+// history
+func probeStart(markVar store.Var[int], toolTokensVar store.Var[int64]) lingograph.Pipeline {
+	return lingograph.NewActorUnsafe(lingograph.Assistant, func(history slicev.RO[lingograph.Message], r store.Store) ([]lingograph.Message, error) {
+		store.Set(r, markVar, history.Len())
+		store.Set(r, toolTokensVar, 0)
+		return nil, nil
+	}).Pipeline(nil, false, 1)
+}
+
+// probeEnd returns a pipeline that records estimated usage for the model
+// calls made since the matching probeStart. The operation is taken from opVar
+// if a tool set it, defaulting to op.
+func probeEnd(tracker *usageTracker, systemPrompt string, op Operation, markVar store.Var[int], toolTokensVar store.Var[int64], opVar store.Var[Operation], chatIDVar store.Var[string]) lingograph.Pipeline {
+	systemTokens := int64(estimateTokens(systemPrompt))
+
+	return lingograph.NewActorUnsafe(lingograph.Assistant, func(history slicev.RO[lingograph.Message], r store.Store) ([]lingograph.Message, error) {
+		mark, _ := store.Get(r, markVar)
+		chatID, _ := store.Get(r, chatIDVar)
+		callOp := op
+		if toolOp, ok := store.Get(r, opVar); ok && toolOp != "" {
+			callOp = toolOp
+			store.Set(r, opVar, "")
+		}
+
+		// the tool calls are not in the history; they are counted as the
+		// output of the first model call, which is the one making them unless
+		// the model chains tools
+		toolTokens, _ := store.Get(r, toolTokensVar)
+		store.Set(r, toolTokensVar, 0)
+
+		var contextTokens int64
+		for i := range mark {
+			contextTokens += int64(estimateTokens(history.At(i).Content))
+		}
+
+		// every assistant message is the output of one model call, which saw
+		// the system prompt and the whole history before it
+		for i := mark; i < history.Len(); i++ {
+			msg := history.At(i)
+			tokens := int64(estimateTokens(msg.Content))
+			if msg.Role == lingograph.Assistant {
+				tokens += toolTokens
+				toolTokens = 0
+				tracker.record(callOp, chatID, string(chatModel.ToOpenAI()), systemTokens+contextTokens, tokens, true)
+			}
+			contextTokens += tokens
+		}
+
+		return nil, nil
+	}).Pipeline(nil, false, 1)
+}
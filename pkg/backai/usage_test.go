@@ -0,0 +1,133 @@
+package backai
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vasilisp/wikai/pkg/api"
+)
+
+// testTracker returns a tracker saving to a temporary directory, at the
+// time now points to
+func testTracker(t *testing.T, dailyCap float64, now *time.Time) *usageTracker {
+	t.Helper()
+
+	tracker := newUsageTracker(filepath.Join(t.TempDir(), "usage.json"), dailyCap)
+	tracker.now = func() time.Time { return *now }
+	t.Cleanup(tracker.flush)
+
+	return tracker
+}
+
+func TestRecord(t *testing.T) {
+	now := time.Date(2025, 4, 24, 12, 0, 0, 0, time.UTC)
+	tracker := testTracker(t, 0, &now)
+
+	tracker.record(OpSearch, "chat", "gpt-4.1-mini", 1000, 500, true)
+	tracker.record(OpIndex, "", "text-embedding-3-small", 2000, 0, false)
+
+	stats := tracker.snapshot()
+
+	search := stats.ByOperation[string(OpSearch)]
+	if search.EstimatedPromptTokens != 1000 || search.EstimatedCompletionTokens != 500 || search.PromptTokens != 0 {
+		t.Errorf("search usage %+v, want estimated tokens only", search)
+	}
+	if index := stats.ByOperation[string(OpIndex)]; index.PromptTokens != 2000 || index.EstimatedPromptTokens != 0 {
+		t.Errorf("index usage %+v, want reported tokens only", index)
+	}
+
+	day := stats.ByDay["2025-04-24"]
+	want := cost("gpt-4.1-mini", 1000, 500) + cost("text-embedding-3-small", 2000, 0)
+	if day.Requests != 2 || day.Cost != want {
+		t.Errorf("day usage %+v, want 2 requests costing %f", day, want)
+	}
+
+	if chat := stats.ByChat["chat"]; chat.Requests != 1 || chat.LastDay != "2025-04-24" {
+		t.Errorf("chat usage %+v", chat)
+	}
+	if _, ok := stats.ByChat[""]; ok {
+		t.Error("usage outside a chat counted as a chat")
+	}
+}
+
+func TestCheckCap(t *testing.T) {
+	now := time.Date(2025, 4, 24, 23, 0, 0, 0, time.UTC)
+	// a million prompt tokens of gpt-4.1 cost $2
+	tracker := testTracker(t, 3, &now)
+
+	tracker.record(OpSearch, "", "gpt-4.1", 1_000_000, 0, false)
+	if err := tracker.checkCap(); err != nil {
+		t.Fatalf("checkCap under the cap: %v", err)
+	}
+
+	tracker.record(OpSearch, "", "gpt-4.1", 1_000_000, 0, false)
+	if err := tracker.checkCap(); !errors.Is(err, ErrSpendingCapReached) {
+		t.Fatalf("checkCap over the cap: %v", err)
+	}
+
+	// the cap is per day
+	now = now.Add(2 * time.Hour)
+	if err := tracker.checkCap(); err != nil {
+		t.Errorf("checkCap on the next day: %v", err)
+	}
+
+	stats := tracker.snapshot()
+	if len(stats.ByDay) != 1 || stats.ByDay["2025-04-24"].Cost != 4 {
+		t.Errorf("got days %v, want the first day only", stats.ByDay)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	tracker := testTracker(t, 0, &now)
+
+	tracker.record(OpSearch, "old", "gpt-4.1", 10, 10, true)
+	now = now.AddDate(0, 0, usageRetentionDays+1)
+	tracker.record(OpSearch, "new", "gpt-4.1", 10, 10, true)
+
+	stats := tracker.snapshot()
+	if _, ok := stats.ByDay["2025-01-01"]; ok || len(stats.ByDay) != 1 {
+		t.Errorf("got days %v, want the old day pruned", stats.ByDay)
+	}
+	if _, ok := stats.ByChat["old"]; ok || len(stats.ByChat) != 1 {
+		t.Errorf("got chats %v, want the old chat pruned", stats.ByChat)
+	}
+	// the operation totals are kept
+	if stats.ByOperation[string(OpSearch)].Requests != 2 {
+		t.Errorf("got %+v, want 2 requests", stats.ByOperation[string(OpSearch)])
+	}
+}
+
+func TestFlush(t *testing.T) {
+	now := time.Now()
+	tracker := testTracker(t, 1, &now)
+
+	tracker.record(OpSearch, "chat", "gpt-4.1", 100, 100, false)
+	if _, err := os.Stat(tracker.path); !os.IsNotExist(err) {
+		t.Fatalf("usage saved before the delay: %v", err)
+	}
+
+	tracker.flush()
+
+	data, err := os.ReadFile(tracker.path)
+	if err != nil {
+		t.Fatalf("usage not saved on flush: %v", err)
+	}
+	var saved api.UsageStats
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.ByOperation[string(OpSearch)].Requests != 1 {
+		t.Errorf("saved %+v", saved)
+	}
+
+	// the counters, and so the cap, survive a restart
+	restarted := newUsageTracker(tracker.path, 1)
+	if got := restarted.snapshot().ByDay[now.Format(dayFormat)]; got.Cost != tracker.snapshot().ByDay[now.Format(dayFormat)].Cost {
+		t.Errorf("restarted with %+v", got)
+	}
+}
@@ -9,28 +9,142 @@ import (
 	"time"
 )
 
+// Encoding is the storage format of a vector. Notes written before encodings
+// were introduced carry none and are float64.
+type Encoding string
+
+const (
+	Float64 Encoding = "float64"
+	Float32 Encoding = "float32"
+	// Int8 scales each vector so that its largest component maps to 127
+	Int8 Encoding = "int8"
+)
+
+// DefaultEncoding is used for new embeddings when none is configured; it is
+// lossless, so existing wikis keep their precision unless they opt in to a
+// smaller encoding
+const DefaultEncoding = Float64
+
+func ParseEncoding(s string) (Encoding, error) {
+	switch Encoding(s) {
+	case "":
+		return DefaultEncoding, nil
+	case Float64, Float32, Int8:
+		return Encoding(s), nil
+	}
+	return "", fmt.Errorf("unknown vector encoding %q", s)
+}
+
 type Embedding struct {
 	ID     string
 	Stamp  time.Time
 	Vector []float64
+	// Encoding is how Vector is stored when marshalled; empty means Float64
+	Encoding Encoding
 }
 
 type jsonEmbedding struct {
-	ID     string `json:"id"`
-	Stamp  int64  `json:"stamp"`
-	Vector string `json:"vector"`
+	ID       string   `json:"id"`
+	Stamp    int64    `json:"stamp"`
+	Encoding Encoding `json:"encoding,omitempty"`
+	Scale    float32  `json:"scale,omitempty"`
+	Vector   string   `json:"vector"`
+}
+
+// QuantizeInt8 maps v to int8 components, returning them with the scale that
+// maps them back
+func QuantizeInt8(v []float64) ([]int8, float32) {
+	maxAbs := 0.0
+	for _, x := range v {
+		maxAbs = max(maxAbs, math.Abs(x))
+	}
+
+	quantized := make([]int8, len(v))
+	if maxAbs == 0 {
+		return quantized, 0
+	}
+
+	scale := float32(maxAbs / 127)
+	for i, x := range v {
+		quantized[i] = int8(max(-127, min(127, math.Round(x/float64(scale)))))
+	}
+
+	return quantized, scale
+}
+
+// EncodeVector returns the bytes of v in the given encoding, together with
+// the scale for Int8
+func EncodeVector(v []float64, encoding Encoding) ([]byte, float32) {
+	switch encoding {
+	case Float32:
+		buf := make([]byte, len(v)*4)
+		for i, x := range v {
+			binary.LittleEndian.PutUint32(buf[i*4:], math.Float32bits(float32(x)))
+		}
+		return buf, 0
+	case Int8:
+		quantized, scale := QuantizeInt8(v)
+		buf := make([]byte, len(quantized))
+		for i, q := range quantized {
+			buf[i] = byte(q)
+		}
+		return buf, scale
+	}
+
+	buf := make([]byte, len(v)*8)
+	for i, x := range v {
+		binary.LittleEndian.PutUint64(buf[i*8:], math.Float64bits(x))
+	}
+	return buf, 0
+}
+
+// DecodeVector is the inverse of EncodeVector
+func DecodeVector(buf []byte, encoding Encoding, scale float32) ([]float64, error) {
+	switch encoding {
+	case Float32:
+		if len(buf)%4 != 0 {
+			return nil, fmt.Errorf("float32 vector of %d bytes", len(buf))
+		}
+		v := make([]float64, len(buf)/4)
+		for i := range v {
+			v[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(buf[i*4:])))
+		}
+		return v, nil
+	case Int8:
+		v := make([]float64, len(buf))
+		for i, b := range buf {
+			v[i] = float64(int8(b)) * float64(scale)
+		}
+		return v, nil
+	case "", Float64:
+		if len(buf)%8 != 0 {
+			return nil, fmt.Errorf("float64 vector of %d bytes", len(buf))
+		}
+		v := make([]float64, len(buf)/8)
+		for i := range v {
+			v[i] = math.Float64frombits(binary.LittleEndian.Uint64(buf[i*8:]))
+		}
+		return v, nil
+	}
+
+	return nil, fmt.Errorf("unknown vector encoding %q", encoding)
 }
 
 func (e Embedding) MarshalJSON() ([]byte, error) {
-	buf := make([]byte, len(e.Vector)*8)
-	for i, v := range e.Vector {
-		binary.LittleEndian.PutUint64(buf[i*8:], math.Float64bits(v))
+	encoding := e.Encoding
+	if encoding == Float64 {
+		// omitted, so that older versions can still read it
+		encoding = ""
 	}
 
+	buf, scale := EncodeVector(e.Vector, encoding)
+
 	temp := jsonEmbedding{
-		ID:     e.ID,
-		Stamp:  e.Stamp.Unix(),
-		Vector: base64.StdEncoding.EncodeToString(buf),
+		ID:       e.ID,
+		Stamp:    e.Stamp.Unix(),
+		Encoding: encoding,
+		Scale:    scale,
+		Vector:   base64.StdEncoding.EncodeToString(buf),
 	}
 
 	return json.Marshal(temp)
@@ -47,14 +161,17 @@ func (e *Embedding) UnmarshalJSON(data []byte) error {
 		return fmt.Errorf("failed to decode vector base64: %v", err)
 	}
 
-	vector := make([]float64, len(buf)/8)
-	for i := range vector {
-		bits := binary.LittleEndian.Uint64(buf[i*8:])
-		vector[i] = math.Float64frombits(bits)
+	vector, err := DecodeVector(buf, temp.Encoding, temp.Scale)
+	if err != nil {
+		return err
 	}
 
 	e.ID = temp.ID
 	e.Vector = vector
 	e.Stamp = time.Unix(temp.Stamp, 0)
+	e.Encoding = temp.Encoding
+	if e.Encoding == "" {
+		e.Encoding = Float64
+	}
 	return nil
 }
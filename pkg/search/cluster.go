@@ -0,0 +1,213 @@
+package search
+
+import (
+	"errors"
+	"math"
+	"math/rand/v2"
+	"sort"
+
+	"gonum.org/v1/gonum/floats"
+)
+
+// maxClusterIterations bounds the k-means iterations; clustering usually
+// settles long before
+const maxClusterIterations = 100
+
+// Cluster is a group of documents with similar embeddings; IDs are sorted
+// by their similarity to the centroid, most similar first
+type Cluster struct {
+	IDs []string
+}
+
+// DefaultClusters is the number of clusters for n documents when none is
+// given, the rule of thumb of sqrt(n/2)
+func DefaultClusters(n int) int {
+	return max(1, int(math.Round(math.Sqrt(float64(n)/2))))
+}
+
+// Cluster groups the documents keep accepts, nil for all, into at most k
+// clusters by spherical k-means, i.e. by cosine similarity. Initial centroids
+// are picked by k-means++ from seed, so that the same documents and seed
+// give the same clusters. Clusters are sorted by size, largest first.
+func (db *db) Cluster(k int, seed int64, keep func(id string) bool) ([]Cluster, error) {
+	if k <= 0 {
+		return nil, errors.New("number of clusters must be positive")
+	}
+
+	db.mu.RLock()
+	ids := make([]string, 0, len(db.rows))
+	for id, row := range db.rows {
+		if !row.empty() && row.norm > 0 && (keep == nil || keep(id)) {
+			ids = append(ids, id)
+		}
+	}
+	// map order is random; the seed alone must decide
+	sort.Strings(ids)
+
+	// documents embedded with other dimensions than the first are left out
+	kept := ids[:0]
+	vectors := make([][]float64, 0, len(ids))
+	for _, id := range ids {
+		row := db.rows[id]
+		v := row.vector()
+		if len(vectors) > 0 && len(v) != len(vectors[0]) {
+			continue
+		}
+		kept = append(kept, id)
+		vectors = append(vectors, floats.ScaleTo(make([]float64, len(v)), 1/row.norm, v))
+	}
+	ids = kept
+	db.mu.RUnlock()
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	k = min(k, len(ids))
+
+	rng := rand.New(rand.NewPCG(uint64(seed), 0))
+	centroids := initCentroids(vectors, k, rng)
+
+	assignment := make([]int, len(vectors))
+	for i := range assignment {
+		assignment[i] = -1
+	}
+
+	for range maxClusterIterations {
+		changed := false
+		for i, v := range vectors {
+			if c := nearest(v, centroids); c != assignment[i] {
+				assignment[i] = c
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+
+		updateCentroids(vectors, assignment, centroids)
+	}
+
+	members := make([][]int, k)
+	for i, c := range assignment {
+		members[c] = append(members[c], i)
+	}
+
+	clusters := make([]Cluster, 0, k)
+	for c, indices := range members {
+		if len(indices) == 0 {
+			continue
+		}
+
+		sort.SliceStable(indices, func(a, b int) bool {
+			return floats.Dot(vectors[indices[a]], centroids[c]) > floats.Dot(vectors[indices[b]], centroids[c])
+		})
+
+		cluster := Cluster{IDs: make([]string, len(indices))}
+		for j, i := range indices {
+			cluster.IDs[j] = ids[i]
+		}
+		clusters = append(clusters, cluster)
+	}
+
+	sort.SliceStable(clusters, func(a, b int) bool {
+		return len(clusters[a].IDs) > len(clusters[b].IDs)
+	})
+
+	return clusters, nil
+}
+
+// initCentroids picks k of the unit vectors by k-means++: the first at
+// random, and each next one with probability proportional to the square of
+// its distance to the closest centroid picked so far
+func initCentroids(vectors [][]float64, k int, rng *rand.Rand) [][]float64 {
+	centroids := make([][]float64, 0, k)
+	centroids = append(centroids, clone(vectors[rng.IntN(len(vectors))]))
+
+	weights := make([]float64, len(vectors))
+	for len(centroids) < k {
+		total := 0.0
+		for i, v := range vectors {
+			d := 1 - floats.Dot(v, centroids[nearest(v, centroids)])
+			weights[i] = d * d
+			total += weights[i]
+		}
+
+		// every vector coincides with a centroid
+		if total <= 0 {
+			break
+		}
+
+		pick := rng.Float64() * total
+		i := 0
+		for ; i < len(weights)-1 && pick >= weights[i]; i++ {
+			pick -= weights[i]
+		}
+		centroids = append(centroids, clone(vectors[i]))
+	}
+
+	return centroids
+}
+
+// nearest returns the index of the centroid most similar to a unit vector
+func nearest(v []float64, centroids [][]float64) int {
+	best, bestSimilarity := 0, math.Inf(-1)
+	for c, centroid := range centroids {
+		if similarity := floats.Dot(v, centroid); similarity > bestSimilarity {
+			best, bestSimilarity = c, similarity
+		}
+	}
+	return best
+}
+
+// updateCentroids moves each centroid to the normalized mean of its
+// vectors; a centroid left without vectors takes over the vector farthest
+// from its own centroid
+func updateCentroids(vectors [][]float64, assignment []int, centroids [][]float64) {
+	counts := make([]int, len(centroids))
+	for c := range centroids {
+		for j := range centroids[c] {
+			centroids[c][j] = 0
+		}
+	}
+	for i, c := range assignment {
+		floats.Add(centroids[c], vectors[i])
+		counts[c]++
+	}
+
+	for c := range centroids {
+		if counts[c] == 0 {
+			continue
+		}
+		if norm := floats.Norm(centroids[c], 2); norm > 0 {
+			floats.Scale(1/norm, centroids[c])
+		}
+	}
+
+	for c := range centroids {
+		if counts[c] > 0 {
+			continue
+		}
+
+		farthest, farthestSimilarity := -1, math.Inf(1)
+		for i, v := range vectors {
+			if counts[assignment[i]] <= 1 {
+				continue
+			}
+			if similarity := floats.Dot(v, centroids[assignment[i]]); similarity < farthestSimilarity {
+				farthest, farthestSimilarity = i, similarity
+			}
+		}
+		if farthest < 0 {
+			continue
+		}
+
+		copy(centroids[c], vectors[farthest])
+		counts[assignment[farthest]]--
+		assignment[farthest] = c
+		counts[c] = 1
+	}
+}
+
+func clone(v []float64) []float64 {
+	return append([]float64(nil), v...)
+}
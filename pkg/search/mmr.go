@@ -0,0 +1,82 @@
+package search
+
+// DefaultMMRPool is how many of the most relevant results MMR re-ranks, if
+// Query.MMRPool is zero
+const DefaultMMRPool = 50
+
+// vector decodes the stored vector
+func (r row) vector() []float64 {
+	if r.f64 != nil {
+		return r.f64
+	}
+
+	if r.f32 != nil {
+		v := make([]float64, len(r.f32))
+		for i, x := range r.f32 {
+			v[i] = float64(x)
+		}
+		return v
+	}
+
+	v := make([]float64, len(r.i8))
+	for i, q := range r.i8 {
+		v[i] = float64(q) * float64(r.scale)
+	}
+	return v
+}
+
+// mmr re-ranks candidates, sorted by relevance, by maximal marginal
+// relevance: each pick maximises lambda times its similarity to the query
+// minus 1-lambda times its highest similarity to the earlier picks, so that
+// near-duplicates of a result rank below less similar results. At most n are
+// returned; distances stay those to the query.
+func mmr(candidates []Result, rows map[string]row, lambda float64, n int) []Result {
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+
+	vectors := make([][]float64, len(candidates))
+	norms := make([]float64, len(candidates))
+	for i, candidate := range candidates {
+		vectors[i] = rows[candidate.Path].vector()
+		norms[i] = rows[candidate.Path].norm
+	}
+
+	// maxSimilarity[i] is the highest similarity of candidate i to a pick
+	maxSimilarity := make([]float64, len(candidates))
+	picked := make([]bool, len(candidates))
+	results := make([]Result, 0, n)
+
+	for len(results) < n {
+		best, bestScore := -1, 0.0
+		for i, candidate := range candidates {
+			if picked[i] {
+				continue
+			}
+
+			score := lambda * (1 - candidate.Distance)
+			if len(results) > 0 {
+				score -= (1 - lambda) * maxSimilarity[i]
+			}
+			if best < 0 || score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+
+		picked[best] = true
+		results = append(results, candidates[best])
+
+		pickedRow := rows[candidates[best].Path]
+		for i := range candidates {
+			if picked[i] {
+				continue
+			}
+			similarity := 1 - pickedRow.distance(vectors[i], norms[i])
+			if len(results) == 1 || similarity > maxSimilarity[i] {
+				maxSimilarity[i] = similarity
+			}
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,62 @@
+package search
+
+import (
+	"errors"
+	"sort"
+)
+
+// Pair is two documents and the cosine similarity of their embeddings; A
+// sorts before B
+type Pair struct {
+	A          string
+	B          string
+	Similarity float64
+}
+
+func (db *db) SimilarPairs(minSimilarity float64) ([]Pair, error) {
+	if minSimilarity <= 0 || minSimilarity > 1 {
+		return nil, errors.New("minimum similarity must be in (0, 1]")
+	}
+
+	db.mu.RLock()
+	ids := make([]string, 0, len(db.rows))
+	for id, row := range db.rows {
+		if !row.empty() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	vectors := make([][]float64, len(ids))
+	norms := make([]float64, len(ids))
+	for i, id := range ids {
+		vectors[i] = db.rows[id].vector()
+		norms[i] = db.rows[id].norm
+	}
+	db.mu.RUnlock()
+
+	// brute-force, compare every pair once
+	pairs := make([]Pair, 0)
+	for i := range ids {
+		for j := i + 1; j < len(ids); j++ {
+			if norms[i] == 0 || norms[j] == 0 {
+				continue
+			}
+
+			dot := 0.0
+			for k, x := range vectors[i][:min(len(vectors[i]), len(vectors[j]))] {
+				dot += x * vectors[j][k]
+			}
+
+			if similarity := dot / (norms[i] * norms[j]); similarity >= minSimilarity {
+				pairs = append(pairs, Pair{A: ids[i], B: ids[j], Similarity: similarity})
+			}
+		}
+	}
+
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return pairs[i].Similarity > pairs[j].Similarity
+	})
+
+	return pairs, nil
+}
@@ -0,0 +1,192 @@
+package search
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/vasilisp/wikai/internal/util"
+	"gonum.org/v1/gonum/mat"
+)
+
+// Query selects documents and ranks them by their distance to a vector. The
+// filters are applied before distances are computed; zero fields do not
+// filter.
+type Query struct {
+	Vector []float64
+	// Prefix keeps the documents whose ID starts with it, e.g. "team/" for a
+	// namespace
+	Prefix string
+	// From and To bound the stamps of the documents; To is exclusive
+	From time.Time
+	To   time.Time
+	// Tags keeps the documents that have all of them
+	Tags []string
+	// Allow keeps only the listed documents, and Deny drops the listed ones
+	Allow []string
+	Deny  []string
+	// Keep, if set, is called for the documents that pass the other filters,
+	// with the database locked, so it must not use the database
+	Keep func(id string) bool
+	// MinSimilarity drops the documents whose cosine similarity to the vector
+	// is lower; zero or less keeps all
+	MinSimilarity float64
+	// MMR re-ranks the most relevant results by maximal marginal relevance,
+	// trading relevance for diversity by MMRLambda: 1 ranks by relevance
+	// alone, lower values push near-duplicates of better results down and 0
+	// ranks by diversity alone
+	MMR       bool
+	MMRLambda float64
+	// MMRPool is how many of the most relevant results MMR re-ranks, whatever
+	// the page, so that pages do not overlap; the results past it follow by
+	// relevance. Defaults to DefaultMMRPool.
+	MMRPool int
+	// Offset results are skipped, for pagination, and at most Limit are
+	// returned
+	Offset int
+	Limit  int
+}
+
+func (db *db) SetTags(id string, tags []string) {
+	util.Assert(db.rows != nil, "SetTags nil embeddings")
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.removeTagsLocked(id)
+
+	if len(tags) == 0 {
+		return
+	}
+
+	db.docTags[id] = append([]string(nil), tags...)
+	for _, tag := range tags {
+		if db.tagDocs[tag] == nil {
+			db.tagDocs[tag] = make(map[string]bool)
+		}
+		db.tagDocs[tag][id] = true
+	}
+}
+
+func (db *db) removeTagsLocked(id string) {
+	for _, tag := range db.docTags[id] {
+		delete(db.tagDocs[tag], id)
+		if len(db.tagDocs[tag]) == 0 {
+			delete(db.tagDocs, tag)
+		}
+	}
+	delete(db.docTags, id)
+}
+
+// candidatesLocked calls visit for a superset of the documents the query
+// selects, as few as the indexes allow
+func (db *db) candidatesLocked(query Query, visit func(id string, row row)) {
+	switch {
+	case len(query.Allow) > 0:
+		seen := make(map[string]bool, len(query.Allow))
+		for _, id := range query.Allow {
+			if row, ok := db.rows[id]; ok && !seen[id] {
+				seen[id] = true
+				visit(id, row)
+			}
+		}
+	case len(query.Tags) > 0:
+		// the rarest tag has the fewest documents to check
+		var rarest map[string]bool
+		for i, tag := range query.Tags {
+			if docs := db.tagDocs[tag]; i == 0 || len(docs) < len(rarest) {
+				rarest = docs
+			}
+		}
+		for id := range rarest {
+			if row, ok := db.rows[id]; ok {
+				visit(id, row)
+			}
+		}
+	default:
+		for id, row := range db.rows {
+			visit(id, row)
+		}
+	}
+}
+
+func (db *db) hasTagsLocked(id string, tags []string) bool {
+	for _, tag := range tags {
+		if !db.tagDocs[tag][id] {
+			return false
+		}
+	}
+	return true
+}
+
+func (db *db) Query(query Query) ([]Result, error) {
+	util.Assert(db.rows != nil, "Query nil embeddings")
+
+	if query.Limit <= 0 {
+		return nil, errors.New("query limit must be positive")
+	}
+	if query.Offset < 0 {
+		return nil, errors.New("query offset must not be negative")
+	}
+	if query.MMRLambda < 0 || query.MMRLambda > 1 {
+		return nil, errors.New("query MMR lambda must be between 0 and 1")
+	}
+
+	wanted := query.Offset + query.Limit
+	mmrPool := query.MMRPool
+	if mmrPool <= 0 {
+		mmrPool = DefaultMMRPool
+	}
+	pool := wanted
+	if query.MMR {
+		pool = max(wanted, mmrPool)
+	}
+
+	deny := make(map[string]bool, len(query.Deny))
+	for _, id := range query.Deny {
+		deny[id] = true
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	bestResults := newBestResults(pool)
+	queryNorm := mat.Norm(mat.NewVecDense(len(query.Vector), query.Vector), 2)
+
+	// brute-force, calculate cosine similarity with the selected embeddings
+	db.candidatesLocked(query, func(id string, row row) {
+		switch {
+		case row.empty(), deny[id], !strings.HasPrefix(id, query.Prefix):
+			return
+		case !query.From.IsZero() && row.stamp.Before(query.From):
+			return
+		case !query.To.IsZero() && !row.stamp.Before(query.To):
+			return
+		case !db.hasTagsLocked(id, query.Tags):
+			return
+		case query.Keep != nil && !query.Keep(id):
+			return
+		}
+
+		distance := row.distance(query.Vector, queryNorm)
+		if query.MinSimilarity > 0 && 1-distance < query.MinSimilarity {
+			return
+		}
+
+		bestResults.add(Result{
+			Path:     id,
+			Distance: distance,
+		})
+	})
+
+	results := bestResults.get()
+	if query.MMR {
+		n := min(mmrPool, len(results))
+		results = append(mmr(results[:n], db.rows, query.MMRLambda, n), results[n:]...)
+	}
+	if query.Offset >= len(results) {
+		return []Result{}, nil
+	}
+
+	return results[query.Offset:min(wanted, len(results))], nil
+}
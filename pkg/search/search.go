@@ -2,10 +2,14 @@ package search
 
 import (
 	"container/heap"
+	"math"
+	"slices"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/vasilisp/wikai/internal/util"
+	"github.com/vasilisp/wikai/pkg/embedding"
 	"gonum.org/v1/gonum/mat"
 )
 
@@ -28,45 +32,157 @@ func cosineDistance(a, b []float64) float64 {
 	return 1 - cosineSimilarity(a, b)
 }
 
+// row keeps the vector in the DB encoding; only the field for that encoding
+// is set
 type row struct {
-	vector []float64
-	stamp  time.Time
+	f64   []float64
+	f32   []float32
+	i8    []int8
+	scale float32
+	// norm of the stored vector, precomputed for cosine distance
+	norm  float64
+	stamp time.Time
 }
 
+func newRow(v []float64, encoding embedding.Encoding, stamp time.Time) row {
+	r := row{stamp: stamp}
+
+	switch encoding {
+	case embedding.Float32:
+		r.f32 = make([]float32, len(v))
+		sum := 0.0
+		for i, x := range v {
+			r.f32[i] = float32(x)
+			sum += float64(r.f32[i]) * float64(r.f32[i])
+		}
+		r.norm = math.Sqrt(sum)
+	case embedding.Int8:
+		r.i8, r.scale = embedding.QuantizeInt8(v)
+		sum := 0.0
+		for _, q := range r.i8 {
+			sum += float64(q) * float64(q)
+		}
+		r.norm = math.Sqrt(sum) * float64(r.scale)
+	default:
+		r.f64 = v
+		r.norm = mat.Norm(mat.NewVecDense(len(v), v), 2)
+	}
+
+	return r
+}
+
+func (r row) empty() bool {
+	return r.f64 == nil && r.f32 == nil && r.i8 == nil
+}
+
+// distance is the cosine distance between the row and a query of the given
+// norm
+func (r row) distance(query []float64, queryNorm float64) float64 {
+	if r.f64 != nil {
+		return cosineDistance(query, r.f64)
+	}
+
+	dot := 0.0
+	if r.f32 != nil {
+		for i, x := range r.f32[:min(len(r.f32), len(query))] {
+			dot += query[i] * float64(x)
+		}
+	} else {
+		for i, q := range r.i8[:min(len(r.i8), len(query))] {
+			dot += query[i] * float64(q)
+		}
+		dot *= float64(r.scale)
+	}
+
+	return 1 - dot/(queryNorm*r.norm)
+}
+
+// DB is safe for concurrent use by multiple goroutines
 type DB interface {
 	// Add adds an embedding to the database
 	Add(id string, emb []float64, stamp time.Time)
+	// Remove removes the embedding of a document, if any
+	Remove(id string)
+	// SetTags replaces the tags of a document, which Query can filter by; a
+	// document may have tags before it has an embedding
+	SetTags(id string, tags []string)
 	// Search searches the database for the most similar embeddings to the query
 	Search(query []float64, maxResults int) ([]Result, error)
+	// Query searches the documents the query selects for the most similar
+	// embeddings to its vector
+	Query(query Query) ([]Result, error)
 	// NumRows returns the number of rows in the database
 	NumRows() int
 	// DocStamp returns the timestamp of the document with the given id
 	DocStamp(id string) (time.Time, bool)
+	// SimilarPairs returns the pairs of documents at least as similar as
+	// minSimilarity, most similar first
+	SimilarPairs(minSimilarity float64) ([]Pair, error)
+	// Cluster groups the documents keep accepts into at most k clusters of
+	// similar embeddings, deterministically for a given seed
+	Cluster(k int, seed int64, keep func(id string) bool) ([]Cluster, error)
+	// Vector returns the embedding of a document, as stored
+	Vector(id string) ([]float64, bool)
+	// Version changes whenever an embedding is added or removed, so that
+	// results computed from the embeddings can be cached
+	Version() uint64
 	seal()
 }
 
 func (db *db) seal() {}
 
 type db struct {
-	rows map[string]row
+	mu       sync.RWMutex
+	rows     map[string]row
+	encoding embedding.Encoding
+	// docTags maps documents to their tags, and tagDocs tags to their
+	// documents
+	docTags map[string][]string
+	tagDocs map[string]map[string]bool
+	version uint64
 }
 
-func NewDB() DB {
+// NewDB creates a DB keeping vectors in the given encoding; Float32 halves
+// the memory of Float64 and Int8 divides it by eight, at some loss of
+// precision
+func NewDB(encoding embedding.Encoding) DB {
 	rows := make(map[string]row)
 
-	return &db{rows: rows}
+	return &db{
+		rows:     rows,
+		encoding: encoding,
+		docTags:  make(map[string][]string),
+		tagDocs:  make(map[string]map[string]bool),
+	}
 }
 
 func (db *db) Add(id string, emb []float64, stamp time.Time) {
 	util.Assert(db.rows != nil, "Add nil embeddings")
 
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
 	if _, ok := db.rows[id]; ok {
 		if db.rows[id].stamp.After(stamp) {
 			return
 		}
 	}
 
-	db.rows[id] = row{vector: emb, stamp: stamp}
+	db.rows[id] = newRow(emb, db.encoding, stamp)
+	db.version++
+}
+
+func (db *db) Remove(id string) {
+	util.Assert(db.rows != nil, "Remove nil embeddings")
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.rows[id]; ok {
+		delete(db.rows, id)
+		db.version++
+	}
+	db.removeTagsLocked(id)
 }
 
 type resultHeap []Result
@@ -118,30 +234,15 @@ func (br bestResults) get() []Result {
 }
 
 func (db *db) Search(query []float64, maxResults int) ([]Result, error) {
-	util.Assert(db.rows != nil, "Search nil embeddings")
-
-	bestResults := newBestResults(maxResults)
-
-	// brute-force, calculate cosine similarity with all embeddings
-	for id, row := range db.rows {
-		if row.vector == nil {
-			continue
-		}
-
-		distance := cosineDistance(query, row.vector)
-
-		bestResults.add(Result{
-			Path:     id,
-			Distance: distance,
-		})
-	}
-
-	return bestResults.get(), nil
+	return db.Query(Query{Vector: query, Limit: maxResults})
 }
 
 func (db *db) DocStamp(id string) (time.Time, bool) {
 	util.Assert(db.rows != nil, "DocStamp nil embeddings")
 
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
 	row, ok := db.rows[id]
 	if ok {
 		return row.stamp, true
@@ -150,8 +251,36 @@ func (db *db) DocStamp(id string) (time.Time, bool) {
 	return time.Time{}, false
 }
 
+func (db *db) Vector(id string) ([]float64, bool) {
+	util.Assert(db.rows != nil, "Vector nil embeddings")
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	row, ok := db.rows[id]
+	if !ok || row.empty() {
+		return nil, false
+	}
+
+	if row.f64 != nil {
+		// not shared with the caller
+		return slices.Clone(row.f64), true
+	}
+	return row.vector(), true
+}
+
+func (db *db) Version() uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.version
+}
+
 func (db *db) NumRows() int {
 	util.Assert(db.rows != nil, "Stats nil embeddings")
 
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
 	return len(db.rows)
 }
@@ -0,0 +1,343 @@
+package search
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vasilisp/wikai/pkg/embedding"
+)
+
+func randomVector(rng *rand.Rand, dimensions int) []float64 {
+	v := make([]float64, dimensions)
+	for i := range v {
+		v[i] = rng.NormFloat64()
+	}
+	return v
+}
+
+// TestConcurrentAccess hammers a DB with writers and readers; run with -race
+func TestConcurrentAccess(t *testing.T) {
+	const (
+		workers    = 8
+		operations = 500
+		documents  = 50
+		dimensions = 16
+	)
+
+	for _, encoding := range encodings {
+		t.Run(string(encoding), func(t *testing.T) {
+			db := NewDB(encoding)
+
+			var wg sync.WaitGroup
+			for w := range workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					rng := rand.New(rand.NewPCG(uint64(w), 0))
+					for range operations {
+						id := fmt.Sprintf("doc-%d", rng.IntN(documents))
+
+						switch rng.IntN(6) {
+						case 0, 1:
+							db.Add(id, randomVector(rng, dimensions), time.Now())
+						case 2:
+							db.Remove(id)
+						case 3:
+							db.SetTags(id, []string{"tag", fmt.Sprintf("tag-%d", rng.IntN(3))})
+						case 4:
+							_, err := db.Query(Query{
+								Vector:    randomVector(rng, dimensions),
+								Tags:      []string{"tag"},
+								MMR:       true,
+								MMRLambda: 0.5,
+								Limit:     5,
+							})
+							if err != nil {
+								t.Errorf("Query: %v", err)
+							}
+						default:
+							results, err := db.Search(randomVector(rng, dimensions), 5)
+							if err != nil {
+								t.Errorf("Search: %v", err)
+							}
+							if len(results) > 5 {
+								t.Errorf("got %d results, want at most 5", len(results))
+							}
+							db.Vector(id)
+							db.DocStamp(id)
+							db.NumRows()
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			if rows := db.NumRows(); rows > documents {
+				t.Errorf("got %d rows for %d documents", rows, documents)
+			}
+		})
+	}
+}
+
+func TestQueryFilters(t *testing.T) {
+	db := NewDB(embedding.Float64)
+	now := time.Now()
+
+	db.Add("a/1", []float64{1, 0}, now.Add(-48*time.Hour))
+	db.Add("a/2", []float64{1, 0.1}, now)
+	db.Add("b/1", []float64{0, 1}, now)
+	db.SetTags("a/2", []string{"x"})
+	db.SetTags("b/1", []string{"x"})
+
+	for _, test := range []struct {
+		name  string
+		query Query
+		want  []string
+	}{
+		{"all", Query{}, []string{"a/1", "a/2", "b/1"}},
+		{"prefix", Query{Prefix: "a/"}, []string{"a/1", "a/2"}},
+		{"tags", Query{Tags: []string{"x"}}, []string{"a/2", "b/1"}},
+		{"from", Query{From: now.Add(-time.Hour)}, []string{"a/2", "b/1"}},
+		{"deny", Query{Deny: []string{"a/1"}}, []string{"a/2", "b/1"}},
+		{"allow", Query{Allow: []string{"b/1", "missing"}}, []string{"b/1"}},
+		{"min similarity", Query{MinSimilarity: 0.9}, []string{"a/1", "a/2"}},
+		{"keep", Query{Keep: func(id string) bool { return id != "a/2" }}, []string{"a/1", "b/1"}},
+		{"offset", Query{Offset: 2}, []string{"b/1"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			query := test.query
+			query.Vector = []float64{1, 0}
+			if query.Limit == 0 {
+				query.Limit = 10
+			}
+
+			results, err := db.Query(query)
+			if err != nil {
+				t.Fatalf("Query: %v", err)
+			}
+
+			got := make([]string, len(results))
+			for i, result := range results {
+				got[i] = result.Path
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+var encodings = []embedding.Encoding{embedding.Float64, embedding.Float32, embedding.Int8}
+
+// randomDBs adds documents of random vectors to a DB in each encoding
+func randomDBs(documents, dimensions int) map[embedding.Encoding]DB {
+	dbs := make(map[embedding.Encoding]DB, len(encodings))
+	for _, encoding := range encodings {
+		dbs[encoding] = NewDB(encoding)
+	}
+
+	rng := rand.New(rand.NewPCG(1, 0))
+	now := time.Now()
+	for d := range documents {
+		v := randomVector(rng, dimensions)
+		for _, db := range dbs {
+			db.Add(fmt.Sprintf("doc-%d", d), v, now)
+		}
+	}
+
+	return dbs
+}
+
+// TestRecall checks that the smaller encodings find nearly the same nearest
+// neighbours as Float64
+func TestRecall(t *testing.T) {
+	const (
+		documents  = 2000
+		dimensions = 256
+		queries    = 50
+		k          = 10
+	)
+
+	dbs := randomDBs(documents, dimensions)
+	rng := rand.New(rand.NewPCG(2, 0))
+
+	minRecall := map[embedding.Encoding]float64{
+		embedding.Float32: 0.99,
+		embedding.Int8:    0.9,
+	}
+	found := make(map[embedding.Encoding]int)
+	for range queries {
+		query := randomVector(rng, dimensions)
+
+		exact, err := dbs[embedding.Float64].Search(query, k)
+		if err != nil {
+			t.Fatalf("Search: %v", err)
+		}
+		want := make(map[string]bool, k)
+		for _, result := range exact {
+			want[result.Path] = true
+		}
+
+		for encoding := range minRecall {
+			results, err := dbs[encoding].Search(query, k)
+			if err != nil {
+				t.Fatalf("Search: %v", err)
+			}
+			for _, result := range results {
+				if want[result.Path] {
+					found[encoding]++
+				}
+			}
+		}
+	}
+
+	for encoding, want := range minRecall {
+		recall := float64(found[encoding]) / (queries * k)
+		t.Logf("%s recall@%d: %.3f", encoding, k, recall)
+		if recall < want {
+			t.Errorf("%s recall@%d is %.3f, want at least %.2f", encoding, k, recall, want)
+		}
+	}
+}
+
+// BenchmarkQuery measures a query over 10000 documents in each encoding
+func BenchmarkQuery(b *testing.B) {
+	const dimensions = 1536
+
+	dbs := randomDBs(10000, dimensions)
+	query := randomVector(rand.New(rand.NewPCG(2, 0)), dimensions)
+
+	for _, encoding := range encodings {
+		b.Run(string(encoding), func(b *testing.B) {
+			for b.Loop() {
+				if _, err := dbs[encoding].Search(query, 10); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMemory reports the heap a document takes in each encoding
+func BenchmarkMemory(b *testing.B) {
+	const (
+		documents  = 1000
+		dimensions = 1536
+	)
+
+	for _, encoding := range encodings {
+		b.Run(string(encoding), func(b *testing.B) {
+			var perDocument float64
+			for b.Loop() {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				db := NewDB(encoding)
+				rng := rand.New(rand.NewPCG(1, 0))
+				now := time.Now()
+				for d := range documents {
+					db.Add(fmt.Sprintf("doc-%d", d), randomVector(rng, dimensions), now)
+				}
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				perDocument = float64(after.HeapAlloc-before.HeapAlloc) / documents
+				runtime.KeepAlive(db)
+			}
+			b.ReportMetric(perDocument, "heap-B/doc")
+		})
+	}
+}
+
+// TestMMRPagination checks that pages of MMR results do not depend on the
+// offset, so that they neither overlap nor skip results
+func TestMMRPagination(t *testing.T) {
+	const (
+		documents = 40
+		pageSize  = 5
+	)
+
+	db := randomDBs(documents, 16)[embedding.Float64]
+	vector := randomVector(rand.New(rand.NewPCG(2, 0)), 16)
+
+	for _, lambda := range []float64{0, 0.5, 1} {
+		t.Run(fmt.Sprint(lambda), func(t *testing.T) {
+			query := Query{Vector: vector, MMR: true, MMRLambda: lambda, MMRPool: 20, Limit: documents}
+			all, err := db.Query(query)
+			if err != nil {
+				t.Fatalf("Query: %v", err)
+			}
+			if len(all) != documents {
+				t.Fatalf("got %d results, want %d", len(all), documents)
+			}
+
+			var paged []Result
+			for offset := 0; offset < documents; offset += pageSize {
+				query.Offset, query.Limit = offset, pageSize
+				page, err := db.Query(query)
+				if err != nil {
+					t.Fatalf("Query: %v", err)
+				}
+				paged = append(paged, page...)
+			}
+
+			if fmt.Sprint(paged) != fmt.Sprint(all) {
+				t.Errorf("pages %v differ from %v", paged, all)
+			}
+		})
+	}
+}
+
+func TestSimilarPairs(t *testing.T) {
+	for _, encoding := range encodings {
+		t.Run(string(encoding), func(t *testing.T) {
+			db := NewDB(encoding)
+			now := time.Now()
+
+			db.Add("b", []float64{1, 0.1, 0}, now)
+			db.Add("a", []float64{1, 0, 0}, now)
+			db.Add("d", []float64{0, 1, 0.3}, now)
+			db.Add("c", []float64{0, 1, 0}, now)
+			db.Add("e", []float64{0, 0, 1}, now)
+			db.Add("zero", []float64{0, 0, 0}, now)
+
+			pairs, err := db.SimilarPairs(0.9)
+			if err != nil {
+				t.Fatalf("SimilarPairs: %v", err)
+			}
+			// a-b is more similar than c-d
+			want := []Pair{{A: "a", B: "b", Similarity: 0.995}, {A: "c", B: "d", Similarity: 0.958}}
+			if len(pairs) != len(want) {
+				t.Fatalf("got pairs %v, want %v", pairs, want)
+			}
+			for i, pair := range pairs {
+				if pair.A != want[i].A || pair.B != want[i].B || math.Abs(pair.Similarity-want[i].Similarity) > 0.01 {
+					t.Errorf("pair %d is %v, want %v", i, pair, want[i])
+				}
+			}
+
+			// a threshold of 1 keeps identical documents only
+			db.Add("f", []float64{0, 0, 2}, now)
+			pairs, err = db.SimilarPairs(1)
+			if err != nil {
+				t.Fatalf("SimilarPairs: %v", err)
+			}
+			if encoding == embedding.Float64 && (len(pairs) != 1 || pairs[0].A != "e" || pairs[0].B != "f") {
+				t.Errorf("got pairs %v at similarity 1, want e-f", pairs)
+			}
+
+			for _, threshold := range []float64{0, -0.5, 1.5} {
+				if _, err := db.SimilarPairs(threshold); err == nil {
+					t.Errorf("SimilarPairs(%v) accepted", threshold)
+				}
+			}
+		})
+	}
+}